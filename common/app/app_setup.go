@@ -1,12 +1,21 @@
 package app
 
 import (
+	"context"
 	"fmt"
+	"github.com/apex/gateway"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"webhooks/common"
 	"webhooks/common/storage"
@@ -18,8 +27,12 @@ const (
 	_ = iota
 	StorageTypeS3
 	StorageTypeDynamoDb
+	StorageTypeFile
 )
 
+// file store in the write ahead log directory of a source, holding the objects its buffer gave up on
+const deadLetterFileName = "dead-letter.data"
+
 func AppInitStrict(storageType StorageType) *App {
 	a, err := AppInit(storageType)
 	if err != nil {
@@ -28,8 +41,8 @@ func AppInitStrict(storageType StorageType) *App {
 	return a
 }
 
-// tries to init anything we need in the lambdas, returns an error if something goes wrong
-func AppInit(storageType StorageType) (*App, error) {
+// the aws session configured by AWS_CREDENTIALS and REGION - for tools which need only the aws clients
+func NewAwsSession() (*session.Session, error) {
 	var awsCredentials *credentials.Credentials
 	credsPath := os.Getenv("AWS_CREDENTIALS")
 	if credsPath != "" {
@@ -40,54 +53,235 @@ func AppInit(storageType StorageType) (*App, error) {
 		awsRegion = "eu-central-1"
 	}
 
-	sess, err := session.NewSession(&aws.Config{
+	return session.NewSession(&aws.Config{
 		Region:      aws.String(awsRegion),
 		Credentials: awsCredentials,
 	})
+}
 
+// tries to init anything we need in the lambdas, returns an error if something goes wrong
+func AppInit(storageType StorageType) (*App, error) {
+	sess, err := NewAwsSession()
 	if err != nil {
 		panic(err)
 	}
 
-	var store storage.Store
+	// every source gets its own namespace in the same table/bucket/directory
+	newStore := func(source string) (storage.Store, error) {
+		switch storageType {
+		case StorageTypeS3:
+			options := s3StoreOptionsFromEnv()
+			options.Source = source
+			return storage.NewS3StoreWithOptions(sess, os.Getenv("S3_BUCKET"), options), nil
+		case StorageTypeDynamoDb:
+			options := dynamoDbStoreOptionsFromEnv()
+			options.Source = source
+			return storage.NewDynamoDbStoreWithOptions(sess, os.Getenv("DYNAMO_TABLE"), options), nil
+		case StorageTypeFile:
+			fileName := "webhooks.data"
+			if source != DefaultWebHookSource {
+				fileName = fmt.Sprintf("webhooks-%s.data", source)
+			}
+			return storage.NewFileStore(filepath.Join(os.Getenv("DATA_DIR"), fileName))
+		default:
+			return nil, fmt.Errorf("unknown storage type %v", storageType)
+		}
+	}
+
+	bufferOptions := common.ObjectBufferOptions{
+		MaxBufferSize:  100,
+		MaxBufferBytes: 4 * 1024 * 1024,
+		FlushTimeout:   time.Minute,
+		FlushWorkers:   4,
+		MaxInFlight:    8,
+		AddTimeout:     time.Second * 5,
+	}
+
+	configs, err := LoadSourceConfigs()
+	if err != nil {
+		return nil, err
+	}
+	maxBodyBytes, err := maxBodyBytesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	metadataHeaders := metadataHeadersFromEnv()
+	trustedProxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string]*Source)
+	for _, config := range configs {
+		store, err := newStore(config.Name)
+		if err != nil {
+			return nil, err
+		}
+		store = storage.WithSource(config.Name, store)
+
+		options := config.bufferOptions(bufferOptions)
+		// the accepted webhooks survive restarts only if they're written to a local write ahead log first
+		// the default source keeps using WAL_DIR itself, so logs left by older versions are still replayed
+		if walDir := os.Getenv("WAL_DIR"); walDir != "" {
+			if config.Name != DefaultWebHookSource {
+				walDir = filepath.Join(walDir, config.Name)
+			}
+			options.WriteAheadLog, err = storage.NewWriteAheadLog(walDir)
+			if err != nil {
+				return nil, err
+			}
+			// the objects the store doesn't accept are kept next to the log, instead of being replayed after each restart
+			options.DeadLetterStore, err = storage.NewFileStore(filepath.Join(walDir, deadLetterFileName))
+			if err != nil {
+				return nil, err
+			}
+		}
+		collector, err := common.NewObjectBufferWithOptions(store, options)
+		if err != nil {
+			return nil, err
+		}
 
-	switch storageType {
-	case StorageTypeS3:
-		store = storage.NewDynamoDbStore(sess, os.Getenv("S3_BUCKET"))
-	case StorageTypeDynamoDb:
-		store = storage.NewDynamoDbStore(sess, os.Getenv("DYNAMO_TABLE"))
-	default:
-		return nil, fmt.Errorf("unknown storage type %v", storageType)
+		source := &Source{
+			Name:            config.Name,
+			AckMode:         config.ackMode(),
+			MaxBodyBytes:    config.MaxBodyBytes,
+			MetadataHeaders: config.MetadataHeaders,
+			Store:           store,
+			Collector:       collector,
+		}
+		if source.MaxBodyBytes == 0 {
+			source.MaxBodyBytes = maxBodyBytes
+		}
+		if source.MetadataHeaders == nil {
+			source.MetadataHeaders = metadataHeaders
+		}
+		sources[config.Name] = source
 	}
 
-	dataCollector := common.NewObjectBuffer(store, 100, time.Minute)
+	signatures, err := LoadSignatureVerifiers()
+	if err != nil {
+		return nil, err
+	}
+	for source := range signatures {
+		if _, ok := sources[source]; !ok {
+			return nil, fmt.Errorf("signature config for unknown source %s", source)
+		}
+	}
 
 	return &App{
-		Session:   sess,
-		Store:     store,
-		Collector: dataCollector,
+		Session:        sess,
+		Sources:        sources,
+		Signatures:     signatures,
+		TrustedProxies: trustedProxies,
 	}, nil
 }
 
-// struct containing all required stuff needed by both master/slave lambdas
-type App struct {
-	Session   *session.Session
-	Store     storage.Store
-	Collector *common.ObjectBuffer
+// S3_KEY_LAYOUT=hourly groups the objects by the hour they were received in
+// S3_SEGMENTS=true saves each buffer flush as a single object
+// S3_SKIP_MALFORMED_KEYS=true logs and skips the keys which aren't object ids instead of failing the sync
+func s3StoreOptionsFromEnv() storage.S3StoreOptions {
+	options := storage.S3StoreOptions{
+		KeyLayout: storage.S3KeyLayoutFlat,
+	}
+	options.Segments, _ = strconv.ParseBool(os.Getenv("S3_SEGMENTS"))
+	if skip, _ := strconv.ParseBool(os.Getenv("S3_SKIP_MALFORMED_KEYS")); skip {
+		options.MalformedKeys = storage.S3MalformedKeysLenient
+		options.OnMalformedKey = func(key string, err error) {
+			common.Logger.WithError(err).WithField("key", key).Warn("skipped malformed s3 key")
+		}
+	}
+	if os.Getenv("S3_KEY_LAYOUT") == "hourly" {
+		options.KeyLayout = storage.S3KeyLayoutHourly
+	}
+	return options
 }
 
-// receives post requests containing json objects
-// writes the json data in storage
-//this is common for slave/master - only the storage is different for them (slave -> s3, master -> dynamoDb)
-func (app *App) CreateWebHookHttpHandler() http.HandlerFunc {
-	return func(writer http.ResponseWriter, request *http.Request) {
-		obj, err := common.ReadWebHookObject(request.Body)
-		if err != nil {
-			common.Logger.WithError(err).Error("error while reading webhook object")
-			writer.WriteHeader(http.StatusInternalServerError)
-		} else {
-			app.Collector.Add(obj)
-			writer.WriteHeader(http.StatusOK)
+// DYNAMO_LAYOUT=raw saves the payloads exactly as they were received
+// DYNAMO_COMPRESS, DYNAMO_INDEXED_FIELDS(comma separated) and DYNAMO_OVERFLOW_BUCKET configure the raw layout
+func dynamoDbStoreOptionsFromEnv() storage.DynamoDbStoreOptions {
+	options := storage.DynamoDbStoreOptions{
+		Layout:         storage.DynamoDbLayoutFlat,
+		OverflowBucket: os.Getenv("DYNAMO_OVERFLOW_BUCKET"),
+	}
+	if os.Getenv("DYNAMO_LAYOUT") == "raw" {
+		options.Layout = storage.DynamoDbLayoutRaw
+	}
+	options.Compress, _ = strconv.ParseBool(os.Getenv("DYNAMO_COMPRESS"))
+	for _, field := range strings.Split(os.Getenv("DYNAMO_INDEXED_FIELDS"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			options.IndexedFields = append(options.IndexedFields, field)
 		}
 	}
+	return options
+}
+
+// serves the handler as a lambda function behind api gateway
+// if LISTEN_ADDR is defined, it runs as a plain http server instead - useful for local development and non aws deployments
+// returns http.ErrServerClosed once Shutdown was called
+func (app *App) ListenAndServe(handler http.Handler) error {
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		return gateway.ListenAndServe(":3000", handler)
+	}
+
+	app.serverMux.Lock()
+	app.server = &http.Server{Addr: addr, Handler: handler}
+	app.serverMux.Unlock()
+
+	return app.server.ListenAndServe()
+}
+
+// max time spent on draining the collector once asked to stop
+const ShutdownTimeout = time.Second * 20
+
+// blocks until the process is asked to stop
+func WaitForShutdownSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return <-signals
+}
+
+// stops accepting requests, waits for the running ones and then saves everything left in the collectors
+// returns the first error, but every collector gets the chance to save its objects
+func (app *App) Shutdown(ctx context.Context) error {
+	app.serverMux.Lock()
+	server := app.server
+	app.serverMux.Unlock()
+
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			common.Logger.WithError(err).Error("error while stopping the http server")
+		}
+	}
+
+	errs := make(chan error, len(app.Sources))
+	for _, source := range app.Sources {
+		go func(source *Source) {
+			err := source.Collector.Close(ctx)
+			if err != nil {
+				common.Logger.WithError(err).WithField("source", source.Name).Error("couldn't save all buffered webhooks")
+			}
+			errs <- err
+		}(source)
+	}
+
+	var firstErr error
+	for range app.Sources {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// struct containing all required stuff needed by both master/slave lambdas
+type App struct {
+	Session    *session.Session
+	Sources    map[string]*Source           // by name, always has the default source
+	Signatures map[string]SignatureVerifier // by source, sources missing from it accept unsigned webhooks
+	// the X-Forwarded-For header of requests coming from these is used for finding the client ip
+	TrustedProxies []*net.IPNet
+
+	serverMux sync.Mutex
+	server    *http.Server // set only when running as a plain http server
 }
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+	"webhooks/common/storage"
+)
+
+// the store wrapped by storage.WithSource
+func sourceStoreOf(a *App, name string) interface{} {
+	source, _ := a.Source(name)
+	return reflect.ValueOf(source.Store).FieldByName("Store").Interface()
+}
+
+func TestAppInitStorageType(t *testing.T) {
+	a, err := AppInit(StorageTypeS3)
+	assert.NoError(t, err)
+	assert.IsType(t, storage.NewS3Store(a.Session, ""), sourceStoreOf(a, DefaultWebHookSource))
+
+	a, err = AppInit(StorageTypeDynamoDb)
+	assert.NoError(t, err)
+	assert.IsType(t, storage.NewDynamoDbStore(a.Session, ""), sourceStoreOf(a, DefaultWebHookSource))
+
+	_, err = AppInit(StorageType(0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"webhooks/common/data"
+)
+
+// headers saved with the webhooks of the sources which don't set metadata_headers, unless WEBHOOK_METADATA_HEADERS is defined
+var DefaultMetadataHeaders = []string{"Content-Type", "User-Agent"}
+
+// WEBHOOK_METADATA_HEADERS (comma separated) overrides DefaultMetadataHeaders
+func metadataHeadersFromEnv() []string {
+	value, ok := os.LookupEnv("WEBHOOK_METADATA_HEADERS")
+	if !ok {
+		return DefaultMetadataHeaders
+	}
+	headers := make([]string, 0)
+	for _, header := range strings.Split(value, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// TRUSTED_PROXIES (comma separated ips and cidrs) are the proxies whose X-Forwarded-For header is used for finding the client ip
+func trustedProxiesFromEnv() ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, proxy, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", value, err)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+func (app *App) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range app.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the address the request came from - if it came through trusted proxies, the first untrusted address of X-Forwarded-For
+// the header is read from right to left, since only the entries added by trusted proxies can be believed
+func (app *App) clientIP(request *http.Request) string {
+	addr, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		addr = request.RemoteAddr
+	}
+	if !app.isTrustedProxy(addr) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(request.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// whatever is left of a malformed entry can't be believed either
+			break
+		}
+		addr = hop
+		if !app.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// the metadata saved with the webhooks of a request - only the source's metadata headers are kept
+func (app *App) webHookMetadata(source *Source, request *http.Request, receivedAt time.Time) *data.WebHookMetadata {
+	metadata := &data.WebHookMetadata{
+		Method:     request.Method,
+		RemoteAddr: app.clientIP(request),
+		Query:      request.URL.RawQuery,
+		ReceivedAt: receivedAt,
+	}
+	for _, header := range source.MetadataHeaders {
+		header = http.CanonicalHeaderKey(header)
+		if values, ok := request.Header[header]; ok {
+			if metadata.Headers == nil {
+				metadata.Headers = make(map[string][]string)
+			}
+			metadata.Headers[header] = values
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+	"webhooks/common"
+	"webhooks/common/storage"
+)
+
+func TestClientIP(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+	proxies, err := trustedProxiesFromEnv()
+	assert.NoError(t, err)
+	app := &App{TrustedProxies: proxies}
+
+	clientIP := func(remoteAddr string, forwardedFor ...string) string {
+		request := newWebHookRequest("/webhook", `{}`)
+		request.RemoteAddr = remoteAddr
+		for _, value := range forwardedFor {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+		return app.clientIP(request)
+	}
+
+	// the header of untrusted clients is ignored
+	assert.Equal(t, "203.0.113.7", clientIP("203.0.113.7:1234", "198.51.100.1"))
+	assert.Equal(t, "203.0.113.7", clientIP("10.1.2.3:1234", "198.51.100.1, 203.0.113.7"))
+	assert.Equal(t, "203.0.113.7", clientIP("10.1.2.3:1234", "198.51.100.1", "203.0.113.7, 192.0.2.1"))
+	assert.Equal(t, "10.1.2.3", clientIP("10.1.2.3:1234"))
+	// all hops are trusted
+	assert.Equal(t, "10.0.0.1", clientIP("10.1.2.3:1234", "10.0.0.1"))
+	// nothing left of a malformed entry is used
+	assert.Equal(t, "10.0.0.1", clientIP("10.1.2.3:1234", "198.51.100.1, unknown, 10.0.0.1"))
+	assert.Equal(t, "192.0.2.1", clientIP("192.0.2.1"))
+
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/33")
+	_, err = trustedProxiesFromEnv()
+	assert.Error(t, err)
+}
+
+func TestWebHookHandlerMetadata(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: DefaultSyncFlushDelay})
+	defaultSource(app).AckMode = WebHookAckSync
+	defaultSource(app).MetadataHeaders = []string{"user-agent", "X-Event-Type", "X-Missing"}
+	handler := app.CreateWebHookHttpHandler()
+
+	before := time.Now()
+	request := newWebHookRequest("/webhook?event=push", `{"a":1}`)
+	request.RemoteAddr = "203.0.113.7:1234"
+	request.Header.Set("User-Agent", "sender/1.0")
+	request.Header.Set("X-Event-Type", "push")
+	request.Header.Set("X-Signature", "secret")
+	assert.Equal(t, http.StatusOK, serveWebHook(handler, request).Code)
+
+	request = newWebHookRequest("/webhook", `[{"b":1},{"b":2}]`)
+	request.RemoteAddr = "198.51.100.1:1234"
+	assert.Equal(t, http.StatusOK, serveWebHook(handler, request).Code)
+
+	ids, err := storage.LoadStorageKeysSync(context.Background(), store, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	objects, err := storage.LoadStorageObjectsSync(context.Background(), store, ids)
+	assert.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	for _, obj := range objects {
+		metadata := obj.Metadata
+		if !assert.NotNil(t, metadata) {
+			continue
+		}
+		assert.Equal(t, http.MethodPost, metadata.Method)
+		assert.False(t, metadata.ReceivedAt.Before(before))
+		if string(obj.JsonData) == `{"a":1}` {
+			assert.Equal(t, "203.0.113.7", metadata.RemoteAddr)
+			assert.Equal(t, "event=push", metadata.Query)
+			assert.Equal(t, map[string][]string{"User-Agent": {"sender/1.0"}, "X-Event-Type": {"push"}}, metadata.Headers)
+		} else {
+			assert.Equal(t, "198.51.100.1", metadata.RemoteAddr)
+			assert.Empty(t, metadata.Query)
+			assert.Nil(t, metadata.Headers)
+		}
+	}
+}
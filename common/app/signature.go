@@ -0,0 +1,206 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureSchemeGithub = "github"
+	SignatureSchemeStripe = "stripe"
+	SignatureSchemeHmac   = "hmac"
+
+	githubSignatureHeader = "X-Hub-Signature-256"
+	stripeSignatureHeader = "Stripe-Signature"
+	defaultHmacHeader     = "X-Signature"
+
+	defaultStripeTolerance = time.Minute * 5
+)
+
+// checks that a webhook was sent by whoever knows the secret
+type SignatureVerifier interface {
+	// returns why the signature isn't valid - the error never contains the secrets or the signatures
+	Verify(header http.Header, body []byte) error
+}
+
+// describes how the webhooks of a source are signed
+// multiple secrets can be active at the same time, so they can be rotated without rejecting webhooks
+type SignatureConfig struct {
+	Source  string   `json:"source"`
+	Scheme  string   `json:"scheme"`
+	Secrets []string `json:"secrets"`
+	// header holding the hex encoded signature - only for the hmac scheme, defaults to X-Signature
+	Header string `json:"header,omitempty"`
+	// max age of a signature - only for the stripe scheme, defaults to 300
+	ToleranceSeconds int `json:"tolerance_seconds,omitempty"`
+}
+
+func (c *SignatureConfig) verifier() (SignatureVerifier, error) {
+	if c.Source == "" {
+		return nil, errors.New("signature source is required")
+	}
+	if len(c.Secrets) == 0 {
+		return nil, fmt.Errorf("source %s: at least one secret is required", c.Source)
+	}
+	secrets := make([][]byte, len(c.Secrets))
+	for i, secret := range c.Secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("source %s: empty secret", c.Source)
+		}
+		secrets[i] = []byte(secret)
+	}
+
+	switch c.Scheme {
+	case SignatureSchemeGithub:
+		return &hmacVerifier{header: githubSignatureHeader, prefix: "sha256=", secrets: secrets}, nil
+	case SignatureSchemeHmac:
+		header := c.Header
+		if header == "" {
+			header = defaultHmacHeader
+		}
+		return &hmacVerifier{header: header, secrets: secrets}, nil
+	case SignatureSchemeStripe:
+		tolerance := defaultStripeTolerance
+		if c.ToleranceSeconds > 0 {
+			tolerance = time.Second * time.Duration(c.ToleranceSeconds)
+		}
+		return &stripeVerifier{tolerance: tolerance, secrets: secrets, now: time.Now}, nil
+	default:
+		return nil, fmt.Errorf("source %s: unknown signature scheme %q", c.Source, c.Scheme)
+	}
+}
+
+// loads the signature verifiers of each source from the json file WEBHOOK_SIGNATURES points to - [{source, scheme, secrets, ...}]
+// sources missing from the file accept unsigned webhooks
+func LoadSignatureVerifiers() (map[string]SignatureVerifier, error) {
+	verifiers := make(map[string]SignatureVerifier)
+
+	path := os.Getenv("WEBHOOK_SIGNATURES")
+	if path == "" {
+		return verifiers, nil
+	}
+
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*SignatureConfig
+	if err = json.Unmarshal(jsonData, &configs); err != nil {
+		return nil, fmt.Errorf("invalid signatures config %s: %v", path, err)
+	}
+
+	for _, config := range configs {
+		if _, ok := verifiers[config.Source]; ok {
+			return nil, fmt.Errorf("duplicate signature config for source %s", config.Source)
+		}
+		verifier, err := config.verifier()
+		if err != nil {
+			return nil, err
+		}
+		verifiers[config.Source] = verifier
+	}
+	return verifiers, nil
+}
+
+func hmacSha256(secret []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// true if the signature matches one of the secrets, compared in constant time
+func matchesAnySecret(secrets [][]byte, signature []byte, parts ...[]byte) bool {
+	for _, secret := range secrets {
+		if hmac.Equal(signature, hmacSha256(secret, parts...)) {
+			return true
+		}
+	}
+	return false
+}
+
+// the hex encoded hmac-sha256 of the body in a header, ex github's X-Hub-Signature-256: sha256=<hex>
+type hmacVerifier struct {
+	header  string
+	prefix  string
+	secrets [][]byte
+}
+
+func (v *hmacVerifier) Verify(header http.Header, body []byte) error {
+	value := header.Get(v.header)
+	if value == "" {
+		return fmt.Errorf("missing %s header", v.header)
+	}
+	if !strings.HasPrefix(value, v.prefix) {
+		return fmt.Errorf("%s header doesn't start with %q", v.header, v.prefix)
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(value, v.prefix))
+	if err != nil {
+		return fmt.Errorf("%s header isn't hex encoded", v.header)
+	}
+	if !matchesAnySecret(v.secrets, signature, body) {
+		return fmt.Errorf("%s header doesn't match any of the %d secrets", v.header, len(v.secrets))
+	}
+	return nil
+}
+
+// Stripe-Signature: t=<unix timestamp>,v1=<hex hmac-sha256 of "<timestamp>.<body>">[,v1=...]
+// the timestamp has to be within the tolerance, so captured requests can't be replayed later
+type stripeVerifier struct {
+	tolerance time.Duration
+	secrets   [][]byte
+	now       func() time.Time
+}
+
+func (v *stripeVerifier) Verify(header http.Header, body []byte) error {
+	value := header.Get(stripeSignatureHeader)
+	if value == "" {
+		return fmt.Errorf("missing %s header", stripeSignatureHeader)
+	}
+
+	var timestamp string
+	signatures := make([][]byte, 0)
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			if signature, err := hex.DecodeString(kv[1]); err == nil {
+				signatures = append(signatures, signature)
+			}
+		}
+	}
+
+	unixSecs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s header has no valid timestamp", stripeSignatureHeader)
+	}
+	if age := v.now().Sub(time.Unix(unixSecs, 0)); age > v.tolerance || age < -v.tolerance {
+		return fmt.Errorf("%s timestamp is %v away from now, more than the %v tolerance", stripeSignatureHeader, age.Round(time.Second), v.tolerance)
+	}
+	if len(signatures) == 0 {
+		return fmt.Errorf("%s header has no v1 signatures", stripeSignatureHeader)
+	}
+
+	for _, signature := range signatures {
+		if matchesAnySecret(v.secrets, signature, []byte(timestamp), []byte("."), body) {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the %d %s signatures match any of the %d secrets", len(signatures), stripeSignatureHeader, len(v.secrets))
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+	"webhooks/common"
+	"webhooks/common/storage"
+)
+
+func sign(secret string, parts ...string) string {
+	byteParts := make([][]byte, len(parts))
+	for i, part := range parts {
+		byteParts[i] = []byte(part)
+	}
+	return hex.EncodeToString(hmacSha256([]byte(secret), byteParts...))
+}
+
+func newVerifier(t *testing.T, config SignatureConfig) SignatureVerifier {
+	config.Source = "test"
+	verifier, err := config.verifier()
+	assert.NoError(t, err)
+	return verifier
+}
+
+func TestGithubSignature(t *testing.T) {
+	verifier := newVerifier(t, SignatureConfig{Scheme: SignatureSchemeGithub, Secrets: []string{"old", "new"}})
+	body := []byte(`{"a":1}`)
+
+	for _, secret := range []string{"old", "new"} {
+		header := http.Header{}
+		header.Set("X-Hub-Signature-256", "sha256="+sign(secret, string(body)))
+		assert.NoError(t, verifier.Verify(header, body), "any of the active secrets should be accepted")
+	}
+
+	header := http.Header{}
+	assert.Error(t, verifier.Verify(header, body))
+
+	header.Set("X-Hub-Signature-256", sign("new", string(body)))
+	assert.Error(t, verifier.Verify(header, body), "the sha256= prefix is required")
+
+	header.Set("X-Hub-Signature-256", "sha256="+sign("revoked", string(body)))
+	err := verifier.Verify(header, body)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "new")
+	assert.NotContains(t, err.Error(), sign("revoked", string(body)), "the error shouldn't leak the signature")
+}
+
+func TestHmacSignature(t *testing.T) {
+	verifier := newVerifier(t, SignatureConfig{Scheme: SignatureSchemeHmac, Secrets: []string{"secret"}, Header: "X-Custom-Signature"})
+	body := []byte(`{"a":1}`)
+
+	header := http.Header{}
+	header.Set("X-Custom-Signature", sign("secret", string(body)))
+	assert.NoError(t, verifier.Verify(header, body))
+	assert.Error(t, verifier.Verify(header, []byte(`{"a":2}`)))
+
+	header.Set("X-Custom-Signature", "not hex")
+	assert.Error(t, verifier.Verify(header, body))
+}
+
+func TestStripeSignature(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	verifier := newVerifier(t, SignatureConfig{Scheme: SignatureSchemeStripe, Secrets: []string{"whsec"}, ToleranceSeconds: 60})
+	verifier.(*stripeVerifier).now = func() time.Time { return now }
+	body := []byte(`{"a":1}`)
+
+	stripeHeader := func(timestamp time.Time, signatures ...string) http.Header {
+		value := fmt.Sprintf("t=%d", timestamp.Unix())
+		for _, signature := range signatures {
+			value += ",v1=" + signature
+		}
+		header := http.Header{}
+		header.Set("Stripe-Signature", value)
+		return header
+	}
+	signAt := func(secret string, timestamp time.Time) string {
+		return sign(secret, fmt.Sprintf("%d", timestamp.Unix()), ".", string(body))
+	}
+
+	sent := now.Add(-time.Second * 30)
+	assert.NoError(t, verifier.Verify(stripeHeader(sent, signAt("other", sent), signAt("whsec", sent)), body))
+	assert.Error(t, verifier.Verify(stripeHeader(sent, signAt("other", sent)), body))
+
+	sent = now.Add(-time.Minute * 2)
+	err := verifier.Verify(stripeHeader(sent, signAt("whsec", sent)), body)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tolerance")
+
+	// the timestamp is part of the signed payload
+	assert.Error(t, verifier.Verify(stripeHeader(now, signAt("whsec", sent)), body))
+}
+
+func TestLoadSignatureVerifiers(t *testing.T) {
+	f, err := ioutil.TempFile("", "signatures")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[
+		{"source": "default", "scheme": "github", "secrets": ["s1"]},
+		{"source": "stripe", "scheme": "stripe", "secrets": ["s2", "s3"], "tolerance_seconds": 10}
+	]`)
+	assert.NoError(t, err)
+	f.Close()
+
+	os.Setenv("WEBHOOK_SIGNATURES", f.Name())
+	defer os.Unsetenv("WEBHOOK_SIGNATURES")
+
+	verifiers, err := LoadSignatureVerifiers()
+	assert.NoError(t, err)
+	assert.Len(t, verifiers, 2)
+	assert.Equal(t, 10*time.Second, verifiers["stripe"].(*stripeVerifier).tolerance)
+
+	_, err = (&SignatureConfig{Source: "a", Scheme: "md5", Secrets: []string{"s"}}).verifier()
+	assert.Error(t, err)
+	_, err = (&SignatureConfig{Source: "a", Scheme: SignatureSchemeHmac}).verifier()
+	assert.Error(t, err, "a secret is required")
+}
+
+func TestWebHookHandlerSignature(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour})
+	app.Signatures = map[string]SignatureVerifier{
+		DefaultWebHookSource: newVerifier(t, SignatureConfig{Scheme: SignatureSchemeHmac, Secrets: []string{"secret"}}),
+	}
+	handler := app.CreateWebHookHttpHandler()
+
+	rec := postWebHook(handler, `{"a":1}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	body := `{"a":1}`
+	req := newWebHookRequest("/webhook", body)
+	req.Header.Set("X-Signature", sign("secret", body))
+	rec = serveWebHook(handler, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+	"webhooks/common"
+	"webhooks/common/storage"
+)
+
+const (
+	sourceAckAsync = "async"
+	sourceAckSync  = "sync"
+
+	// max webhook body size of the sources which don't set max_body_bytes, unless WEBHOOK_MAX_BODY_BYTES is defined
+	DefaultMaxBodyBytes = 1024 * 1024
+	// how long the buffer of a sync source waits for more webhooks before saving them, unless sync_flush_delay_ms is set
+	DefaultSyncFlushDelay = time.Millisecond * 50
+)
+
+// source names end up in urls, storage keys and file names
+var sourceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// describes how the webhooks of a source are received and buffered
+type SourceConfig struct {
+	Name string `json:"name"`
+	// "sync" replies only once the object was saved, defaults to "async"
+	Ack string `json:"ack,omitempty"`
+	// bigger requests are rejected with 413 - 0 uses the default limit
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// overrides the default buffer settings
+	Buffer SourceBufferConfig `json:"buffer,omitempty"`
+	// request headers saved with each webhook - missing uses the default ones, [] saves none
+	MetadataHeaders []string `json:"metadata_headers,omitempty"`
+}
+
+type SourceBufferConfig struct {
+	MaxSize             int `json:"max_size,omitempty"`
+	MaxBytes            int `json:"max_bytes,omitempty"`
+	FlushTimeoutSeconds int `json:"flush_timeout_seconds,omitempty"`
+	// replaces the flush timeout of sync sources - their senders wait for the flush, so it has to be short
+	SyncFlushDelayMillis int `json:"sync_flush_delay_ms,omitempty"`
+}
+
+func (c *SourceConfig) validate() error {
+	if !sourceNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("invalid source name %q - use up to 64 lowercase letters, digits, _ and -", c.Name)
+	}
+	if c.Ack != "" && c.Ack != sourceAckAsync && c.Ack != sourceAckSync {
+		return fmt.Errorf("source %s: unknown ack mode %q", c.Name, c.Ack)
+	}
+	if c.MaxBodyBytes < 0 || c.Buffer.MaxSize < 0 || c.Buffer.MaxBytes < 0 || c.Buffer.FlushTimeoutSeconds < 0 || c.Buffer.SyncFlushDelayMillis < 0 {
+		return fmt.Errorf("source %s: limits can't be negative", c.Name)
+	}
+	return nil
+}
+
+func (c *SourceConfig) ackMode() WebHookAckMode {
+	if c.Ack == sourceAckSync {
+		return WebHookAckSync
+	}
+	return WebHookAckAsync
+}
+
+func (c *SourceConfig) bufferOptions(defaults common.ObjectBufferOptions) common.ObjectBufferOptions {
+	if c.Buffer.MaxSize > 0 {
+		defaults.MaxBufferSize = c.Buffer.MaxSize
+	}
+	if c.Buffer.MaxBytes > 0 {
+		defaults.MaxBufferBytes = c.Buffer.MaxBytes
+	}
+	if c.Buffer.FlushTimeoutSeconds > 0 {
+		defaults.FlushTimeout = time.Second * time.Duration(c.Buffer.FlushTimeoutSeconds)
+	}
+	// the webhooks received meanwhile are saved in the same batch, instead of one batch per request
+	if c.ackMode() == WebHookAckSync {
+		defaults.FlushTimeout = DefaultSyncFlushDelay
+		if c.Buffer.SyncFlushDelayMillis > 0 {
+			defaults.FlushTimeout = time.Millisecond * time.Duration(c.Buffer.SyncFlushDelayMillis)
+		}
+	}
+	return defaults
+}
+
+// WEBHOOK_MAX_BODY_BYTES overrides DefaultMaxBodyBytes
+func maxBodyBytesFromEnv() (int64, error) {
+	value := os.Getenv("WEBHOOK_MAX_BODY_BYTES")
+	if value == "" {
+		return DefaultMaxBodyBytes, nil
+	}
+	maxBodyBytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || maxBodyBytes <= 0 {
+		return 0, fmt.Errorf("WEBHOOK_MAX_BODY_BYTES has to be a positive number of bytes, got %q", value)
+	}
+	return maxBodyBytes, nil
+}
+
+// loads the sources from the json file WEBHOOK_SOURCES points to - [{name, ack, max_body_bytes, buffer, metadata_headers}]
+// the default source is always there, it can be configured by adding an entry named "default"
+func LoadSourceConfigs() ([]*SourceConfig, error) {
+	configs := make([]*SourceConfig, 0)
+
+	if path := os.Getenv("WEBHOOK_SOURCES"); path != "" {
+		jsonData, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(jsonData, &configs); err != nil {
+			return nil, fmt.Errorf("invalid sources config %s: %v", path, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate source %s", config.Name)
+		}
+		names[config.Name] = true
+	}
+	if !names[DefaultWebHookSource] {
+		configs = append(configs, &SourceConfig{Name: DefaultWebHookSource})
+	}
+	return configs, nil
+}
+
+// a webhook source - its objects are buffered on their own and saved in their own namespace of the store
+type Source struct {
+	Name         string
+	AckMode      WebHookAckMode
+	MaxBodyBytes int64 // 0 accepts any size
+	// request headers saved in the metadata of each webhook
+	MetadataHeaders []string
+	Store           storage.Store
+	Collector       *common.ObjectBuffer
+}
+
+// the source with the given name, ok is false if it wasn't configured
+func (app *App) Source(name string) (*Source, bool) {
+	source, ok := app.Sources[name]
+	return source, ok
+}
+
+// the store holding the objects of a source
+func (app *App) SourceStore(name string) (storage.Store, error) {
+	source, ok := app.Source(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown source %s", name)
+	}
+	return source.Store, nil
+}
+
+// names of all sources, sorted
+func (app *App) SourceNames() []string {
+	names := make([]string, 0, len(app.Sources))
+	for name := range app.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
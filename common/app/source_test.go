@@ -0,0 +1,59 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webhooks/common"
+)
+
+func TestLoadSourceConfigs(t *testing.T) {
+	configs, err := LoadSourceConfigs()
+	assert.NoError(t, err)
+	assert.Len(t, configs, 1)
+	assert.Equal(t, DefaultWebHookSource, configs[0].Name)
+
+	dir, err := ioutil.TempDir("", "sources")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeConfig := func(config string) string {
+		path := filepath.Join(dir, "sources.json")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0644))
+		return path
+	}
+
+	path := writeConfig(`[{"name":"orders","ack":"sync","buffer":{"max_size":10,"flush_timeout_seconds":5},"metadata_headers":["X-Event-Type"]},{"name":"default","max_body_bytes":1024}]`)
+	os.Setenv("WEBHOOK_SOURCES", path)
+	defer os.Unsetenv("WEBHOOK_SOURCES")
+
+	configs, err = LoadSourceConfigs()
+	assert.NoError(t, err)
+	assert.Len(t, configs, 2)
+	assert.Equal(t, WebHookAckSync, configs[0].ackMode())
+	options := configs[0].bufferOptions(common.ObjectBufferOptions{MaxBufferSize: 100, MaxBufferBytes: 1000, FlushTimeout: time.Minute})
+	assert.Equal(t, common.ObjectBufferOptions{MaxBufferSize: 10, MaxBufferBytes: 1000, FlushTimeout: DefaultSyncFlushDelay}, options, "sync sources flush after the sync flush delay")
+	configs[0].Buffer.SyncFlushDelayMillis = 20
+	options = configs[0].bufferOptions(common.ObjectBufferOptions{MaxBufferSize: 100, MaxBufferBytes: 1000, FlushTimeout: time.Minute})
+	assert.Equal(t, time.Millisecond*20, options.FlushTimeout)
+	options = configs[1].bufferOptions(common.ObjectBufferOptions{MaxBufferSize: 100, MaxBufferBytes: 1000, FlushTimeout: time.Minute})
+	assert.Equal(t, time.Minute, options.FlushTimeout)
+	assert.Equal(t, WebHookAckAsync, configs[1].ackMode())
+	assert.Equal(t, int64(1024), configs[1].MaxBodyBytes)
+	assert.Equal(t, []string{"X-Event-Type"}, configs[0].MetadataHeaders)
+	assert.Nil(t, configs[1].MetadataHeaders)
+
+	for _, invalid := range []string{
+		`[{"name":"Orders"}]`,
+		`[{"name":"a/b"}]`,
+		`[{"name":"orders","ack":"later"}]`,
+		`[{"name":"orders","buffer":{"sync_flush_delay_ms":-1}}]`,
+		`[{"name":"orders"},{"name":"orders"}]`,
+	} {
+		os.Setenv("WEBHOOK_SOURCES", writeConfig(invalid))
+		_, err = LoadSourceConfigs()
+		assert.Error(t, err, invalid)
+	}
+}
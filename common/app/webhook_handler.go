@@ -0,0 +1,341 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"webhooks/common"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+type WebHookAckMode int
+
+const (
+	// replies 202 once the object was buffered
+	WebHookAckAsync WebHookAckMode = iota
+	// replies 200 only once the batch holding the object was saved in the store - for senders needing at least once delivery
+	WebHookAckSync
+)
+
+// the source of the webhooks posted to /webhook
+const DefaultWebHookSource = storage.DefaultSource
+
+// webhooks of the other sources are posted to /webhook/<source>
+const webHookPath = "/webhook"
+
+// seconds a sender should wait before retrying when the buffer can't take the object
+const webHookRetryAfter = "5"
+
+// error codes of the json body replied when a webhook is rejected
+const (
+	WebHookErrorMethodNotAllowed     = "method_not_allowed"
+	WebHookErrorUnsupportedMediaType = "unsupported_media_type"
+	WebHookErrorTooLarge             = "payload_too_large"
+	WebHookErrorUnreadable           = "unreadable_body"
+	WebHookErrorInvalidSignature     = "invalid_signature"
+	WebHookErrorEmpty                = "empty_payload"
+	WebHookErrorNotAnObject          = "not_an_object"
+	WebHookErrorMalformed            = "malformed_json"
+	WebHookErrorMalformedPayload     = "malformed_payload" // forms and xml
+	WebHookErrorUnknownSource        = "unknown_source"
+	WebHookErrorUnavailable          = "unavailable"
+)
+
+// the json body of the replies rejecting a webhook
+type WebHookErrorReply struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeWebHookError(writer http.ResponseWriter, status int, code string, message string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(&WebHookErrorReply{Error: code, Message: message}); err != nil {
+		common.Logger.WithError(err).Warn("couldn't write the webhook error reply")
+	}
+}
+
+// the reply of a batch - Items has the outcome of each object, in the order they were sent
+type WebHookBatchReply struct {
+	Accepted int                 `json:"accepted"`
+	Rejected int                 `json:"rejected"`
+	Items    []*WebHookItemReply `json:"items"`
+}
+
+// the outcome of a batch item - Status is what a request holding only this object would have got
+type WebHookItemReply struct {
+	Status  int    `json:"status"`
+	ID      string `json:"id,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	jsonMediaType   = "application/json"
+	ndjsonMediaType = "application/x-ndjson"
+	formMediaType   = "application/x-www-form-urlencoded"
+	xmlMediaType    = "application/xml"
+)
+
+// the media type of a webhook body - json, ndjson batches, forms or xml
+// the application/<something>+json and +xml types are handled as json and xml, text/xml as xml
+// parameters like charset are ignored, ok is false for anything else
+func webHookMediaType(contentType string) (mediaType string, ok bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case mediaType == jsonMediaType || mediaType == ndjsonMediaType || mediaType == formMediaType || mediaType == xmlMediaType:
+		return mediaType, true
+	case strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"):
+		return jsonMediaType, true
+	case mediaType == "text/xml" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+xml")):
+		return xmlMediaType, true
+	}
+	return "", false
+}
+
+// the error code of an invalid webhook object
+func webHookObjectErrorCode(err error, mediaType string) string {
+	switch {
+	case err == common.EmptyWebHookError:
+		return WebHookErrorEmpty
+	case err == common.NonObjectWebHookError:
+		return WebHookErrorNotAnObject
+	case mediaType == formMediaType || mediaType == xmlMediaType:
+		return WebHookErrorMalformedPayload
+	default:
+		return WebHookErrorMalformed
+	}
+}
+
+// receives post requests containing json objects
+// writes the json data in storage
+//this is common for slave/master - only the storage is different for them (slave -> s3, master -> dynamoDb)
+// the source is picked from the path - replies 404 for sources which weren't configured
+// rejected requests get a WebHookErrorReply body
+func (app *App) CreateWebHookHttpHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(request.URL.Path, webHookPath), "/")
+		if name == "" {
+			name = DefaultWebHookSource
+		}
+		source, ok := app.Source(name)
+		if !ok {
+			writeWebHookError(writer, http.StatusNotFound, WebHookErrorUnknownSource, fmt.Sprintf("unknown source %q", name))
+			return
+		}
+		app.handleWebHook(source, writer, request)
+	}
+}
+
+// replies 405 for anything but POST and 415 if the Content-Type isn't json, ndjson, a form or xml
+// replies 413 if the body is bigger than the source allows
+// replies 401 if the source's signature verifier rejects the request
+// replies 400 if the body isn't a json object, a json array of objects, ndjson, a form or an xml document - batches are handled by handleWebHookBatch
+// replies 503 with a Retry-After header if the object couldn't be buffered (ex the buffer is full)
+// in sync mode, also if the object couldn't be saved before the request was cancelled
+// the objects are saved together with the metadata of the request
+func (app *App) handleWebHook(source *Source, writer http.ResponseWriter, request *http.Request) {
+	receivedAt := time.Now().UTC()
+	logger := common.Logger.WithField("source", source.Name)
+
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writeWebHookError(writer, http.StatusMethodNotAllowed, WebHookErrorMethodNotAllowed, "webhooks have to be posted")
+		return
+	}
+	contentType := request.Header.Get("Content-Type")
+	mediaType, ok := webHookMediaType(contentType)
+	if !ok {
+		writeWebHookError(writer, http.StatusUnsupportedMediaType, WebHookErrorUnsupportedMediaType, fmt.Sprintf("expected a json, ndjson, form or xml body, got %q", contentType))
+		return
+	}
+
+	var body []byte
+	var err error
+	if source.MaxBodyBytes > 0 {
+		tooLarge := fmt.Sprintf("the body can have at most %d bytes", source.MaxBodyBytes)
+		if request.ContentLength > source.MaxBodyBytes {
+			writeWebHookError(writer, http.StatusRequestEntityTooLarge, WebHookErrorTooLarge, tooLarge)
+			return
+		}
+		// reading one more byte tells whether the body is too big without reading all of it
+		body, err = ioutil.ReadAll(io.LimitReader(request.Body, source.MaxBodyBytes+1))
+		if err == nil && int64(len(body)) > source.MaxBodyBytes {
+			logger.Warnf("rejected webhook bigger than %d bytes", source.MaxBodyBytes)
+			writeWebHookError(writer, http.StatusRequestEntityTooLarge, WebHookErrorTooLarge, tooLarge)
+			return
+		}
+	} else {
+		body, err = ioutil.ReadAll(request.Body)
+	}
+	if err != nil {
+		logger.WithError(err).Error("error while reading webhook request")
+		writeWebHookError(writer, http.StatusBadRequest, WebHookErrorUnreadable, "couldn't read the body")
+		return
+	}
+
+	if verifier, ok := app.Signatures[source.Name]; ok {
+		if err = verifier.Verify(request.Header, body); err != nil {
+			logger.WithError(err).Warn("rejected webhook with an invalid signature")
+			writeWebHookError(writer, http.StatusUnauthorized, WebHookErrorInvalidSignature, err.Error())
+			return
+		}
+	}
+
+	metadata := app.webHookMetadata(source, request, receivedAt)
+
+	// ndjson bodies and json arrays are batches, each of their objects is buffered on its own
+	// forms and xml are converted to json objects, the original payload is saved too
+	var batch []*common.WebHookBatchItem
+	if mediaType == ndjsonMediaType {
+		batch, err = common.ReadWebHookNdjson(bytes.NewReader(body))
+	} else if trimmed := bytes.TrimSpace(body); mediaType == jsonMediaType && len(trimmed) > 0 && trimmed[0] == '[' {
+		batch, err = common.ReadWebHookArray(bytes.NewReader(body))
+	} else {
+		var obj *data.WebHookObject
+		switch mediaType {
+		case formMediaType:
+			obj, err = common.ReadFormWebHookObject(bytes.NewReader(body))
+		case xmlMediaType:
+			obj, err = common.ReadXmlWebHookObject(bytes.NewReader(body))
+		default:
+			obj, err = common.ReadWebHookObject(bytes.NewReader(body))
+		}
+		if err == nil {
+			obj.Source = source.Name
+			obj.Metadata = metadata
+			if len(obj.RawData) > 0 {
+				obj.ContentType = contentType
+			}
+			err = app.bufferWebHooks(request.Context(), source, []*data.WebHookObject{obj})[0]
+			if err != nil {
+				writer.Header().Set("Retry-After", webHookRetryAfter)
+				writeWebHookError(writer, http.StatusServiceUnavailable, WebHookErrorUnavailable, err.Error())
+				return
+			}
+			writer.WriteHeader(acceptedStatus(source))
+			return
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Warn("rejected invalid webhook object")
+		writeWebHookError(writer, http.StatusBadRequest, webHookObjectErrorCode(err, mediaType), err.Error())
+		return
+	}
+	app.handleWebHookBatch(source, batch, metadata, writer, request)
+}
+
+func acceptedStatus(source *Source) int {
+	if source.AckMode == WebHookAckSync {
+		return http.StatusOK
+	}
+	return http.StatusAccepted
+}
+
+// replies with the outcome of each item: 202/200 if all of them were accepted, 207 if only some of them
+// if none of them were accepted, 503 with a Retry-After header if any of them can be retried, 400 otherwise
+func (app *App) handleWebHookBatch(source *Source, batch []*common.WebHookBatchItem, metadata *data.WebHookMetadata, writer http.ResponseWriter, request *http.Request) {
+	reply := &WebHookBatchReply{Items: make([]*WebHookItemReply, len(batch))}
+	objects := make([]*data.WebHookObject, 0, len(batch))
+	for i, item := range batch {
+		if item.Err != nil {
+			reply.Items[i] = &WebHookItemReply{Status: http.StatusBadRequest, Error: webHookObjectErrorCode(item.Err, ndjsonMediaType), Message: item.Err.Error()}
+			continue
+		}
+		item.Object.Source = source.Name
+		item.Object.Metadata = metadata
+		objects = append(objects, item.Object)
+	}
+
+	errs := app.bufferWebHooks(request.Context(), source, objects)
+	retry := false
+	for i, item := range batch {
+		if item.Err != nil {
+			reply.Rejected += 1
+			continue
+		}
+		err := errs[0]
+		errs = errs[1:]
+		if err != nil {
+			reply.Items[i] = &WebHookItemReply{Status: http.StatusServiceUnavailable, Error: WebHookErrorUnavailable, Message: err.Error()}
+			reply.Rejected += 1
+			retry = true
+			continue
+		}
+		reply.Items[i] = &WebHookItemReply{Status: acceptedStatus(source), ID: item.Object.ID.Hex()}
+		reply.Accepted += 1
+	}
+
+	status := acceptedStatus(source)
+	if reply.Accepted == 0 && retry {
+		status = http.StatusServiceUnavailable
+	} else if reply.Accepted == 0 {
+		status = http.StatusBadRequest
+	} else if reply.Rejected > 0 {
+		status = http.StatusMultiStatus
+	}
+	if reply.Rejected > 0 {
+		common.Logger.WithField("source", source.Name).Warnf("rejected %d of the %d objects of a batch", reply.Rejected, len(batch))
+	}
+
+	if retry {
+		writer.Header().Set("Retry-After", webHookRetryAfter)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(reply); err != nil {
+		common.Logger.WithError(err).Warn("couldn't write the webhook batch reply")
+	}
+}
+
+// adds the objects to the source's collector - returns the error of each object, nil if it was accepted
+// in sync mode, an object is accepted only once it was saved or the request was cancelled
+func (app *App) bufferWebHooks(ctx context.Context, source *Source, objects []*data.WebHookObject) []error {
+	logger := common.Logger.WithField("source", source.Name)
+	errs := make([]error, len(objects))
+
+	if source.AckMode == WebHookAckAsync {
+		for i, obj := range objects {
+			if errs[i] = source.Collector.Add(obj); errs[i] != nil {
+				logger.WithError(errs[i]).Error("error while buffering webhook object")
+			}
+		}
+		return errs
+	}
+
+	futures := make([]*common.ObjectFuture, len(objects))
+	for i, obj := range objects {
+		if futures[i], errs[i] = source.Collector.AddWithFuture(obj); errs[i] != nil {
+			logger.WithError(errs[i]).Error("error while buffering webhook object")
+		}
+	}
+
+	// no forced flush, the buffer of a sync source is flushed once it's full or after its short sync flush delay
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+		if err := future.Wait(ctx); err != nil {
+			logger.WithError(err).WithField("id", objects[i].ID.Hex()).Error("webhook object wasn't saved before replying")
+			if ctx.Err() != nil {
+				errs[i] = errors.New("the webhook wasn't saved in time")
+			} else {
+				// the buffer gave up on it, ex the store rejected it
+				errs[i] = errors.New("the webhook couldn't be saved")
+			}
+		}
+	}
+	return errs
+}
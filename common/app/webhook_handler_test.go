@@ -0,0 +1,331 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+// polls cond until it's true, like assert.Eventually
+// testify's version panics when it times out while cond is still running, which hides the actual failure
+func eventually(t *testing.T, cond func() bool, waitFor time.Duration, tick time.Duration, msgAndArgs ...interface{}) bool {
+	deadline := time.Now().Add(waitFor)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return assert.Fail(t, "condition never satisfied", msgAndArgs...)
+		}
+		time.Sleep(tick)
+	}
+	return true
+}
+
+func newTestApp(store storage.Store, options common.ObjectBufferOptions) *App {
+	collector, err := common.NewObjectBufferWithOptions(store, options)
+	if err != nil {
+		panic(err)
+	}
+	return &App{Sources: map[string]*Source{
+		DefaultWebHookSource: {Name: DefaultWebHookSource, Store: store, Collector: collector},
+	}}
+}
+
+func defaultSource(app *App) *Source {
+	source, _ := app.Source(DefaultWebHookSource)
+	return source
+}
+
+func newWebHookRequest(path string, body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func postWebHook(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	return serveWebHook(handler, newWebHookRequest("/webhook", body))
+}
+
+func serveWebHook(handler http.HandlerFunc, request *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, request)
+	return rec
+}
+
+func TestWebHookHandlerAsync(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour})
+	handler := app.CreateWebHookHttpHandler()
+
+	rec := postWebHook(handler, `{"a":1}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, 0, store.Len(), "async mode shouldn't wait for the object to be saved")
+
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+	assert.Equal(t, 1, store.Len())
+
+	rec = postWebHook(handler, `{"a":2}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, webHookRetryAfter, rec.Header().Get("Retry-After"))
+}
+
+func TestWebHookHandlerSync(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: DefaultSyncFlushDelay})
+	defaultSource(app).AckMode = WebHookAckSync
+	handler := app.CreateWebHookHttpHandler()
+
+	rec := postWebHook(handler, `{"a":1}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, store.Len(), "sync mode should reply once the object was saved")
+
+	// the store keeps failing, the object is given up once the buffer is closed
+	store.FailAfter = 1
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postWebHook(handler, `{"a":2}`)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	eventually(t, func() bool {
+		return defaultSource(app).Collector.Stats().Failures > 0
+	}, time.Second, time.Millisecond)
+	assert.Error(t, defaultSource(app).Collector.Close(ctx))
+
+	rec = <-done
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, webHookRetryAfter, rec.Header().Get("Retry-After"))
+}
+
+func TestWebHookHandlerSyncRejected(t *testing.T) {
+	store := storage.NewMemoryStore()
+	store.Reject = func(obj *data.WebHookObject) bool {
+		return true
+	}
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: DefaultSyncFlushDelay})
+	defaultSource(app).AckMode = WebHookAckSync
+	handler := app.CreateWebHookHttpHandler()
+
+	// the buffer gives up on the objects the store will never accept, the sender doesn't wait for its timeout
+	rec := postWebHook(handler, `{"a":1}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "the webhook couldn't be saved")
+	assert.Equal(t, 1, defaultSource(app).Collector.Stats().GivenUp)
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+}
+
+func TestWebHookHandlerSyncBatching(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Millisecond * 100})
+	defaultSource(app).AckMode = WebHookAckSync
+	handler := app.CreateWebHookHttpHandler()
+
+	// the requests received within the sync flush delay are saved together
+	codes := make(chan int)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			codes <- postWebHook(handler, fmt.Sprintf(`{"a":%d}`, i)).Code
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, <-codes)
+	}
+	assert.Equal(t, 5, store.Len())
+	assert.Equal(t, 1, defaultSource(app).Collector.Stats().Flushes, "sync requests shouldn't be flushed one by one")
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+}
+
+func TestWebHookHandlerSources(t *testing.T) {
+	defaultStore := storage.NewMemoryStore()
+	app := newTestApp(defaultStore, common.ObjectBufferOptions{MaxBufferSize: 1, FlushTimeout: time.Hour})
+
+	ordersStore := storage.NewMemoryStore()
+	ordersCollector, err := common.NewObjectBufferWithOptions(ordersStore, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: DefaultSyncFlushDelay})
+	assert.NoError(t, err)
+	app.Sources["orders"] = &Source{Name: "orders", AckMode: WebHookAckSync, MaxBodyBytes: 16, Store: ordersStore, Collector: ordersCollector}
+	handler := app.CreateWebHookHttpHandler()
+
+	post := func(path string, body string) int {
+		return serveWebHook(handler, newWebHookRequest(path, body)).Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("/webhook/orders", `{"order":1}`), "orders are acknowledged once saved")
+	assert.Equal(t, http.StatusOK, post("/webhook/orders/", `{"order":2}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("/webhook/orders", `{"order":"too big for orders"}`))
+	assert.Equal(t, http.StatusAccepted, post("/webhook/", `{"a":1}`))
+	assert.Equal(t, http.StatusNotFound, post("/webhook/unknown", `{"a":1}`))
+
+	assert.NoError(t, app.Shutdown(context.Background()))
+	assert.Equal(t, 2, ordersStore.Len())
+	assert.Equal(t, 1, defaultStore.Len())
+
+	ids, err := storage.LoadStorageKeysSync(context.Background(), ordersStore, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	objects, err := storage.LoadStorageObjectsSync(context.Background(), ordersStore, ids)
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+	for _, obj := range objects {
+		assert.Equal(t, "orders", obj.Source)
+	}
+}
+
+func TestWebHookHandlerRejects(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour})
+	defaultSource(app).MaxBodyBytes = 32
+	handler := app.CreateWebHookHttpHandler()
+
+	expectError := func(rec *httptest.ResponseRecorder, status int, code string) {
+		assert.Equal(t, status, rec.Code, code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), code)
+		reply := WebHookErrorReply{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reply), code)
+		assert.Equal(t, code, reply.Error)
+		assert.NotEmpty(t, reply.Message, code)
+	}
+
+	rec := serveWebHook(handler, httptest.NewRequest(http.MethodGet, "/webhook", nil))
+	expectError(rec, http.StatusMethodNotAllowed, WebHookErrorMethodNotAllowed)
+	assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+
+	for _, contentType := range []string{"", "text/plain", "multipart/form-data", "application/jsonx"} {
+		req := newWebHookRequest("/webhook", `{"a":1}`)
+		req.Header.Set("Content-Type", contentType)
+		expectError(serveWebHook(handler, req), http.StatusUnsupportedMediaType, WebHookErrorUnsupportedMediaType)
+	}
+	for i, contentType := range []string{"application/json; charset=utf-8", "application/vnd.github+json"} {
+		req := newWebHookRequest("/webhook", fmt.Sprintf(`{"a":%d}`, i))
+		req.Header.Set("Content-Type", contentType)
+		assert.Equal(t, http.StatusAccepted, serveWebHook(handler, req).Code, contentType)
+	}
+
+	expectError(postWebHook(handler, `{"a":"`+strings.Repeat("x", 32)+`"}`), http.StatusRequestEntityTooLarge, WebHookErrorTooLarge)
+	// without a Content-Length the body is cut while reading it
+	req := newWebHookRequest("/webhook", "")
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"a":"` + strings.Repeat("x", 32) + `"}`))
+	req.ContentLength = -1
+	expectError(serveWebHook(handler, req), http.StatusRequestEntityTooLarge, WebHookErrorTooLarge)
+
+	expectError(postWebHook(handler, ""), http.StatusBadRequest, WebHookErrorEmpty)
+	expectError(postWebHook(handler, `"a"`), http.StatusBadRequest, WebHookErrorNotAnObject)
+	expectError(postWebHook(handler, `{"a":`), http.StatusBadRequest, WebHookErrorMalformed)
+	expectError(postWebHook(handler, `{"a":1}{`), http.StatusBadRequest, WebHookErrorMalformed)
+	expectError(serveWebHook(handler, newWebHookRequest("/webhook/unknown", `{"a":1}`)), http.StatusNotFound, WebHookErrorUnknownSource)
+
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+	assert.Equal(t, 2, store.Len(), "only the valid webhooks are saved")
+}
+
+func postWebHookBatch(t *testing.T, handler http.HandlerFunc, contentType string, body string) (int, *WebHookBatchReply) {
+	req := newWebHookRequest("/webhook", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := serveWebHook(handler, req)
+
+	reply := &WebHookBatchReply{}
+	if rec.Header().Get("Content-Type") == "application/json" {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), reply))
+	}
+	return rec.Code, reply
+}
+
+func TestWebHookHandlerBatch(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour})
+	handler := app.CreateWebHookHttpHandler()
+
+	status, reply := postWebHookBatch(t, handler, "application/json", ` [{"a":1}, {"a":2}] `)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, 2, reply.Accepted)
+	assert.Len(t, reply.Items, 2)
+	assert.NotEqual(t, reply.Items[0].ID, reply.Items[1].ID, "each object has its own id")
+
+	status, reply = postWebHookBatch(t, handler, "application/x-ndjson", "{\"b\":1}\n\n[1]\r\n{\"b\":\n{\"b\":2}")
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Equal(t, 2, reply.Accepted)
+	assert.Equal(t, 2, reply.Rejected)
+	assert.Len(t, reply.Items, 4)
+	for i, expected := range []int{http.StatusAccepted, http.StatusBadRequest, http.StatusBadRequest, http.StatusAccepted} {
+		assert.Equal(t, expected, reply.Items[i].Status, i)
+	}
+	assert.Equal(t, WebHookErrorNotAnObject, reply.Items[1].Error)
+	assert.Equal(t, WebHookErrorMalformed, reply.Items[2].Error)
+
+	status, reply = postWebHookBatch(t, handler, "application/json", `[1, "a"]`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, 2, reply.Rejected)
+
+	for _, body := range []string{`[]`, `[{"a":1},`, `[{"a":1}] x`} {
+		status, _ = postWebHookBatch(t, handler, "application/json", body)
+		assert.Equal(t, http.StatusBadRequest, status, body)
+	}
+	status, _ = postWebHookBatch(t, handler, "application/x-ndjson", "\n \n")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+	assert.Equal(t, 4, store.Len())
+
+	status, reply = postWebHookBatch(t, handler, "application/json", `[{"c":1}]`)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, WebHookErrorUnavailable, reply.Items[0].Error)
+}
+
+func TestWebHookHandlerBatchSync(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: DefaultSyncFlushDelay})
+	defaultSource(app).AckMode = WebHookAckSync
+	handler := app.CreateWebHookHttpHandler()
+
+	status, reply := postWebHookBatch(t, handler, "application/x-ndjson", "{\"a\":1}\n{\"a\":2}\n")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, reply.Accepted)
+	assert.Equal(t, 2, store.Len(), "sync mode should reply once the batch was saved")
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+}
+
+func TestWebHookHandlerFormAndXml(t *testing.T) {
+	store := storage.NewMemoryStore()
+	app := newTestApp(store, common.ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour})
+	handler := app.CreateWebHookHttpHandler()
+
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req := newWebHookRequest("/webhook", body)
+		req.Header.Set("Content-Type", contentType)
+		return serveWebHook(handler, req)
+	}
+
+	assert.Equal(t, http.StatusAccepted, post("application/x-www-form-urlencoded", "a=1&b=2").Code)
+	assert.Equal(t, http.StatusAccepted, post("text/xml; charset=utf-8", "<c>3</c>").Code)
+	assert.Equal(t, http.StatusAccepted, post("application/soap+xml", "<d>4</d>").Code)
+	assert.Equal(t, http.StatusBadRequest, post("application/xml", "<c>").Code)
+	assert.Equal(t, http.StatusBadRequest, post("application/x-www-form-urlencoded", "").Code)
+
+	assert.NoError(t, defaultSource(app).Collector.Close(context.Background()))
+	ids, err := storage.LoadStorageKeysSync(context.Background(), store, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	objects, err := storage.LoadStorageObjectsSync(context.Background(), store, ids)
+	assert.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	byType := make(map[string]string)
+	for _, obj := range objects {
+		assert.NotEmpty(t, obj.RawData)
+		byType[obj.ContentType] = string(obj.JsonData)
+	}
+	assert.JSONEq(t, `{"a":"1","b":"2"}`, byType["application/x-www-form-urlencoded"])
+	assert.JSONEq(t, `{"c":"3"}`, byType["text/xml; charset=utf-8"])
+	assert.JSONEq(t, `{"d":"4"}`, byType["application/soap+xml"])
+
+	rec := post("application/xml", "<c>")
+	reply := WebHookErrorReply{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reply))
+	assert.Equal(t, WebHookErrorMalformedPayload, reply.Error)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"time"
@@ -11,6 +12,134 @@ import (
 type WebHookObject struct {
 	ID       ObjectID
 	JsonData []byte // actual json byte array - note that this might be nil
+	Source   string // the integration which sent it, stores keep the objects of each source apart
+	// the payload exactly as it was received - set only if JsonData was converted from another format (ex form or xml)
+	RawData     []byte
+	ContentType string // the content type of RawData
+	// how the webhook was received - nil for objects saved before it was captured
+	Metadata *WebHookMetadata
+	// the algorithm the hash part of ID was computed with - empty for objects saved before it was recorded
+	HashAlgorithm string
+}
+
+// the request which delivered a webhook
+type WebHookMetadata struct {
+	Method     string `json:"method"`
+	RemoteAddr string `json:"remote_addr"` // the client ip, as seen by the trusted proxies
+	Query      string `json:"query,omitempty"`
+	// only the allowed headers are kept
+	Headers    map[string][]string `json:"headers,omitempty"`
+	ReceivedAt time.Time           `json:"received_at"` // keeps the nanoseconds
+}
+
+// objects with RawData, Metadata or HashAlgorithm are persisted in an envelope:
+// [payloadEnvelopeVersion][fields count u8] then for each set field [field tag u8][value length u32][value]
+// fields which aren't set are left out, unknown tags are skipped so fields can be added without a new version
+// a json object never starts with the version byte, so json only payloads are persisted as they are
+const payloadEnvelopeVersion byte = 1
+
+const (
+	payloadFieldJson byte = iota + 1
+	payloadFieldRawData
+	payloadFieldContentType
+	payloadFieldMetadata
+	payloadFieldHashAlgorithm
+)
+
+var malformedPayloadError = errors.New("malformed payload envelope")
+
+// the bytes stores persist for the object - JsonData, unless the object has RawData, Metadata or HashAlgorithm too
+func (this *WebHookObject) EncodePayload() []byte {
+	if len(this.RawData) == 0 && this.Metadata == nil && this.HashAlgorithm == "" {
+		return this.JsonData
+	}
+
+	var metadata []byte
+	if this.Metadata != nil {
+		// can't fail, it has only strings and a time
+		metadata, _ = json.Marshal(this.Metadata)
+	}
+	fields := []struct {
+		tag   byte
+		value []byte
+		set   bool
+	}{
+		{payloadFieldJson, this.JsonData, this.JsonData != nil},
+		{payloadFieldRawData, this.RawData, len(this.RawData) > 0},
+		{payloadFieldContentType, []byte(this.ContentType), this.ContentType != ""},
+		{payloadFieldMetadata, metadata, metadata != nil},
+		{payloadFieldHashAlgorithm, []byte(this.HashAlgorithm), this.HashAlgorithm != ""},
+	}
+
+	size, count := 2, 0
+	for _, field := range fields {
+		if field.set {
+			size += 1 + 4 + len(field.value)
+			count++
+		}
+	}
+	res := make([]byte, 0, size)
+	res = append(res, payloadEnvelopeVersion, byte(count))
+	var lenBuf [4]byte
+	for _, field := range fields {
+		if !field.set {
+			continue
+		}
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(field.value)))
+		res = append(res, field.tag)
+		res = append(res, lenBuf[:]...)
+		res = append(res, field.value...)
+	}
+	return res
+}
+
+// sets JsonData, RawData, ContentType, Metadata and HashAlgorithm out of the bytes returned by EncodePayload
+func (this *WebHookObject) DecodePayload(payload []byte) error {
+	if len(payload) == 0 || payload[0] != payloadEnvelopeVersion {
+		this.JsonData, this.RawData, this.ContentType, this.Metadata, this.HashAlgorithm = payload, nil, "", nil, ""
+		return nil
+	}
+	if len(payload) < 2 {
+		return malformedPayloadError
+	}
+
+	decoded := WebHookObject{}
+	rest := payload[2:]
+	for i := 0; i < int(payload[1]); i++ {
+		if len(rest) < 1+4 {
+			return malformedPayloadError
+		}
+		tag := rest[0]
+		valueLen := int(binary.BigEndian.Uint32(rest[1:]))
+		rest = rest[1+4:]
+		if len(rest) < valueLen {
+			return malformedPayloadError
+		}
+		value := rest[:valueLen]
+		rest = rest[valueLen:]
+
+		switch tag {
+		case payloadFieldJson:
+			decoded.JsonData = value
+		case payloadFieldRawData:
+			decoded.RawData = value
+		case payloadFieldContentType:
+			decoded.ContentType = string(value)
+		case payloadFieldMetadata:
+			decoded.Metadata = &WebHookMetadata{}
+			if err := json.Unmarshal(value, decoded.Metadata); err != nil {
+				return malformedPayloadError
+			}
+		case payloadFieldHashAlgorithm:
+			decoded.HashAlgorithm = string(value)
+		}
+	}
+	if len(rest) > 0 {
+		return malformedPayloadError
+	}
+
+	this.JsonData, this.RawData, this.ContentType, this.Metadata, this.HashAlgorithm = decoded.JsonData, decoded.RawData, decoded.ContentType, decoded.Metadata, decoded.HashAlgorithm
+	return nil
 }
 
 func (this *WebHookObject) DataTo(pointer interface{}) error {
@@ -34,12 +163,14 @@ func (this WebHookObject) UnixTimestamp() int64 {
 	return this.ID.Timestamp().Unix()
 }
 
+// the base64 md5 of EncodePayload
 func (this WebHookObject) Md5() string {
-	if this.JsonData == nil {
+	payload := this.EncodePayload()
+	if payload == nil {
 		return ""
 	}
 	h := md5.New()
-	h.Write(this.JsonData)
+	h.Write(payload)
 
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
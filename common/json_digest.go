@@ -0,0 +1,320 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"webhooks/common/data"
+)
+
+// identifies how the hash part of an object id was computed
+type HashAlgorithm string
+
+const (
+	// crc32c of the sorted top level keys, each followed by the primitive values it contains - used by the ids created before HashAlgorithmCanonicalJson
+	// it can't tell apart ex {"a":["x","y"]}, {"a":"xy"} and {"a":{"x":"y"}}
+	HashAlgorithmConcat HashAlgorithm = "crc32c-concat-v1"
+	// crc32c of the canonical json of the payload - see CanonicalJson
+	HashAlgorithmCanonicalJson HashAlgorithm = "crc32c-canonical-json-v2"
+
+	// the algorithm ReadWebHookObject uses
+	CurrentHashAlgorithm = HashAlgorithmCanonicalJson
+)
+
+// newest first
+var knownHashAlgorithms = []HashAlgorithm{HashAlgorithmCanonicalJson, HashAlgorithmConcat}
+
+var hashTable = crc32.MakeTable(crc32.Castagnoli)
+
+// hashes a json object using the given algorithm
+func WebHookHash(algorithm HashAlgorithm, jsonData []byte) (uint32, error) {
+	switch algorithm {
+	case HashAlgorithmCanonicalJson:
+		canonical, err := CanonicalJson(jsonData)
+		if err != nil {
+			return 0, err
+		}
+		return crc32.Checksum(canonical, hashTable), nil
+	case HashAlgorithmConcat:
+		return concatWebHookHash(jsonData)
+	default:
+		return 0, fmt.Errorf("unknown hash algorithm %s", algorithm)
+	}
+}
+
+// the algorithm the id of an object was computed with, as it was recorded when the object was received
+// objects saved before the algorithm was recorded were all hashed with HashAlgorithmConcat
+// it's never guessed by hashing the json again - the stored json isn't always the received one (ex the dynamodb flat layout)
+func ObjectHashAlgorithm(obj *data.WebHookObject) HashAlgorithm {
+	if obj.HashAlgorithm == "" {
+		return HashAlgorithmConcat
+	}
+	return HashAlgorithm(obj.HashAlgorithm)
+}
+
+// whether WebHookHash supports the algorithm
+func IsKnownHashAlgorithm(algorithm HashAlgorithm) bool {
+	for _, known := range knownHashAlgorithms {
+		if known == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// the canonical form of a json value, following RFC 8785 (json canonicalization scheme)
+// object keys are sorted at every depth by their utf-16 code units, arrays keep their order, there's no whitespace
+// and strings are escaped only where json requires it - so the type and the nesting of each value is part of the result
+// unlike RFC 8785, numbers aren't converted to float64 first, they keep all of their digits: 1, 1.0 and 10e-1 are all 1,
+// but 12345678901234567890 and 12345678901234567891 stay different
+// a key repeated in the same object keeps its last value
+func CanonicalJson(jsonData []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.UseNumber()
+
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = writeCanonicalJson(dec, &buf, t); err != nil {
+		return nil, err
+	}
+	if err = expectJsonEnd(dec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fails if anything else than whitespace follows the value the decoder just read
+func expectJsonEnd(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return malformedJsonError
+	}
+	return nil
+}
+
+// writes the value starting with the token t, reading the rest of it from the decoder
+// the decoder has to use json.Decoder.UseNumber
+// nothing is decoded in memory except the keys of the objects being written, which are sorted once each object was read
+func writeCanonicalJson(dec *json.Decoder, dest *bytes.Buffer, t json.Token) error {
+	switch v := t.(type) {
+	case nil:
+		dest.WriteString("null")
+	case bool:
+		dest.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		number, err := canonicalJsonNumber(v.String())
+		if err != nil {
+			return err
+		}
+		dest.WriteString(number)
+	case string:
+		writeCanonicalJsonString(dest, v)
+	case json.Delim:
+		if v == '[' {
+			return writeCanonicalJsonArray(dec, dest)
+		}
+		if v == '{' {
+			return writeCanonicalJsonObject(dec, dest)
+		}
+		return malformedJsonError
+	default:
+		return fmt.Errorf("unexpected json token %T", t)
+	}
+	return nil
+}
+
+// the end of the input inside a value means it was truncated
+func nextJsonToken(dec *json.Decoder) (json.Token, error) {
+	t, err := dec.Token()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return t, err
+}
+
+// writes the rest of an array whose '[' was already read
+func writeCanonicalJsonArray(dec *json.Decoder, dest *bytes.Buffer) error {
+	dest.WriteByte('[')
+	for i := 0; ; i++ {
+		t, err := nextJsonToken(dec)
+		if err != nil {
+			return err
+		}
+		if t == json.Delim(']') {
+			break
+		}
+		if i > 0 {
+			dest.WriteByte(',')
+		}
+		if err = writeCanonicalJson(dec, dest, t); err != nil {
+			return err
+		}
+	}
+	dest.WriteByte(']')
+	return nil
+}
+
+// writes the rest of an object whose '{' was already read
+// each member is written to its own buffer, the members are joined once their keys were sorted
+func writeCanonicalJsonObject(dec *json.Decoder, dest *bytes.Buffer) error {
+	type member struct {
+		key   string
+		value []byte
+	}
+	members := make([]member, 0)
+	index := make(map[string]int)
+
+	var value bytes.Buffer
+	for {
+		t, err := nextJsonToken(dec)
+		if err != nil {
+			return err
+		}
+		if t == json.Delim('}') {
+			break
+		}
+		key, ok := t.(string)
+		if !ok {
+			return malformedJsonError
+		}
+
+		if t, err = nextJsonToken(dec); err != nil {
+			return err
+		}
+		value.Reset()
+		if err = writeCanonicalJson(dec, &value, t); err != nil {
+			return err
+		}
+
+		if i, ok := index[key]; ok {
+			members[i].value = append(members[i].value[:0], value.Bytes()...)
+			continue
+		}
+		index[key] = len(members)
+		members = append(members, member{key: key, value: append([]byte(nil), value.Bytes()...)})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return lessUtf16(members[i].key, members[j].key)
+	})
+
+	dest.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			dest.WriteByte(',')
+		}
+		writeCanonicalJsonString(dest, m.key)
+		dest.WriteByte(':')
+		dest.Write(m.value)
+	}
+	dest.WriteByte('}')
+	return nil
+}
+
+// only quotes, backslashes and control characters are escaped, using the short escapes where there's one
+func writeCanonicalJsonString(dest *bytes.Buffer, s string) {
+	dest.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			dest.WriteString(`\"`)
+		case '\\':
+			dest.WriteString(`\\`)
+		case '\b':
+			dest.WriteString(`\b`)
+		case '\t':
+			dest.WriteString(`\t`)
+		case '\n':
+			dest.WriteString(`\n`)
+		case '\f':
+			dest.WriteString(`\f`)
+		case '\r':
+			dest.WriteString(`\r`)
+		default:
+			if r < 0x20 {
+				dest.WriteString(fmt.Sprintf(`\u%04x`, r))
+			} else {
+				dest.WriteRune(r)
+			}
+		}
+	}
+	dest.WriteByte('"')
+}
+
+// RFC 8785 sorts the keys by their utf-16 code units, which isn't the order of their utf-8 bytes for characters above U+FFFF
+func lessUtf16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+// formats a json number the way javascript formats numbers, but using its exact decimal value
+// integers up to 21 digits are written in full, 0.000001 and bigger fractions as decimals, anything else as <d.ddd>e<+|-><exponent>
+func canonicalJsonNumber(number string) (string, error) {
+	negative := strings.HasPrefix(number, "-")
+	mantissa := strings.TrimPrefix(number, "-")
+
+	exponent := 0
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		e, err := strconv.Atoi(mantissa[i+1:])
+		if err != nil {
+			return "", fmt.Errorf("number out of range %s", number)
+		}
+		exponent = e
+		mantissa = mantissa[:i]
+	}
+	digits := mantissa
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		digits = mantissa[:i] + mantissa[i+1:]
+		exponent -= len(mantissa) - i - 1
+	}
+
+	// the value is digits * 10^exponent
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		// -0 too
+		return "0", nil
+	}
+	trimmed := strings.TrimRight(digits, "0")
+	exponent += len(digits) - len(trimmed)
+	digits = trimmed
+
+	// the value is 0.digits * 10^point
+	k, point := len(digits), len(digits)+exponent
+	var res string
+	switch {
+	case k <= point && point <= 21:
+		res = digits + strings.Repeat("0", point-k)
+	case 0 < point && point <= 21:
+		res = digits[:point] + "." + digits[point:]
+	case -6 < point && point <= 0:
+		res = "0." + strings.Repeat("0", -point) + digits
+	default:
+		res = digits[:1]
+		if k > 1 {
+			res += "." + digits[1:]
+		}
+		if point-1 > 0 {
+			res += "e+" + strconv.Itoa(point-1)
+		} else {
+			res += "e-" + strconv.Itoa(1-point)
+		}
+	}
+
+	if negative {
+		res = "-" + res
+	}
+	return res, nil
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestCanonicalJson(t *testing.T) {
+	for payload, expected := range map[string]string{
+		`{ "b" : [3, {"d":1,"c":2}], "a" : null }`:                                      `{"a":null,"b":[3,{"c":2,"d":1}]}`,
+		`{"numbers":[333333333.33333329,1E30,4.50,2e-3,0.000000000000000000000000001]}`: `{"numbers":[333333333.33333329,1e+30,4.5,0.002,1e-27]}`,
+		`[1.0, 10e-1, -0, 0.0e5, 100, 1e21, 1e20, 0.000001, 0.0000001, -12.5e-1]`:       `[1,1,0,0,100,1e+21,100000000000000000000,0.000001,1e-7,-1.25]`,
+		`[12345678901234567890, 12345678901234567891]`:                                  `[12345678901234567890,12345678901234567891]`,
+		`{"s":"€\t\"\\\/\u0001<>& "}`:                                                   "{\"s\":\"€\\t\\\"\\\\/\\u0001<>& \"}",
+		// utf-16 order puts U+1F600 (surrogates) before U+FB33
+		`{"דּ":1,"😀":2,"a":3}`: "{\"a\":3,\"\U0001F600\":2,\"דּ\":1}",
+		`true`:                `true`,
+		// the last value of a repeated key wins, like when decoding into a map
+		`{"a":1,"b":{"y":[1],"x":2},"a":{"c":3}}`: `{"a":{"c":3},"b":{"x":2,"y":[1]}}`,
+		`{"a":[{"b":[{"d":1,"c":[]}]}]}`:          `{"a":[{"b":[{"c":[],"d":1}]}]}`,
+	} {
+		canonical, err := CanonicalJson([]byte(payload))
+		assert.NoError(t, err, payload)
+		assert.Equal(t, expected, string(canonical), payload)
+	}
+
+	for _, payload := range []string{``, `{"a":1`, `{"a":[1,{"b":`, `{"a":1}}`, `{"a":1} {}`, `[1e999999999999999999999]`, `{1:2}`, `{"a" 1}`, `[1,]`} {
+		_, err := CanonicalJson([]byte(payload))
+		assert.Error(t, err, payload)
+	}
+}
+
+func TestReadWebHookObjectHash(t *testing.T) {
+	// ReadWebHookObject canonicalizes while reading, it has to hash the same way as WebHookHash
+	for _, payload := range []string{`{}`, `{"b":[3,{"d":1,"c":2}],"a":null}`, " {\"a\":1.50,\n\"a\":\"\u20ac\"} \n"} {
+		obj, err := ReadWebHookObject(strings.NewReader(payload))
+		assert.NoError(t, err, payload)
+		assert.Equal(t, payload, string(obj.JsonData), "the payload should be kept as it was received")
+		hash, err := WebHookHash(HashAlgorithmCanonicalJson, []byte(payload))
+		assert.NoError(t, err, payload)
+		assert.Equal(t, hash, obj.ID.Hash(), payload)
+	}
+}
+
+func TestWebHookHash(t *testing.T) {
+	hash := func(algorithm HashAlgorithm, payload string) uint32 {
+		res, err := WebHookHash(algorithm, []byte(payload))
+		assert.NoError(t, err, payload)
+		return res
+	}
+
+	// the old algorithm can't tell these apart
+	similar := []string{`{"a":["x","y"]}`, `{"a":"xy"}`, `{"a":{"x":"y"}}`, `{"a":null}`, `{"a":""}`, `{"a":1}`, `{"a":"1"}`, `{"a":1.5}`, `{"a":1.50000000000000001}`}
+	assert.Equal(t, hash(HashAlgorithmConcat, similar[0]), hash(HashAlgorithmConcat, similar[1]))
+	assert.Equal(t, hash(HashAlgorithmConcat, similar[3]), hash(HashAlgorithmConcat, similar[4]))
+	hashes := make(map[uint32]string)
+	for _, payload := range similar {
+		h := hash(HashAlgorithmCanonicalJson, payload)
+		assert.NotContains(t, hashes, h, "%s and %s", payload, hashes[h])
+		hashes[h] = payload
+	}
+
+	assert.Equal(t, hash(HashAlgorithmCanonicalJson, `{"a":{"b":1,"c":[1,2]},"d":1.0}`), hash(HashAlgorithmCanonicalJson, `{"d":1,"a":{"c":[1,2],"b":1}}`))
+	assert.NotEqual(t, hash(HashAlgorithmCanonicalJson, `{"a":[1,2]}`), hash(HashAlgorithmCanonicalJson, `{"a":[2,1]}`))
+
+	_, err := WebHookHash("md5", []byte(`{}`))
+	assert.Error(t, err)
+}
+
+func TestObjectHashAlgorithm(t *testing.T) {
+	obj, err := ReadWebHookObject(strings.NewReader(`{"a":["x","y"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, CurrentHashAlgorithm, ObjectHashAlgorithm(obj))
+
+	// the recorded algorithm is trusted, even if the json was changed afterwards
+	obj.JsonData = []byte(`{"a":"changed"}`)
+	assert.Equal(t, CurrentHashAlgorithm, ObjectHashAlgorithm(obj))
+
+	// ids created before the algorithm was recorded
+	legacy := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 1), JsonData: obj.JsonData}
+	assert.Equal(t, HashAlgorithmConcat, ObjectHashAlgorithm(legacy))
+
+	assert.True(t, IsKnownHashAlgorithm(HashAlgorithmConcat))
+	assert.True(t, IsKnownHashAlgorithm(HashAlgorithmCanonicalJson))
+	assert.False(t, IsKnownHashAlgorithm("md5"))
+}
@@ -23,6 +23,14 @@ var (
 	allKnownDelimiters map[string]*JsonDelimiter
 
 	malformedJsonError = errors.New("invalid json")
+
+	// the webhook payload has no json value at all
+	EmptyWebHookError = errors.New("empty webhook payload")
+	// the webhook payload is json, but not an object
+	NonObjectWebHookError = errors.New("webhook payload is not a json object")
+
+	// returned by readJsonObjectPair once the object it reads from was closed
+	jsonObjectEndError = errors.New("end of json object")
 )
 
 type JsonDelimiter struct {
@@ -72,54 +80,77 @@ func init() {
 
 }
 
-// reads a json object, validates it's format, sorts its keys, calculates the crc32c hash of the result
+// reads a json object, validates its format and hashes it using CurrentHashAlgorithm (HashAlgorithmCanonicalJson)
+// fails with EmptyWebHookError or NonObjectWebHookError if in doesn't have a json object, anything after the object is malformed json
 func ReadWebHookObject(in io.Reader) (*data.WebHookObject, error) {
 
 	receivedAt := time.Now()
 
-	// we need to traverse the in buffer twice
-	//	- once for generating an unique json signature (because its keys are not ordered)
-	// 	- once for reading the whole json - which we need to store somewhere
-	results := make(map[string]*bytes.Buffer)
-	var allJsonBuf bytes.Buffer
-	tee := io.TeeReader(in, &allJsonBuf)
-
-	dec := json.NewDecoder(tee)
+	// a single pass over the payload - it's kept as it was received while it's being canonicalized
+	var jsonData bytes.Buffer
+	dec := json.NewDecoder(io.TeeReader(in, &jsonData))
+	dec.UseNumber()
 
 	t, err := dec.Token()
-	if err != nil {
-		return nil, nil
+	if err == io.EOF {
+		return nil, EmptyWebHookError
+	} else if err != nil {
+		return nil, err
 	}
 
 	jsonDelim, ok := t.(json.Delim)
 	if !ok {
-		return nil, malformedJsonError
+		return nil, NonObjectWebHookError
 	}
 	if jsonDelim.String() != DelimiterObjectStart.value {
-		return nil, malformedJsonError
+		return nil, NonObjectWebHookError
 	}
 
-	for {
-		err = readJsonObjectPair(dec, results)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
+	var canonical bytes.Buffer
+	if err = writeCanonicalJsonObject(dec, &canonical); err != nil {
+		return nil, err
 	}
-
-	hash, err := digestPayload(results)
-	if err != nil {
+	if err = expectJsonEnd(dec); err != nil {
 		return nil, err
 	}
 
 	return &data.WebHookObject{
-		ID:       data.NewObjectIdFromTimestamp(receivedAt, hash),
-		JsonData: allJsonBuf.Bytes(),
+		ID:            data.NewObjectIdFromTimestamp(receivedAt, crc32.Checksum(canonical.Bytes(), hashTable)),
+		JsonData:      jsonData.Bytes(),
+		HashAlgorithm: string(HashAlgorithmCanonicalJson),
 	}, nil
 
 }
 
+// the HashAlgorithmConcat hash of a json object
+// its keys are sorted, then each of them is hashed together with the primitive values it contains
+func concatWebHookHash(jsonData []byte) (uint32, error) {
+	results := make(map[string]*bytes.Buffer)
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+
+	t, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if jsonDelim, ok := t.(json.Delim); !ok || jsonDelim.String() != DelimiterObjectStart.value {
+		return 0, NonObjectWebHookError
+	}
+
+	for {
+		err = readJsonObjectPair(dec, results)
+		if err == jsonObjectEndError {
+			break
+		} else if err == io.EOF {
+			// the object was never closed
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	return digestPayload(results)
+}
+
 func readJsonObjectPair(dec *json.Decoder, dest map[string]*bytes.Buffer) (readError error) {
 
 	delims := list.New() // keeps track of the json delimiter tokens
@@ -133,8 +164,10 @@ func readJsonObjectPair(dec *json.Decoder, dest map[string]*bytes.Buffer) (readE
 	// json object keys must be strings
 	if key, ok := tkn.(string); ok {
 		jsonKey = key
+	} else if delim, ok := tkn.(json.Delim); ok && delim.String() == DelimiterObjectEnd.value {
+		return jsonObjectEndError
 	} else {
-		err = malformedJsonError
+		readError = malformedJsonError
 		goto DONE
 	}
 
@@ -214,7 +247,7 @@ func findKnownJsonDelimiter(token string) *JsonDelimiter {
 	return nil
 }
 
-// generating a crc32c hash for the given json object - having keys sorted
+// generating a crc32c hash for the given json object - having keys sorted (HashAlgorithmConcat)
 func digestPayload(data map[string]*bytes.Buffer) (uint32, error) {
 	keys := make([]string, len(data))
 	i := 0
@@ -232,6 +265,10 @@ func digestPayload(data map[string]*bytes.Buffer) (uint32, error) {
 		if _, err := hash32.Write([]byte(k)); err != nil {
 			return 0, err
 		}
+		// empty values (null, "", {} or []) have no buffer
+		if data[k] == nil {
+			continue
+		}
 		if _, err := hash32.Write(data[k].Bytes()); err != nil {
 			return 0, err
 		}
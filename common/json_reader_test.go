@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
 	"testing"
 	"time"
 	"webhooks/common/data"
@@ -51,6 +53,36 @@ func TestReadWebHookObject(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestReadWebHookObjectInvalid(t *testing.T) {
+	for payload, expected := range map[string]error{
+		``:                EmptyWebHookError,
+		" \n ":            EmptyWebHookError,
+		`[1,2]`:           NonObjectWebHookError,
+		`"a"`:             NonObjectWebHookError,
+		`12`:              NonObjectWebHookError,
+		`null`:            NonObjectWebHookError,
+		`{"a":1`:          io.ErrUnexpectedEOF,
+		`{"a":1}}`:        nil,
+		`{"a":1} {"b":2}`: nil,
+		`{1:2}`:           nil,
+		`nope`:            nil,
+	} {
+		obj, err := ReadWebHookObject(strings.NewReader(payload))
+		assert.Nil(t, obj, payload)
+		if expected != nil {
+			assert.Equal(t, expected, err, payload)
+		} else {
+			assert.Error(t, err, payload)
+		}
+	}
+
+	for _, payload := range []string{" {\"a\":{}} \n", `{}`, `{"a":null,"b":"","c":[]}`} {
+		obj, err := ReadWebHookObject(strings.NewReader(payload))
+		assert.NoError(t, err, payload)
+		assert.NotNil(t, obj, payload)
+	}
+}
+
 func makeObj(t *testing.T, m map[string]interface{}) *data.WebHookObject {
 	payload, _ := json.Marshal(m)
 	webhook, err := ReadWebHookObject(bytes.NewReader(payload))
@@ -2,73 +2,257 @@ package common
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"sync"
 	"time"
 	"webhooks/common/data"
 	"webhooks/common/storage"
 )
 
+var (
+	ObjectBufferClosedError = errors.New("object buffer closed")
+	ObjectBufferFullError   = errors.New("object buffer full")
+)
+
+// number of times a batch is saved before its failing objects are given up on, unless MaxFlushAttempts is set
+// with the default backoff, that's about 6 minutes
+const DefaultMaxFlushAttempts = 20
+
+type ObjectBufferOptions struct {
+	// a batch is flushed once it has this many objects
+	MaxBufferSize int
+	// or once its payloads (json and raw data) have this many bytes - 0 disables it
+	MaxBufferBytes int
+	// or once this much time passed since the last flush
+	FlushTimeout time.Duration
+	// how many batches are saved at the same time, defaults to 1
+	FlushWorkers int
+	// how many batches can wait for a worker or be saved at the same time, defaults to FlushWorkers
+	// once reached, the buffer fills up and Add starts waiting
+	MaxInFlight int
+	// how long Add waits for room in a full buffer before failing with ObjectBufferFullError - 0 waits as long as needed
+	AddTimeout time.Duration
+	// each object is appended to the log before Add returns - nil keeps the objects only in memory
+	WriteAheadLog *storage.WriteAheadLog
+	// how many times a batch is saved before giving up on its failing objects - 0 uses DefaultMaxFlushAttempts
+	// objects the store will never accept (ex too big) are given up on right away
+	MaxFlushAttempts int
+	// the objects given up on are saved here - nil keeps the write ahead log segments holding them, so they're retried after a restart
+	DeadLetterStore storage.Store
+}
+
 // collects data and groups it in batches based on the maxBufferSize and flushTimeout config options
+// failed flushes are retried with backoff, objects added meanwhile go in the next batch
 func NewObjectBuffer(store storage.Store, maxBufferSize int, flushTimeout time.Duration) *ObjectBuffer {
-	return &ObjectBuffer{
+	b, _ := NewObjectBufferWithOptions(store, ObjectBufferOptions{
+		MaxBufferSize: maxBufferSize,
+		FlushTimeout:  flushTimeout,
+	})
+	return b
+}
+
+// like NewObjectBuffer, but each object is appended to the write ahead log before Add returns
+// the objects left in the log by a previous run are flushed first
+func NewDurableObjectBuffer(store storage.Store, maxBufferSize int, flushTimeout time.Duration, wal *storage.WriteAheadLog) (*ObjectBuffer, error) {
+	return NewObjectBufferWithOptions(store, ObjectBufferOptions{
+		MaxBufferSize: maxBufferSize,
+		FlushTimeout:  flushTimeout,
+		WriteAheadLog: wal,
+	})
+}
+
+// fails only if the write ahead log can't be replayed
+func NewObjectBufferWithOptions(store storage.Store, options ObjectBufferOptions) (*ObjectBuffer, error) {
+	if options.FlushWorkers <= 0 {
+		options.FlushWorkers = 1
+	}
+	if options.MaxInFlight < options.FlushWorkers {
+		options.MaxInFlight = options.FlushWorkers
+	}
+	if options.MaxFlushAttempts <= 0 {
+		options.MaxFlushAttempts = DefaultMaxFlushAttempts
+	}
+
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	b := &ObjectBuffer{
 		flushChan:     make(chan struct{}, 1),
-		closeChan:     make(chan struct{}, 1),
-		inChan:        make(chan *data.WebHookObject),
+		closeChan:     make(chan struct{}),
+		doneChan:      make(chan struct{}),
+		batchChan:     make(chan *objectBatch, options.MaxInFlight),
+		inFlight:      make(chan struct{}, options.MaxInFlight),
+		runCtx:        runCtx,
+		cancelRun:     cancelRun,
 		storage:       store,
-		flushTimeout:  flushTimeout,
-		maxBufferSize: maxBufferSize,
+		options:       options,
+		wal:           options.WriteAheadLog,
+		retryBaseWait: time.Millisecond * 100,
+		retryMaxWait:  time.Second * 30,
+		pending:       make([]*data.WebHookObject, 0),
+		spaceChan:     make(chan struct{}),
 	}
+
+	if b.wal == nil {
+		return b, nil
+	}
+
+	replayed, segments, err := b.wal.Replay()
+	if err != nil {
+		return nil, err
+	}
+	b.pendingSegments = segments
+	if len(replayed) > 0 {
+		Logger.WithField("objects", len(replayed)).Info("replaying the write ahead log")
+		for _, item := range replayed {
+			b.pending = append(b.pending, item)
+			b.pendingBytes += len(item.JsonData) + len(item.RawData)
+		}
+		b.run().Flush()
+	}
+
+	return b, nil
 }
 
 type ObjectBuffer struct {
 	flushChan     chan struct{}
-	closeChan     chan struct{}
+	closeChan     chan struct{}     // closed by Close, the run loop does a final flush and stops
+	doneChan      chan struct{}     // closed once the run loop and the workers stopped
+	batchChan     chan *objectBatch // batches waiting for a worker
+	inFlight      chan struct{}     // holds a value for each batch that wasn't saved yet
+	closeErr      error             // error of the flushes cancelled by Close, set before doneChan is closed
+	closeErrMux   sync.Mutex
+	closeOnce     sync.Once
 	runOnce       sync.Once
-	inChan        chan *data.WebHookObject
+	runCtx        context.Context // cancelled when Close can't wait anymore for the store
+	cancelRun     context.CancelFunc
 	storage       storage.Store
-	flushTimeout  time.Duration
-	maxBufferSize int
+	options       ObjectBufferOptions
+	wal           *storage.WriteAheadLog // nil if the objects are kept only in memory
+	retryBaseWait time.Duration
+	retryMaxWait  time.Duration
+
+	pendingMux      sync.Mutex
+	pending         []*data.WebHookObject
+	pendingBytes    int
+	pendingSegments []uint64 // closed write ahead log segments holding some of the pending objects
+	pendingFutures  []*ObjectFuture
+	spaceChan       chan struct{} // closed and replaced each time the pending objects are taken
+	isClosed        bool
+
+	statsMux sync.Mutex
+	stats    ObjectBufferStats
+}
+
+type ObjectBufferStats struct {
+	Pending      int // objects waiting for the next batch
+	PendingBytes int
+	InFlight     int // batches waiting for a worker or being saved
+	Flushes      int // batches saved
+	Failures     int // failed Put calls, retries included
+	GivenUp      int // objects which couldn't be saved in the store
+	// how long saving the last batch took, retries included
+	LastFlushLatency time.Duration
+}
+
+// objects saved with a single Put, along with the write ahead log segments holding them
+type objectBatch struct {
+	objects  []*data.WebHookObject
+	segments []uint64
+	futures  []*ObjectFuture
+}
+
+// completes once the batch holding an object was saved, or once the buffer gave up on it
+type ObjectFuture struct {
+	id   data.ObjectID
+	done chan struct{}
+	err  error
+}
+
+func newObjectFuture(id data.ObjectID) *ObjectFuture {
+	return &ObjectFuture{id: id, done: make(chan struct{})}
+}
+
+func (f *ObjectFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// closed once the future completed
+func (f *ObjectFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// nil once the object was saved, valid only after Done was closed
+func (f *ObjectFuture) Err() error {
+	return f.err
+}
+
+// waits for the future to complete and returns its error, or ctx.Err() if ctx is done first
+func (f *ObjectFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (b *ObjectBuffer) run() *ObjectBuffer {
 	b.runOnce.Do(func() {
-		go func() {
-
-			defer func() {
-				close(b.closeChan)
-				close(b.flushChan)
-				close(b.inChan)
+		var workers sync.WaitGroup
+		for i := 0; i < b.options.FlushWorkers; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for batch := range b.batchChan {
+					b.saveBatch(b.runCtx, batch)
+					<-b.inFlight
+				}
 			}()
+		}
 
-			flushTicker := time.NewTicker(b.flushTimeout)
+		go func() {
+			defer close(b.doneChan)
 
-			pending := make([]*data.WebHookObject, 0)
+			// counts from the last flush, whatever triggered it
+			flushTimer := time.NewTimer(b.options.FlushTimeout)
+			defer flushTimer.Stop()
+			resetFlushTimer := func() {
+				if !flushTimer.Stop() {
+					select {
+					case <-flushTimer.C:
+					default:
+					}
+				}
+				flushTimer.Reset(b.options.FlushTimeout)
+			}
 
 			for {
 				select {
-				case _ = <-b.flushChan:
-					flushTicker.Stop()
-					//TODO lots of this can be improved here
-					//TODO needs some proper error handling
-					err := b.storage.Put(context.TODO(), pending)
-					if err != nil {
-						fmt.Printf(err.Error())
-					} else {
+				case <-b.flushChan:
+					b.dispatch()
+					resetFlushTimer()
+				case <-flushTimer.C:
+					b.dispatch()
+					resetFlushTimer()
+				case <-b.closeChan:
+					b.dispatch()
+					close(b.batchChan)
+					workers.Wait()
 
+					// left only if Close gave up before a worker was free
+					b.pendingMux.Lock()
+					for _, future := range b.pendingFutures {
+						future.complete(ObjectBufferClosedError)
 					}
-					//TODO this should be done only when there's not an error
-					pending = make([]*data.WebHookObject, 0)
-
-					flushTicker = time.NewTicker(b.flushTimeout)
-				case v := <-b.inChan:
-					pending = append(pending, v)
-					if len(pending) >= b.maxBufferSize {
-						b.Flush()
-					}
+					b.pendingFutures = nil
+					b.pendingMux.Unlock()
 
-				case <-flushTicker.C:
-					b.Flush()
+					if b.wal != nil {
+						if err := b.wal.Close(); err != nil {
+							b.setCloseErr(err)
+						}
+					}
+					return
 				}
 			}
 		}()
@@ -77,21 +261,317 @@ func (b *ObjectBuffer) run() *ObjectBuffer {
 	return b
 }
 
-func (b *ObjectBuffer) Add(item *data.WebHookObject) bool {
+// hands the pending objects to the workers, waits for a free in flight slot first
+func (b *ObjectBuffer) dispatch() {
 	select {
-	case b.run().inChan <- item:
-		return true
-	default:
+	case b.inFlight <- struct{}{}:
+	case <-b.runCtx.Done():
+		return
+	}
+
+	batch := b.takePending()
+	if len(batch.objects) == 0 {
+		<-b.inFlight
+		return
+	}
+	b.batchChan <- batch
+}
+
+func (b *ObjectBuffer) setCloseErr(err error) {
+	b.closeErrMux.Lock()
+	defer b.closeErrMux.Unlock()
+	b.closeErr = err
+}
+
+// saves the batch, retrying with backoff at most MaxFlushAttempts times or until ctx is done
+// the objects which still couldn't be saved are moved to the dead letter store and their futures fail
+// the write ahead log segments holding the batch are removed only once none of its objects can be lost
+func (b *ObjectBuffer) saveBatch(ctx context.Context, batch *objectBatch) {
+	objects := batch.objects
+	givenUp := make([]*data.WebHookObject, 0)
+	var givenUpErr error
+	start := time.Now()
+
+	for attempt := 1; len(objects) > 0; attempt++ {
+		err := b.storage.Put(ctx, objects)
+		if err == nil {
+			break
+		}
+		b.updateStats(func(stats *ObjectBufferStats) { stats.Failures += 1 })
+
+		// the other objects were saved, retry only the failed ones the store might still accept
+		retry, rejected := splitFailedObjects(objects, err)
+		if len(rejected) > 0 {
+			Logger.WithError(err).WithField("objects", len(rejected)).Error("the store rejected some objects, giving up on them")
+			givenUp, givenUpErr = append(givenUp, rejected...), err
+		}
+		objects = retry
+		if len(objects) == 0 {
+			break
+		}
+		if attempt >= b.options.MaxFlushAttempts {
+			Logger.WithError(err).WithField("objects", len(objects)).Errorf("flush failed %d times, giving up", attempt)
+			givenUp, givenUpErr = append(givenUp, objects...), err
+			break
+		}
+
+		wait := b.retryWait(attempt - 1)
+		if ctx.Err() == nil {
+			Logger.WithError(err).WithField("objects", len(objects)).Warnf("flush failed, retrying in %v", wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			// only Close cancels ctx, it returns this error
+			Logger.WithError(err).WithField("objects", len(objects)).Error("flush failed, giving up")
+			b.setCloseErr(err)
+			for _, future := range batch.futures {
+				future.complete(err)
+			}
+			return
+		}
+	}
+
+	keepSegments := len(givenUp) > 0 && !b.saveDeadLetters(ctx, givenUp)
+
+	b.updateStats(func(stats *ObjectBufferStats) {
+		stats.Flushes += 1
+		stats.GivenUp += len(givenUp)
+		stats.LastFlushLatency = time.Since(start)
+	})
+	failedIds := make(map[data.ObjectID]bool, len(givenUp))
+	for _, obj := range givenUp {
+		failedIds[obj.ID] = true
+	}
+	for _, future := range batch.futures {
+		if failedIds[future.id] {
+			future.complete(givenUpErr)
+		} else {
+			future.complete(nil)
+		}
+	}
+
+	if keepSegments {
+		Logger.WithField("segments", batch.segments).Error("keeping the write ahead log segments of the objects given up on")
+		return
+	}
+	for _, seq := range batch.segments {
+		if err := b.wal.Remove(seq); err != nil {
+			Logger.WithError(err).Error("error while removing a flushed write ahead log segment")
+		}
+	}
+}
+
+// saves the objects given up on in the dead letter store, returns false if there's none or it failed
+func (b *ObjectBuffer) saveDeadLetters(ctx context.Context, objects []*data.WebHookObject) bool {
+	if b.options.DeadLetterStore == nil {
 		return false
 	}
+	if err := b.options.DeadLetterStore.Put(ctx, objects); err != nil {
+		Logger.WithError(err).WithField("objects", len(objects)).Error("couldn't save the objects given up on in the dead letter store")
+		return false
+	}
+	Logger.WithField("objects", len(objects)).Warn("objects moved to the dead letter store")
+	return true
+}
+
+// swaps the pending objects with an empty batch
+// the write ahead log is rotated at the same time, so the closed segments hold only the returned objects
+// if the log can't be rotated, the objects stay pending and the next flush tries again
+func (b *ObjectBuffer) takePending() *objectBatch {
+	b.pendingMux.Lock()
+	defer b.pendingMux.Unlock()
+
+	if len(b.pending) == 0 {
+		return &objectBatch{}
+	}
+
+	batch := &objectBatch{objects: b.pending, futures: b.pendingFutures}
+	if b.wal != nil {
+		seq, err := b.wal.Rotate()
+		if err != nil {
+			Logger.WithError(err).Error("error while rotating the write ahead log")
+			return &objectBatch{}
+		}
+		batch.segments = append(b.pendingSegments, seq)
+		b.pendingSegments = nil
+	}
+
+	b.pending = make([]*data.WebHookObject, 0)
+	b.pendingFutures = nil
+	b.pendingBytes = 0
+	close(b.spaceChan)
+	b.spaceChan = make(chan struct{})
+	return batch
+}
+
+func (b *ObjectBuffer) isFull() bool {
+	return len(b.pending) >= b.options.MaxBufferSize ||
+		(b.options.MaxBufferBytes > 0 && b.pendingBytes >= b.options.MaxBufferBytes)
+}
+
+func (b *ObjectBuffer) retryWait(attempt int) time.Duration {
+	wait := b.retryBaseWait
+	for i := 0; i < attempt && wait < b.retryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > b.retryMaxWait {
+		wait = b.retryMaxWait
+	}
+	return wait
+}
+
+// splits the objects a Put call failed with err into the ones worth retrying and the ones the store will never accept
+func splitFailedObjects(objects []*data.WebHookObject, err error) ([]*data.WebHookObject, []*data.WebHookObject) {
+	switch e := err.(type) {
+	case *storage.PermanentPutError:
+		return nil, objects
+	case *storage.PartialPutError:
+		failed := make(map[data.ObjectID]bool, len(e.FailedIds))
+		for _, id := range e.FailedIds {
+			failed[id] = true
+		}
+		permanent := make(map[data.ObjectID]bool, len(e.PermanentIds))
+		for _, id := range e.PermanentIds {
+			permanent[id] = true
+		}
+
+		retry := make([]*data.WebHookObject, 0, len(e.FailedIds))
+		rejected := make([]*data.WebHookObject, 0, len(e.PermanentIds))
+		for _, obj := range objects {
+			if permanent[obj.ID] {
+				rejected = append(rejected, obj)
+			} else if failed[obj.ID] {
+				retry = append(retry, obj)
+			}
+		}
+		return retry, rejected
+	default:
+		return objects, nil
+	}
+}
+
+// the object won't be lost once Add returns without an error - it's in the write ahead log, or in memory if there's none
+// if the buffer is full because all workers are busy, it waits at most AddTimeout for the pending objects to be taken
+func (b *ObjectBuffer) Add(item *data.WebHookObject) error {
+	return b.add(item, nil)
+}
+
+// like Add, the returned future completes once the object was saved in the store
+// it fails if the store didn't accept the object, even if it was then saved in the dead letter store
+func (b *ObjectBuffer) AddWithFuture(item *data.WebHookObject) (*ObjectFuture, error) {
+	future := newObjectFuture(item.ID)
+	if err := b.add(item, future); err != nil {
+		return nil, err
+	}
+	return future, nil
+}
+
+func (b *ObjectBuffer) add(item *data.WebHookObject, future *ObjectFuture) error {
+	b.run()
+
+	var timeout <-chan time.Time
+	if b.options.AddTimeout > 0 {
+		timer := time.NewTimer(b.options.AddTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	b.pendingMux.Lock()
+	for !b.isClosed && b.isFull() {
+		space := b.spaceChan
+		b.pendingMux.Unlock()
+
+		b.Flush()
+		select {
+		case <-space:
+		case <-b.closeChan:
+		case <-timeout:
+			return ObjectBufferFullError
+		}
+		b.pendingMux.Lock()
+	}
+
+	if b.isClosed {
+		b.pendingMux.Unlock()
+		return ObjectBufferClosedError
+	}
+	// the record is written while holding the lock, so it ends up in the segment closed together with its batch
+	// the fsync is done afterwards and shared with the concurrent adds
+	var walPosition uint64
+	if b.wal != nil {
+		var err error
+		if walPosition, err = b.wal.Write(item); err != nil {
+			b.pendingMux.Unlock()
+			return err
+		}
+	}
+	b.pending = append(b.pending, item)
+	b.pendingBytes += len(item.JsonData) + len(item.RawData)
+	if future != nil {
+		b.pendingFutures = append(b.pendingFutures, future)
+	}
+	isFull := b.isFull()
+	b.pendingMux.Unlock()
+
+	if isFull {
+		b.Flush()
+	}
+	if b.wal != nil {
+		// the object might still be saved, the caller retrying with the same id is harmless
+		return b.wal.Sync(walPosition)
+	}
+	return nil
 }
 
 func (b *ObjectBuffer) Flush() bool {
 	return b.signal(b.flushChan)
 }
 
-func (b *ObjectBuffer) Close() bool {
-	return b.signal(b.closeChan)
+func (b *ObjectBuffer) updateStats(fn func(stats *ObjectBufferStats)) {
+	b.statsMux.Lock()
+	defer b.statsMux.Unlock()
+	fn(&b.stats)
+}
+
+func (b *ObjectBuffer) Stats() ObjectBufferStats {
+	b.pendingMux.Lock()
+	pending, pendingBytes := len(b.pending), b.pendingBytes
+	b.pendingMux.Unlock()
+
+	b.statsMux.Lock()
+	defer b.statsMux.Unlock()
+
+	stats := b.stats
+	stats.Pending = pending
+	stats.PendingBytes = pendingBytes
+	stats.InFlight = len(b.inFlight)
+	return stats
+}
+
+// stops accepting objects, flushes the pending ones and waits for the store to save them
+// if ctx is done first, the in flight Put calls are cancelled - Close still waits for them to return
+// returns the error of the Put calls that were cancelled, or ctx.Err() if there were none
+func (b *ObjectBuffer) Close(ctx context.Context) error {
+	b.pendingMux.Lock()
+	b.isClosed = true
+	b.pendingMux.Unlock()
+
+	b.closeOnce.Do(func() {
+		close(b.run().closeChan)
+	})
+
+	select {
+	case <-b.doneChan:
+		return b.closeErr
+	case <-ctx.Done():
+		b.cancelRun()
+		<-b.doneChan
+		if b.closeErr != nil {
+			return b.closeErr
+		}
+		return ctx.Err()
+	}
 }
 
 func (b *ObjectBuffer) signal(ch chan struct{}) bool {
@@ -0,0 +1,497 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+// polls cond until it's true, like assert.Eventually
+// testify's version panics when it times out while cond is still running, which hides the actual failure
+func eventually(t *testing.T, cond func() bool, waitFor time.Duration, tick time.Duration, msgAndArgs ...interface{}) bool {
+	deadline := time.Now().Add(waitFor)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return assert.Fail(t, "condition never satisfied", msgAndArgs...)
+		}
+		time.Sleep(tick)
+	}
+	return true
+}
+
+func TestObjectBuffer(t *testing.T) {
+	store := storage.NewMemoryStore()
+	buffer := NewObjectBuffer(store, 2, time.Hour)
+	now := time.Now()
+
+	add := func(hash uint32) {
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(now, hash), JsonData: []byte(`{}`)}
+		assert.NoError(t, buffer.Add(obj))
+	}
+
+	add(1)
+	assert.Equal(t, 0, store.Len())
+
+	add(2)
+	eventually(t, func() bool {
+		return store.Len() == 2
+	}, time.Second, time.Millisecond, "should flush once maxBufferSize is reached")
+
+	add(3)
+	assert.True(t, buffer.Flush())
+	eventually(t, func() bool {
+		return store.Len() == 3
+	}, time.Second, time.Millisecond, "should flush when asked to")
+}
+
+func TestObjectBufferFlushTimeout(t *testing.T) {
+	store := storage.NewMemoryStore()
+	buffer := NewObjectBuffer(store, 100, time.Millisecond*20)
+
+	obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 1), JsonData: []byte(`{}`)}
+	assert.NoError(t, buffer.Add(obj))
+
+	eventually(t, func() bool {
+		return store.Len() == 1
+	}, time.Second, time.Millisecond*5, "should flush after flushTimeout")
+}
+
+func TestObjectBufferFlushTimeoutReset(t *testing.T) {
+	store := storage.NewMemoryStore()
+	buffer := NewObjectBuffer(store, 100, time.Millisecond*200)
+
+	add := func(hash uint32) {
+		assert.NoError(t, buffer.Add(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), hash), JsonData: []byte(`{}`)}))
+	}
+
+	add(1)
+	time.Sleep(time.Millisecond * 100)
+	assert.True(t, buffer.Flush())
+	eventually(t, func() bool {
+		return store.Len() == 1
+	}, time.Second, time.Millisecond)
+
+	// the timeout starts over after the explicit flush, the next object waits for the full timeout
+	add(2)
+	time.Sleep(time.Millisecond * 150)
+	assert.Equal(t, 1, store.Len(), "shouldn't flush before flushTimeout passed since the last flush")
+	eventually(t, func() bool {
+		return store.Len() == 2
+	}, time.Second, time.Millisecond*5, "should flush after flushTimeout")
+}
+
+// fails the first Put calls, then saves in the wrapped store
+type flakyStore struct {
+	storage.Store
+	mux      sync.Mutex
+	failures int
+}
+
+func (s *flakyStore) Put(ctx context.Context, objects []*data.WebHookObject) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.failures > 0 {
+		s.failures -= 1
+		return errors.New("flaky store")
+	}
+	return s.Store.Put(ctx, objects)
+}
+
+func TestObjectBufferRetry(t *testing.T) {
+	memStore := storage.NewMemoryStore()
+	buffer := NewObjectBuffer(&flakyStore{Store: memStore, failures: 3}, 2, time.Hour)
+	buffer.retryBaseWait = time.Millisecond
+
+	for i := 0; i < 4; i++ {
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)}
+		assert.NoError(t, buffer.Add(obj))
+	}
+
+	eventually(t, func() bool {
+		return memStore.Len() == 4
+	}, time.Second, time.Millisecond, "failed batches should be retried, not dropped")
+	assert.Equal(t, 3, buffer.Stats().Failures)
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	assert.NoError(t, err)
+	return files
+}
+
+func TestDurableObjectBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// nothing is ever saved by the first buffer, as if the process crashed
+	wal, err := storage.NewWriteAheadLog(dir)
+	assert.NoError(t, err)
+	buffer, err := NewDurableObjectBuffer(&flakyStore{failures: 1000000}, 100, time.Hour, wal)
+	assert.NoError(t, err)
+
+	ids := make([]data.ObjectID, 0)
+	for i := 0; i < 3; i++ {
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{"a":1}`)}
+		ids = append(ids, obj.ID)
+		assert.NoError(t, buffer.Add(obj))
+	}
+	assert.NoError(t, wal.Close())
+
+	// a torn record at the end of the log
+	segments := walSegments(t, dir)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	assert.NoError(t, err)
+	f.Close()
+
+	store := storage.NewMemoryStore()
+	wal, err = storage.NewWriteAheadLog(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+	buffer, err = NewDurableObjectBuffer(store, 100, time.Hour, wal)
+	assert.NoError(t, err)
+
+	eventually(t, func() bool {
+		return store.Len() == 3
+	}, time.Second, time.Millisecond, "objects left in the log should be replayed")
+	objects, err := storage.LoadStorageObjectsSync(context.Background(), store, ids)
+	assert.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	eventually(t, func() bool {
+		return len(walSegments(t, dir)) == 1
+	}, time.Second, time.Millisecond, "only the current segment should be left once the objects were saved")
+}
+
+func TestDurableObjectBufferConcurrentAdds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wal, err := storage.NewWriteAheadLog(dir)
+	assert.NoError(t, err)
+	store := storage.NewMemoryStore()
+	buffer, err := NewDurableObjectBuffer(store, 10, time.Hour, wal)
+	assert.NoError(t, err)
+
+	// the objects are written to the log while batches are taken, each one has to end up in the segment of its batch
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, buffer.Add(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)}))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NoError(t, buffer.Close(context.Background()))
+	assert.Equal(t, 100, store.Len())
+	assert.Len(t, walSegments(t, dir), 1, "the segments of the saved batches should be removed")
+}
+
+func TestDurableObjectBufferRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wal, err := storage.NewWriteAheadLog(dir)
+	assert.NoError(t, err)
+	store := storage.NewMemoryStore()
+	buffer, err := NewDurableObjectBuffer(store, 100, time.Hour, wal)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, buffer.Add(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)}))
+	}
+
+	// a directory in place of the next segment, the log can't be rotated
+	segments := walSegments(t, dir)
+	blocker := filepath.Join(dir, fmt.Sprintf("%020d.wal", 1))
+	assert.NoError(t, os.Mkdir(blocker, 0755))
+
+	// the run loop handles one signal at a time, once the second one was taken the first flush is over
+	for i := 0; i < 2; i++ {
+		assert.True(t, buffer.Flush())
+		eventually(t, func() bool {
+			return len(buffer.flushChan) == 0
+		}, time.Second, time.Millisecond)
+	}
+	assert.Equal(t, 0, store.Len(), "the objects shouldn't be saved apart from their segment")
+	assert.Equal(t, 2, buffer.Stats().Pending)
+
+	// the next flush takes them along with their segment
+	assert.NoError(t, os.Remove(blocker))
+	assert.NoError(t, buffer.Close(context.Background()))
+	assert.Equal(t, 2, store.Len())
+	remaining := walSegments(t, dir)
+	assert.Len(t, remaining, 1)
+	assert.NotEqual(t, segments, remaining, "the segment of the saved objects should be removed")
+}
+
+// the adds share the write ahead log fsyncs, so they scale with the number of concurrent requests
+// go test -bench DurableObjectBuffer -cpu 1,8 ./common
+func BenchmarkDurableObjectBufferAdd(b *testing.B) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := storage.NewWriteAheadLog(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buffer, err := NewDurableObjectBuffer(storage.NewMemoryStore(), 1000, time.Hour, wal)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer buffer.Close(context.Background())
+
+	var hash uint32
+	var hashMux sync.Mutex
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			hashMux.Lock()
+			hash += 1
+			obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), hash), JsonData: []byte(`{"a":1}`)}
+			hashMux.Unlock()
+			if err := buffer.Add(obj); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestObjectBufferClose(t *testing.T) {
+	store := storage.NewMemoryStore()
+	store.Latency = time.Millisecond * 50
+	buffer := NewObjectBuffer(store, 2, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)}
+		assert.NoError(t, buffer.Add(obj))
+	}
+
+	// the first batch may still be saving, Close has to wait for it and flush the last object
+	assert.NoError(t, buffer.Close(context.Background()))
+	assert.Equal(t, 3, store.Len())
+
+	obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 10), JsonData: []byte(`{}`)}
+	assert.Equal(t, ObjectBufferClosedError, buffer.Add(obj))
+	assert.NoError(t, buffer.Close(context.Background()), "closing again shouldn't fail")
+}
+
+func TestObjectBufferCloseDeadline(t *testing.T) {
+	buffer := NewObjectBuffer(&flakyStore{failures: 1000000}, 100, time.Hour)
+	buffer.retryBaseWait = time.Millisecond
+
+	obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 1), JsonData: []byte(`{}`)}
+	assert.NoError(t, buffer.Add(obj))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := buffer.Close(ctx)
+	assert.EqualError(t, err, "flaky store", "the store error should be returned once the deadline is reached")
+}
+
+// blocks each Put until release is closed, keeps track of the concurrent calls
+type blockingStore struct {
+	storage.Store
+	release    chan struct{}
+	mux        sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (s *blockingStore) Put(ctx context.Context, objects []*data.WebHookObject) error {
+	s.mux.Lock()
+	s.running += 1
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mux.Unlock()
+
+	<-s.release
+
+	s.mux.Lock()
+	s.running -= 1
+	s.mux.Unlock()
+	return s.Store.Put(ctx, objects)
+}
+
+func (s *blockingStore) MaxRunning() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.maxRunning
+}
+
+func TestObjectBufferWorkers(t *testing.T) {
+	store := &blockingStore{Store: storage.NewMemoryStore(), release: make(chan struct{})}
+	buffer, err := NewObjectBufferWithOptions(store, ObjectBufferOptions{
+		MaxBufferSize: 1,
+		FlushTimeout:  time.Hour,
+		FlushWorkers:  3,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)}
+		assert.NoError(t, buffer.Add(obj))
+	}
+	eventually(t, func() bool {
+		return store.MaxRunning() == 3
+	}, time.Second, time.Millisecond, "batches should be saved concurrently")
+
+	close(store.release)
+	assert.NoError(t, buffer.Close(context.Background()))
+	assert.Equal(t, 3, buffer.Stats().Flushes)
+}
+
+func TestObjectBufferMaxBytes(t *testing.T) {
+	store := storage.NewMemoryStore()
+	buffer, err := NewObjectBufferWithOptions(store, ObjectBufferOptions{
+		MaxBufferSize:  100,
+		MaxBufferBytes: 10,
+		FlushTimeout:   time.Hour,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, buffer.Add(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 1), JsonData: []byte(`{"a":1}`)}))
+	assert.Equal(t, 7, buffer.Stats().PendingBytes)
+
+	assert.NoError(t, buffer.Add(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 2), JsonData: []byte(`{"a":2}`)}))
+	eventually(t, func() bool {
+		return store.Len() == 2
+	}, time.Second, time.Millisecond, "should flush once MaxBufferBytes is reached")
+}
+
+func TestObjectBufferBackpressure(t *testing.T) {
+	store := &blockingStore{Store: storage.NewMemoryStore(), release: make(chan struct{})}
+	buffer, err := NewObjectBufferWithOptions(store, ObjectBufferOptions{
+		MaxBufferSize: 1,
+		FlushTimeout:  time.Hour,
+		AddTimeout:    time.Millisecond * 20,
+	})
+	assert.NoError(t, err)
+
+	add := func(hash uint32) error {
+		return buffer.Add(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), hash), JsonData: []byte(`{}`)})
+	}
+
+	// the first object is being saved, the second one fills the buffer
+	assert.NoError(t, add(1))
+	eventually(t, func() bool {
+		return buffer.Stats().InFlight == 1 && buffer.Stats().Pending == 0
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, add(2))
+
+	assert.Equal(t, ObjectBufferFullError, add(3))
+	stats := buffer.Stats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 1, stats.InFlight)
+
+	// once the store catches up, there's room again
+	close(store.release)
+	assert.NoError(t, add(3))
+	assert.NoError(t, buffer.Close(context.Background()))
+	assert.Equal(t, 3, store.Store.(*storage.MemoryStore).Len())
+}
+
+func TestObjectBufferFuture(t *testing.T) {
+	store := storage.NewMemoryStore()
+	buffer := NewObjectBuffer(store, 100, time.Hour)
+
+	future, err := buffer.AddWithFuture(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 1), JsonData: []byte(`{}`)})
+	assert.NoError(t, err)
+
+	select {
+	case <-future.Done():
+		assert.Fail(t, "the future shouldn't complete before the object was saved")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	assert.True(t, buffer.Flush())
+	assert.NoError(t, future.Wait(context.Background()))
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestObjectBufferRejectedObjects(t *testing.T) {
+	store := storage.NewMemoryStore()
+	store.Reject = func(obj *data.WebHookObject) bool {
+		return obj.ID.Hash() == 2
+	}
+	deadLetters := storage.NewMemoryStore()
+	buffer, err := NewObjectBufferWithOptions(store, ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour, DeadLetterStore: deadLetters})
+	assert.NoError(t, err)
+
+	futures := make([]*ObjectFuture, 0)
+	for i := 1; i <= 3; i++ {
+		future, err := buffer.AddWithFuture(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)})
+		assert.NoError(t, err)
+		futures = append(futures, future)
+	}
+	assert.True(t, buffer.Flush())
+
+	assert.NoError(t, futures[0].Wait(context.Background()))
+	assert.IsType(t, &storage.PartialPutError{}, futures[1].Wait(context.Background()), "the rejected object should fail its future")
+	assert.NoError(t, futures[2].Wait(context.Background()))
+
+	assert.Equal(t, 2, store.Len())
+	assert.Equal(t, 1, deadLetters.Len())
+	stats := buffer.Stats()
+	assert.Equal(t, 1, stats.Failures, "rejected objects shouldn't be retried")
+	assert.Equal(t, 1, stats.GivenUp)
+	assert.NoError(t, buffer.Close(context.Background()))
+}
+
+func TestDurableObjectBufferMaxFlushAttempts(t *testing.T) {
+	for _, withDeadLetters := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "wal")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		wal, err := storage.NewWriteAheadLog(dir)
+		assert.NoError(t, err)
+		options := ObjectBufferOptions{MaxBufferSize: 100, FlushTimeout: time.Hour, WriteAheadLog: wal, MaxFlushAttempts: 3}
+		deadLetters := storage.NewMemoryStore()
+		if withDeadLetters {
+			options.DeadLetterStore = deadLetters
+		}
+		buffer, err := NewObjectBufferWithOptions(&flakyStore{failures: 1000000}, options)
+		assert.NoError(t, err)
+		buffer.retryBaseWait = time.Millisecond
+
+		future, err := buffer.AddWithFuture(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), 1), JsonData: []byte(`{}`)})
+		assert.NoError(t, err)
+		assert.True(t, buffer.Flush())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		assert.EqualError(t, future.Wait(ctx), "flaky store", "the buffer should give up after MaxFlushAttempts")
+		cancel()
+		assert.Equal(t, 3, buffer.Stats().Failures)
+		assert.Equal(t, 1, buffer.Stats().GivenUp)
+		assert.NoError(t, buffer.Close(context.Background()))
+
+		if withDeadLetters {
+			assert.Equal(t, 1, deadLetters.Len())
+			assert.Len(t, walSegments(t, dir), 1, "the segment of an object moved to the dead letter store should be removed")
+		} else {
+			assert.Len(t, walSegments(t, dir), 2, "the segment of an object given up on should be kept without a dead letter store")
+		}
+	}
+}
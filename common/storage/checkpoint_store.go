@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// partition used for checkpoints in the dynamodb table - it never collides with a date partition
+	dbCheckpointPartition   = "sync_checkpoints"
+	dbColumnCheckpointValue = "synced_until"
+)
+
+// keeps track of the max timestamp that was successfully synced for each slave
+type CheckpointStore interface {
+	// returns a zero time if there's no checkpoint for the given slave
+	Load(ctx context.Context, slave string) (time.Time, error)
+
+	Save(ctx context.Context, slave string, syncedUntil time.Time) error
+}
+
+// implements CheckpointStore using a json file - {slave: unix timestamp}
+func NewFileCheckpointStore(path string) CheckpointStore {
+	return &fileCheckpointStore{
+		path: path,
+	}
+}
+
+type fileCheckpointStore struct {
+	path string
+	mux  sync.Mutex
+}
+
+func (s *fileCheckpointStore) Load(ctx context.Context, slave string) (time.Time, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	checkpoints, err := s.read()
+	if err != nil {
+		return zeroTime, err
+	}
+	if ts, ok := checkpoints[slave]; ok {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+	return zeroTime, nil
+}
+
+func (s *fileCheckpointStore) Save(ctx context.Context, slave string, syncedUntil time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	checkpoints, err := s.read()
+	if err != nil {
+		return err
+	}
+	checkpoints[slave] = syncedUntil.Unix()
+
+	jsonData, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first, so we never end up with a partially written file
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(jsonData); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileCheckpointStore) read() (map[string]int64, error) {
+	checkpoints := make(map[string]int64)
+
+	jsonData, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(jsonData, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// implements CheckpointStore using the dynamodb table the master saves its data in
+func NewDynamoDbCheckpointStore(awsSession *session.Session, tableName string) CheckpointStore {
+	return dbCheckpointStore{
+		db:        dynamodb.New(awsSession),
+		tableName: tableName,
+	}
+}
+
+type dbCheckpointStore struct {
+	db        *dynamodb.DynamoDB
+	tableName string
+}
+
+func (s dbCheckpointStore) Load(ctx context.Context, slave string) (time.Time, error) {
+	resp, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		ConsistentRead: aws.Bool(true),
+		Key:            s.key(slave),
+	})
+	if err != nil {
+		return zeroTime, err
+	}
+
+	attr, ok := resp.Item[dbColumnCheckpointValue]
+	if !ok || attr.N == nil {
+		return zeroTime, nil
+	}
+
+	ts, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return zeroTime, err
+	}
+	return time.Unix(ts, 0).UTC(), nil
+}
+
+func (s dbCheckpointStore) Save(ctx context.Context, slave string, syncedUntil time.Time) error {
+	item := s.key(slave)
+	item[dbColumnCheckpointValue] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(syncedUntil.Unix(), 10)),
+	}
+
+	_, err := s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (s dbCheckpointStore) key(slave string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dbColumnDate:     {S: aws.String(dbCheckpointPartition)},
+		dbColumnObjectId: {S: aws.String(slave)},
+	}
+}
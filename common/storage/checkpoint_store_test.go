@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+
+	ts, err := store.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.True(t, ts.IsZero())
+
+	now := time.Unix(time.Now().Unix(), 0).UTC()
+	assert.NoError(t, store.Save(ctx, "a", now))
+	assert.NoError(t, store.Save(ctx, "b", now.Add(-time.Hour)))
+
+	other := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	ts, err = other.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, now, ts)
+
+	ts, err = other.Load(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Hour), ts)
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"strings"
+	"webhooks/common/data"
+)
+
+type DynamoDbLayout int
+
+const (
+	// each top level key of the payload is saved in its own payload.<key> attribute
+	DynamoDbLayoutFlat DynamoDbLayout = iota
+	// the original json bytes are saved in a binary attribute, nothing gets lost
+	// objects converted from another format are saved together with their original payload
+	DynamoDbLayoutRaw
+)
+
+const (
+	dbColumnPayloadRaw      = "payload_raw"
+	dbColumnPayloadEncoding = "payload_encoding"
+	dbColumnPayloadS3Key    = "payload_s3_key"
+	// the flat layout keeps the payload of objects converted from another format in these
+	dbColumnOriginalPayload     = "original_payload"
+	dbColumnOriginalContentType = "original_content_type"
+	// the flat layout keeps the metadata of the request in a map attribute, the raw layout saves it with the payload
+	dbColumnMetadata = "metadata"
+	// the flat layout keeps the algorithm the id was hashed with in this, the raw layout saves it with the payload
+	dbColumnHashAlgorithm = "hash_algorithm"
+
+	dbPayloadEncodingGzip = "gzip"
+
+	// dynamodb items are limited to 400KB, leaving some room for the other attributes
+	dbMaxRawPayloadSize = 350 * 1024
+
+	dbOverflowKeyPrefix = "dynamodb-overflow/"
+)
+
+type DynamoDbStoreOptions struct {
+	Layout DynamoDbLayout
+	// the date partitions of sources other than DefaultSource are prefixed with <source>#
+	Source string
+
+	// the options below are used only by DynamoDbLayoutRaw
+
+	// gzip the raw payload
+	Compress bool
+	// top level payload keys which are also saved as payload.<key> attributes, so they can be queried
+	IndexedFields []string
+	// payloads too big for a dynamodb item are saved in this s3 bucket, the item keeps only a reference to them
+	OverflowBucket string
+}
+
+// builds the item attributes holding the payload
+// fails with a PermanentPutError if the payload can't be encoded, retrying it won't help
+func (s dbStorage) encodePayload(ctx context.Context, item *data.WebHookObject) (map[string]*dynamodb.AttributeValue, error) {
+	if s.options.Layout == DynamoDbLayoutRaw {
+		return s.encodeRawPayload(ctx, item)
+	}
+	attrs, err := encodeFlatPayload(item)
+	if err != nil {
+		return nil, &PermanentPutError{Err: err}
+	}
+	return attrs, nil
+}
+
+func encodeFlatPayload(item *data.WebHookObject) (map[string]*dynamodb.AttributeValue, error) {
+	encoder := dynamodbattribute.NewEncoder()
+
+	jsonData := make(map[string]interface{})
+	if err := item.DataTo(&jsonData); err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]*dynamodb.AttributeValue, len(jsonData))
+	for k, v := range jsonData {
+		attr, err := encoder.Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		attrs[fmt.Sprintf("%s.%s", dbColumnPayloadPrefix, k)] = attr
+	}
+	if len(item.RawData) > 0 {
+		attrs[dbColumnOriginalPayload] = &dynamodb.AttributeValue{B: item.RawData}
+		attrs[dbColumnOriginalContentType] = &dynamodb.AttributeValue{S: aws.String(item.ContentType)}
+	}
+	if item.Metadata != nil {
+		jsonData, err := json.Marshal(item.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		if attrs[dbColumnMetadata], err = jsonToDbAttribute(jsonData); err != nil {
+			return nil, err
+		}
+	}
+	if item.HashAlgorithm != "" {
+		attrs[dbColumnHashAlgorithm] = &dynamodb.AttributeValue{S: aws.String(item.HashAlgorithm)}
+	}
+	return attrs, nil
+}
+
+// only the overflow upload can fail temporarily, the other errors are PermanentPutErrors
+func (s dbStorage) encodeRawPayload(ctx context.Context, item *data.WebHookObject) (map[string]*dynamodb.AttributeValue, error) {
+	attrs, payload, err := s.encodeRawAttributes(item)
+	if err != nil {
+		return nil, &PermanentPutError{Err: err}
+	}
+	if len(payload) <= dbMaxRawPayloadSize {
+		attrs[dbColumnPayloadRaw] = &dynamodb.AttributeValue{B: payload}
+		return attrs, nil
+	}
+
+	if s.options.OverflowBucket == "" {
+		return nil, &PermanentPutError{Err: fmt.Errorf("payload of %s is too big (%d bytes) and no overflow bucket was configured", item.ID.Hex(), len(payload))}
+	}
+
+	key := dbOverflowKeyPrefix + sourcePrefix(s.options.Source, "/") + item.ID.Hex()
+	_, err = s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.options.OverflowBucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(payload),
+	})
+	if err != nil {
+		return nil, err
+	}
+	attrs[dbColumnPayloadS3Key] = &dynamodb.AttributeValue{S: aws.String(key)}
+
+	return attrs, nil
+}
+
+// the indexed fields of the raw layout, along with the encoded and maybe compressed payload
+func (s dbStorage) encodeRawAttributes(item *data.WebHookObject) (map[string]*dynamodb.AttributeValue, []byte, error) {
+	attrs := make(map[string]*dynamodb.AttributeValue)
+
+	if len(s.options.IndexedFields) > 0 {
+		fields := make(map[string]json.RawMessage)
+		if err := item.DataTo(&fields); err != nil {
+			return nil, nil, err
+		}
+		for _, k := range s.options.IndexedFields {
+			if v, ok := fields[k]; ok {
+				attr, err := jsonToDbAttribute(v)
+				if err != nil {
+					return nil, nil, err
+				}
+				attrs[fmt.Sprintf("%s.%s", dbColumnPayloadPrefix, k)] = attr
+			}
+		}
+	}
+
+	payload := item.EncodePayload()
+	if s.options.Compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, nil, err
+		}
+		payload = buf.Bytes()
+		attrs[dbColumnPayloadEncoding] = &dynamodb.AttributeValue{S: aws.String(dbPayloadEncodingGzip)}
+	}
+	return attrs, payload, nil
+}
+
+// reads the payload out of an item - items saved using any of the layouts can be read
+func (s dbStorage) decodePayload(ctx context.Context, item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	var payload []byte
+
+	if attr, ok := item[dbColumnPayloadRaw]; ok {
+		payload = attr.B
+	} else if attr, ok := item[dbColumnPayloadS3Key]; ok && attr.S != nil {
+		if s.s3 == nil {
+			return nil, fmt.Errorf("payload saved in s3 at %s, but no overflow bucket was configured", *attr.S)
+		}
+		resp, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.options.OverflowBucket),
+			Key:    attr.S,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if payload, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		return decodeFlatPayload(item)
+	}
+
+	if attr, ok := item[dbColumnPayloadEncoding]; ok && attr.S != nil {
+		switch *attr.S {
+		case dbPayloadEncodingGzip:
+			r, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		default:
+			return nil, fmt.Errorf("unknown payload encoding %s", *attr.S)
+		}
+	}
+
+	return payload, nil
+}
+
+// rebuilds the original json object out of the payload.<key> attributes
+// the original payload of converted objects is set by decodeOriginalPayload
+func decodeFlatPayload(item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	payload := make(map[string]interface{})
+	prefix := dbColumnPayloadPrefix + "."
+	for k, v := range item {
+		if strings.HasPrefix(k, prefix) {
+			payload[strings.TrimPrefix(k, prefix)] = dbAttributeToJson(v)
+		}
+	}
+
+	return json.Marshal(payload)
+}
+
+// converts a json value to an attribute, numbers are saved exactly as they were sent
+func jsonToDbAttribute(raw json.RawMessage) (*dynamodb.AttributeValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return jsonValueToDbAttribute(v), nil
+}
+
+func jsonValueToDbAttribute(v interface{}) *dynamodb.AttributeValue {
+	switch value := v.(type) {
+	case string:
+		return &dynamodb.AttributeValue{S: aws.String(value)}
+	case json.Number:
+		return &dynamodb.AttributeValue{N: aws.String(value.String())}
+	case bool:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(value)}
+	case map[string]interface{}:
+		m := make(map[string]*dynamodb.AttributeValue, len(value))
+		for k, item := range value {
+			m[k] = jsonValueToDbAttribute(item)
+		}
+		return &dynamodb.AttributeValue{M: m}
+	case []interface{}:
+		l := make([]*dynamodb.AttributeValue, len(value))
+		for i, item := range value {
+			l[i] = jsonValueToDbAttribute(item)
+		}
+		return &dynamodb.AttributeValue{L: l}
+	default:
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+	}
+}
+
+// converts an attribute to a value that marshals to the json it was created from
+// numbers are kept as they were saved instead of being converted to float64
+func dbAttributeToJson(av *dynamodb.AttributeValue) interface{} {
+	switch {
+	case av.S != nil:
+		return *av.S
+	case av.N != nil:
+		return json.Number(*av.N)
+	case av.BOOL != nil:
+		return *av.BOOL
+	case av.M != nil:
+		m := make(map[string]interface{}, len(av.M))
+		for k, v := range av.M {
+			m[k] = dbAttributeToJson(v)
+		}
+		return m
+	case av.L != nil:
+		l := make([]interface{}, len(av.L))
+		for i, v := range av.L {
+			l[i] = dbAttributeToJson(v)
+		}
+		return l
+	case av.B != nil:
+		return av.B
+	case av.SS != nil:
+		return aws.StringValueSlice(av.SS)
+	case av.NS != nil:
+		l := make([]interface{}, len(av.NS))
+		for i, v := range av.NS {
+			l[i] = json.Number(*v)
+		}
+		return l
+	default:
+		// NULL
+		return nil
+	}
+}
+
+// sets the original payload of an object saved with the flat layout, if it was converted from another format
+func decodeOriginalPayload(item map[string]*dynamodb.AttributeValue, obj *data.WebHookObject) {
+	if attr, ok := item[dbColumnOriginalPayload]; ok && len(attr.B) > 0 {
+		obj.RawData = attr.B
+		if attr, ok := item[dbColumnOriginalContentType]; ok && attr.S != nil {
+			obj.ContentType = *attr.S
+		}
+	}
+}
+
+// sets the hash algorithm of an object saved with the flat layout, if it was recorded
+// the json rebuilt out of the attributes isn't the one that was hashed, so it can't be found by hashing it again
+func decodeFlatHashAlgorithm(item map[string]*dynamodb.AttributeValue, obj *data.WebHookObject) {
+	if attr, ok := item[dbColumnHashAlgorithm]; ok && attr.S != nil {
+		obj.HashAlgorithm = *attr.S
+	}
+}
+
+// sets the metadata of an object saved with the flat layout, if it has any
+func decodeFlatMetadata(item map[string]*dynamodb.AttributeValue, obj *data.WebHookObject) error {
+	attr, ok := item[dbColumnMetadata]
+	if !ok || attr.M == nil {
+		return nil
+	}
+	jsonData, err := json.Marshal(dbAttributeToJson(attr))
+	if err != nil {
+		return err
+	}
+	obj.Metadata = &data.WebHookMetadata{}
+	return json.Unmarshal(jsonData, obj.Metadata)
+}
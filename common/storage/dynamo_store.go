@@ -2,12 +2,15 @@ package storage
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"math"
+	"math/rand"
 	"time"
 	"webhooks/common/data"
 )
@@ -17,73 +20,185 @@ const (
 	dbColumnDate          = "date"
 	dbColumnPayloadPrefix = "payload"
 	dbDateFormat          = "2006-01-02"
+
+	// max number of keys dynamodb accepts in a BatchGetItem request
+	dbBatchGetSize = 100
+	// max number of items dynamodb accepts in a BatchWriteItem request
+	dbBatchWriteSize = 25
+	// max number of attempts for items dynamodb didn't process because of throttling
+	dbMaxAttempts = 8
+	// dynamodb rejects bigger items, failing the whole batch write request holding them
+	dbMaxItemSize = 400 * 1024
+)
+
+var (
+	dbRetryBaseWait = time.Millisecond * 50
+	dbRetryMaxWait  = time.Second * 5
 )
 
 var zeroTime time.Time
 
-// implements Store for dynamodb
+// implements Store for dynamodb, using the flat payload layout
 func NewDynamoDbStore(awsSession *session.Session, tableName string) Store {
-	return dbStorage{
+	return NewDynamoDbStoreWithOptions(awsSession, tableName, DynamoDbStoreOptions{})
+}
+
+func NewDynamoDbStoreWithOptions(awsSession *session.Session, tableName string, options DynamoDbStoreOptions) Store {
+	s := dbStorage{
 		db:        dynamodb.New(awsSession),
 		tableName: tableName,
+		options:   options,
+	}
+	if options.OverflowBucket != "" {
+		s.s3 = s3.New(awsSession)
 	}
+	return s
 }
 
 type dbStorage struct {
-	db        *dynamodb.DynamoDB
+	db        dynamodbiface.DynamoDBAPI
+	s3        s3iface.S3API // used only for payloads saved in the overflow bucket
 	tableName string
+	options   DynamoDbStoreOptions
 }
 
-func (s dbStorage) Put(ctx context.Context, data []*data.WebHookObject) error {
+// writes the objects in batches of dbBatchWriteSize, retrying the items dynamodb didn't process
+// the batches that can't be written don't stop the others, a PartialPutError lists the objects that weren't saved
+// objects which can't be encoded or are too big for an item are never sent, they're listed as permanent failures
+func (s dbStorage) Put(ctx context.Context, objects []*data.WebHookObject) error {
 
-	encoder := dynamodbattribute.NewEncoder()
+	objects = dedupeObjects(objects)
+	failed := make([]data.ObjectID, 0)
+	permanent := make([]data.ObjectID, 0)
+	var lastErr error
 
-	toWrite := make([]*dynamodb.WriteRequest, len(data))
+	toWrite := make([]*dynamodb.WriteRequest, 0, len(objects))
 
-	for idx, item := range data {
-		jsonData := make(map[string]interface{})
-		if err := item.DataTo(&jsonData); err != nil {
-			return err
+	for _, item := range objects {
+		dbData, err := s.encodePayload(ctx, item)
+		if err != nil {
+			failed = append(failed, item.ID)
+			if IsPermanentPutError(err) {
+				permanent = append(permanent, item.ID)
+			}
+			lastErr = err
+			continue
 		}
 
-		rawData := map[string]interface{}{
-			dbColumnObjectId: item.ID.Hex(),
-			dbColumnDate:     item.ID.Timestamp().UTC().Format(dbDateFormat),
+		for k, v := range s.itemKey(item.ID) {
+			dbData[k] = v
+		}
+		if size := dbItemSize(dbData); size > dbMaxItemSize {
+			failed = append(failed, item.ID)
+			permanent = append(permanent, item.ID)
+			lastErr = &PermanentPutError{Err: fmt.Errorf("item of %s is too big (%d bytes)", item.ID.Hex(), size)}
+			continue
 		}
 
-		for k, v := range jsonData {
-			rawData[fmt.Sprintf("%s.%s", dbColumnPayloadPrefix, k)] = v
+		toWrite = append(toWrite, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: dbData,
+			},
+		})
+	}
+
+	for start := 0; start < len(toWrite); start += dbBatchWriteSize {
+		end := start + dbBatchWriteSize
+		if end > len(toWrite) {
+			end = len(toWrite)
 		}
 
-		dbData := make(map[string]*dynamodb.AttributeValue, len(rawData))
+		notWritten, err := s.batchWrite(ctx, toWrite[start:end])
+		if err != nil {
+			lastErr = err
+			for _, req := range notWritten {
+				failed = append(failed, dbWriteRequestId(req))
+			}
+		}
+	}
 
-		for k, v := range rawData {
-			attrs, err := encoder.Encode(v)
-			if err != nil {
-				return err
+	if len(failed) > 0 {
+		return &PartialPutError{
+			FailedIds:    failed,
+			PermanentIds: permanent,
+			Err:          lastErr,
+		}
+	}
+	return nil
+}
+
+// writes a single batch, retrying with backoff the items dynamodb didn't process
+// returns the requests that weren't written in case of an error
+func (s dbStorage) batchWrite(ctx context.Context, requests []*dynamodb.WriteRequest) ([]*dynamodb.WriteRequest, error) {
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt >= dbMaxAttempts {
+				return requests, fmt.Errorf("couldn't write %d items after %d attempts", len(requests), attempt)
+			}
+			if err := dbRetryWait(ctx, attempt); err != nil {
+				return requests, err
 			}
-			dbData[k] = attrs
 		}
 
-		toWrite[idx] = &dynamodb.WriteRequest{
-			PutRequest: &dynamodb.PutRequest{
-				Item: dbData,
+		resp, err := s.db.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				s.tableName: requests,
 			},
+		})
+		if err != nil {
+			return requests, err
 		}
 
+		requests = resp.UnprocessedItems[s.tableName]
 	}
+	return nil, nil
+}
 
-	params := &dynamodb.BatchWriteItemInput{
-		RequestItems: map[string][]*dynamodb.WriteRequest{
-			s.tableName: toWrite,
-		},
+// the size dynamodb accounts for an item - the attribute names and values, plus a few bytes for each nested value
+func dbItemSize(item map[string]*dynamodb.AttributeValue) int {
+	size := 0
+	for k, v := range item {
+		size += len(k) + dbAttributeSize(v)
 	}
+	return size
+}
 
-	_, err := s.db.BatchWriteItemWithContext(ctx, params)
-	return err
+func dbAttributeSize(attr *dynamodb.AttributeValue) int {
+	if attr == nil {
+		return 0
+	}
+	size := len(aws.StringValue(attr.S)) + len(aws.StringValue(attr.N)) + len(attr.B)
+	if attr.BOOL != nil || attr.NULL != nil {
+		size += 1
+	}
+	for _, v := range attr.SS {
+		size += len(aws.StringValue(v))
+	}
+	for _, v := range attr.NS {
+		size += len(aws.StringValue(v))
+	}
+	for _, v := range attr.BS {
+		size += len(v)
+	}
+	if attr.L != nil {
+		size += 3
+		for _, v := range attr.L {
+			size += 1 + dbAttributeSize(v)
+		}
+	}
+	if attr.M != nil {
+		size += 3 + dbItemSize(attr.M) + len(attr.M)
+	}
+	return size
+}
 
+func dbWriteRequestId(req *dynamodb.WriteRequest) data.ObjectID {
+	id, _ := data.NewObjectIdFromHex(aws.StringValue(req.PutRequest.Item[dbColumnObjectId].S))
+	return id
 }
 
+// walks over each utc day partition in the given range, following the query pagination
+// the ids are sent in timestamp order - days are queried in order and the object ids are sorted within a day
 func (s dbStorage) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan data.ObjectID, <-chan error) {
 
 	resChan := make(chan data.ObjectID)
@@ -94,8 +209,6 @@ func (s dbStorage) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan
 		defer close(resChan)
 		defer close(errChan)
 
-		decoder := dynamodbattribute.NewDecoder()
-
 		dateIt := newDayIterator(fromTime, toTime)
 		for {
 			rangeStart, rangeEnd, ok := dateIt.Next()
@@ -103,76 +216,210 @@ func (s dbStorage) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan
 				return
 			}
 
-			objIdAttr := dbColumnObjectId
-			//XXX is this the best api amazon can write?
-			var queryInput = &dynamodb.QueryInput{
-				TableName:       aws.String(s.tableName),
-				AttributesToGet: []*string{&objIdAttr},
-				KeyConditions: map[string]*dynamodb.Condition{
-					dbColumnDate: {
-						ComparisonOperator: aws.String("EQ"),
-						AttributeValueList: []*dynamodb.AttributeValue{
-							{
-								S: aws.String(fromTime.Format(dbDateFormat)),
-							},
-						},
-					},
-					dbColumnObjectId: {
-						ComparisonOperator: aws.String("BETWEEN"),
-						AttributeValueList: []*dynamodb.AttributeValue{
-							{
-								S: aws.String(data.NewObjectIdFromTimestamp(rangeStart, 0).Hex()),
-							},
-							{
-								S: aws.String(data.NewObjectIdFromTimestamp(rangeEnd, 0).Hex()),
-							},
-						},
-					},
-				},
+			if err := s.dayKeys(ctx, rangeStart, rangeEnd, resChan); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+// sends the ids between rangeStart and rangeEnd(both inclusive) - both need to be in the same day
+func (s dbStorage) dayKeys(ctx context.Context, rangeStart, rangeEnd time.Time, resChan chan<- data.ObjectID) error {
+	queryInput := &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		KeyConditionExpression: aws.String("#date = :date AND #id BETWEEN :from AND :to"),
+		ProjectionExpression:   aws.String("#id"),
+		// date is a reserved word
+		ExpressionAttributeNames: map[string]*string{
+			"#date": aws.String(dbColumnDate),
+			"#id":   aws.String(dbColumnObjectId),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":date": {S: aws.String(s.datePartition(rangeStart))},
+			":from": {S: aws.String(data.NewObjectIdFromTimestamp(rangeStart, 0).Hex())},
+			":to":   {S: aws.String(data.NewObjectIdFromTimestamp(rangeEnd, math.MaxUint32).Hex())},
+		},
+	}
+
+	for {
+		resp, err := s.db.QueryWithContext(ctx, queryInput)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range resp.Items {
+			objId, err := data.NewObjectIdFromHex(aws.StringValue(item[dbColumnObjectId].S))
+			if err != nil {
+				return err
+			}
+			select {
+			case resChan <- objId:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		queryInput.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// loads the objects in batches, emits them in the same order they were requested
+func (s dbStorage) Objects(ctx context.Context, objectIds []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
+	resChan := make(chan *data.WebHookObject)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		for start := 0; start < len(objectIds); start += dbBatchGetSize {
+			end := start + dbBatchGetSize
+			if end > len(objectIds) {
+				end = len(objectIds)
 			}
+			batch := objectIds[start:end]
 
-			var resp, err = s.db.QueryWithContext(ctx, queryInput)
+			objects, err := s.batchGet(ctx, batch)
 			if err != nil {
 				errChan <- err
 				return
 			}
 
-			for _, item := range resp.Items {
-				idHex := ""
-				if err = decoder.Decode(item[dbColumnObjectId], &idHex); err != nil {
-					errChan <- err
+			// dynamodb doesn't keep the order of the requested keys
+			for _, id := range batch {
+				obj, ok := objects[id]
+				if !ok {
+					errChan <- fmt.Errorf("object %s not found", id.Hex())
 					return
 				}
-				if objId, err := data.NewObjectIdFromHex(idHex); err != nil {
-					errChan <- err
+				select {
+				case resChan <- obj:
+				case <-ctx.Done():
+					errChan <- ctx.Err()
 					return
-				} else {
-					select {
-					case resChan <- objId:
-					case <-ctx.Done():
-						errChan <- ctx.Err()
-						return
-					}
 				}
-
 			}
-
 		}
 	}()
 
 	return resChan, errChan
 }
 
-func (s dbStorage) Objects(ctx context.Context, objectIds []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
-	// not needed
-	errChan := make(chan error, 1)
+// fetches the objects having the given ids, retrying the keys dynamodb didn't process
+func (s dbStorage) batchGet(ctx context.Context, objectIds []data.ObjectID) (map[data.ObjectID]*data.WebHookObject, error) {
+	res := make(map[data.ObjectID]*data.WebHookObject, len(objectIds))
+
+	// dynamodb rejects requests having duplicate keys
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(objectIds))
+	seen := make(map[data.ObjectID]bool, len(objectIds))
+	for _, id := range objectIds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		keys = append(keys, s.itemKey(id))
+	}
+
+	requestItems := map[string]*dynamodb.KeysAndAttributes{
+		s.tableName: {
+			Keys: keys,
+		},
+	}
+
+	for attempt := 0; len(requestItems) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt >= dbMaxAttempts {
+				return nil, fmt.Errorf("couldn't load %d objects after %d attempts", len(requestItems[s.tableName].Keys), attempt)
+			}
+			if err := dbRetryWait(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
 
-	errChan <- errors.New("not implemented")
-	close(errChan)
-	return make(chan *data.WebHookObject, 0), errChan
+		resp, err := s.db.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: requestItems,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range resp.Responses[s.tableName] {
+			obj, err := s.itemToObject(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			res[obj.ID] = obj
+		}
+
+		requestItems = resp.UnprocessedKeys
+	}
+
+	return res, nil
+}
+
+// the date partition of the given time, prefixed by the source
+func (s dbStorage) datePartition(t time.Time) string {
+	return sourcePrefix(s.options.Source, "#") + t.UTC().Format(dbDateFormat)
+}
+
+func (s dbStorage) itemKey(id data.ObjectID) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dbColumnDate:     {S: aws.String(s.datePartition(id.Timestamp()))},
+		dbColumnObjectId: {S: aws.String(id.Hex())},
+	}
+}
+
+// builds an object out of a dynamodb item
+func (s dbStorage) itemToObject(ctx context.Context, item map[string]*dynamodb.AttributeValue) (*data.WebHookObject, error) {
+	idAttr, ok := item[dbColumnObjectId]
+	if !ok || idAttr.S == nil {
+		return nil, fmt.Errorf("item without %s", dbColumnObjectId)
+	}
+	id, err := data.NewObjectIdFromHex(*idAttr.S)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := s.decodePayload(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &data.WebHookObject{ID: id}
+	if err = obj.DecodePayload(payload); err != nil {
+		return nil, fmt.Errorf("object %s: %v", id.Hex(), err)
+	}
+	decodeOriginalPayload(item, obj)
+	decodeFlatHashAlgorithm(item, obj)
+	if err = decodeFlatMetadata(item, obj); err != nil {
+		return nil, fmt.Errorf("object %s: invalid metadata: %v", id.Hex(), err)
+	}
+	return obj, nil
 }
 
-// iterates over all day ranges between start and end time
+// waits before retrying a request - exponential backoff with full jitter
+func dbRetryWait(ctx context.Context, attempt int) error {
+	wait := dbRetryBaseWait << uint(attempt)
+	if wait > dbRetryMaxWait || wait <= 0 {
+		wait = dbRetryMaxWait
+	}
+	wait = time.Duration(rand.Int63n(int64(wait)))
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// iterates over all day ranges between start and end time (both inclusive)
 func newDayIterator(start, end time.Time) *dayIterator {
 	return &dayIterator{
 		start: start.UTC(),
@@ -186,18 +433,19 @@ type dayIterator struct {
 }
 
 // returns the start, end times for the current day interval
+// end is the last second of the day, or the overall end for the last day
 func (it *dayIterator) Next() (time.Time, time.Time, bool) {
 
 	start := it.start
-	end := it.end
 
-	if !start.Before(end) {
+	if start.After(it.end) {
 		return zeroTime, zeroTime, false
 	}
-	t := it.start
-	nextStart := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, t.Location())
-	if nextStart.Before(end) {
-		nextStart = end
+
+	nextStart := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, time.UTC)
+	end := nextStart.Add(-time.Second)
+	if end.After(it.end) {
+		end = it.end
 	}
 
 	it.start = nextStart
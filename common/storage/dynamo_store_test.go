@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+// serves batch requests out of a map, processing at most maxKeys keys per request
+type fakeDynamoDb struct {
+	dynamodbiface.DynamoDBAPI
+	items     map[string]map[string]*dynamodb.AttributeValue // object_id -> item
+	maxKeys   int
+	throttled map[string]bool // object ids that are never processed
+	requests  int
+}
+
+func newFakeDynamoDb(maxKeys int) *fakeDynamoDb {
+	return &fakeDynamoDb{
+		items:     make(map[string]map[string]*dynamodb.AttributeValue),
+		maxKeys:   maxKeys,
+		throttled: make(map[string]bool),
+	}
+}
+
+func (db *fakeDynamoDb) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	db.requests += 1
+	out := &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: make(map[string][]*dynamodb.WriteRequest),
+	}
+	for table, requests := range input.RequestItems {
+		if len(requests) > dbBatchWriteSize {
+			return nil, fmt.Errorf("too many items %d", len(requests))
+		}
+		seen := make(map[string]bool)
+		for i, req := range requests {
+			id := *req.PutRequest.Item[dbColumnObjectId].S
+			if seen[id] {
+				return nil, fmt.Errorf("duplicate key %s", id)
+			}
+			seen[id] = true
+			if dbItemSize(req.PutRequest.Item) > dbMaxItemSize {
+				// like dynamodb, a single item too big fails the whole request
+				return nil, fmt.Errorf("ValidationException: item size has exceeded the maximum allowed size")
+			}
+
+			if i >= db.maxKeys || db.throttled[id] {
+				out.UnprocessedItems[table] = append(out.UnprocessedItems[table], req)
+				continue
+			}
+			db.items[id] = req.PutRequest.Item
+		}
+	}
+	return out, nil
+}
+
+func (db *fakeDynamoDb) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	out := &dynamodb.BatchGetItemOutput{
+		Responses: make(map[string][]map[string]*dynamodb.AttributeValue),
+	}
+	for table, keysAndAttrs := range input.RequestItems {
+		keys := keysAndAttrs.Keys
+		if len(keys) > db.maxKeys {
+			out.UnprocessedKeys = map[string]*dynamodb.KeysAndAttributes{
+				table: {Keys: keys[db.maxKeys:]},
+			}
+			keys = keys[:db.maxKeys]
+		}
+		// reversed, dynamodb doesn't guarantee any order
+		for i := len(keys) - 1; i >= 0; i-- {
+			if item, ok := db.items[*keys[i][dbColumnObjectId].S]; ok {
+				out.Responses[table] = append(out.Responses[table], item)
+			}
+		}
+	}
+	return out, nil
+}
+
+// returns pages of at most maxKeys items
+func (db *fakeDynamoDb) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	date := *input.ExpressionAttributeValues[":date"].S
+	from := *input.ExpressionAttributeValues[":from"].S
+	to := *input.ExpressionAttributeValues[":to"].S
+
+	ids := make([]string, 0)
+	for id, item := range db.items {
+		if *item[dbColumnDate].S == date && id >= from && id <= to {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	if input.ExclusiveStartKey != nil {
+		start := *input.ExclusiveStartKey[dbColumnObjectId].S
+		ids = ids[sort.SearchStrings(ids, start)+1:]
+	}
+
+	out := &dynamodb.QueryOutput{}
+	for _, id := range ids {
+		if len(out.Items) == db.maxKeys {
+			out.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+				dbColumnDate:     {S: aws.String(date)},
+				dbColumnObjectId: out.Items[len(out.Items)-1][dbColumnObjectId],
+			}
+			break
+		}
+		out.Items = append(out.Items, map[string]*dynamodb.AttributeValue{
+			dbColumnObjectId: {S: aws.String(id)},
+		})
+	}
+	return out, nil
+}
+
+func TestDayIterator(t *testing.T) {
+	start := time.Date(2020, 1, 30, 22, 10, 0, 0, time.UTC)
+	end := time.Date(2020, 2, 1, 3, 0, 0, 0, time.UTC)
+
+	it := newDayIterator(start, end)
+	expected := [][2]time.Time{
+		{start, time.Date(2020, 1, 30, 23, 59, 59, 0, time.UTC)},
+		{time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 31, 23, 59, 59, 0, time.UTC)},
+		{time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), end},
+	}
+	for _, e := range expected {
+		rangeStart, rangeEnd, ok := it.Next()
+		assert.True(t, ok)
+		assert.Equal(t, e[0], rangeStart)
+		assert.Equal(t, e[1], rangeEnd)
+	}
+	_, _, ok := it.Next()
+	assert.False(t, ok)
+
+	it = newDayIterator(start, start)
+	rangeStart, rangeEnd, ok := it.Next()
+	assert.True(t, ok, "a single second is a valid range")
+	assert.Equal(t, start, rangeStart)
+	assert.Equal(t, start, rangeEnd)
+}
+
+func TestDynamoDbKeys(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDynamoDb(2)
+	store := dbStorage{db: db, tableName: "webhooks"}
+
+	start := time.Date(2020, 1, 30, 23, 59, 0, 0, time.UTC)
+	ids := make([]data.ObjectID, 0)
+	objects := make([]*data.WebHookObject, 0)
+	for i := 0; i < 15; i++ {
+		// a few objects per second, over 3 days
+		id := data.NewObjectIdFromTimestamp(start.Add(time.Hour*time.Duration(i/3)*12), uint32(100-i))
+		ids = append(ids, id)
+		objects = append(objects, &data.WebHookObject{ID: id, JsonData: []byte(`{}`)})
+	}
+	db.maxKeys = 100
+	assert.NoError(t, store.Put(ctx, objects))
+	db.maxKeys = 2
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Hex() < ids[j].Hex()
+	})
+
+	keys, err := LoadStorageKeysSync(ctx, store, start, start.Add(time.Hour*48))
+	assert.NoError(t, err)
+	assert.Equal(t, ids, keys, "all pages of all days should be read in order")
+
+	keys, err = LoadStorageKeysSync(ctx, store, start.Add(time.Hour*12), start.Add(time.Hour*24))
+	assert.NoError(t, err)
+	assert.Equal(t, ids[3:9], keys)
+}
+
+func TestDynamoDbPut(t *testing.T) {
+	defer func(base, max time.Duration) {
+		dbRetryBaseWait, dbRetryMaxWait = base, max
+	}(dbRetryBaseWait, dbRetryMaxWait)
+	dbRetryBaseWait, dbRetryMaxWait = time.Microsecond, time.Millisecond
+
+	now := time.Now()
+	db := newFakeDynamoDb(10)
+	store := dbStorage{db: db, tableName: "webhooks"}
+
+	objects := make([]*data.WebHookObject, 0)
+	for i := 0; i < 60; i++ {
+		objects = append(objects, &data.WebHookObject{
+			ID:       data.NewObjectIdFromTimestamp(now, uint32(i)),
+			JsonData: []byte(fmt.Sprintf(`{"i":%d}`, i)),
+		})
+	}
+	// same id twice, the last one should be saved
+	objects = append(objects, &data.WebHookObject{ID: objects[0].ID, JsonData: []byte(`{"i":"last"}`)})
+
+	assert.NoError(t, store.Put(context.Background(), objects))
+	assert.Len(t, db.items, 60)
+	assert.Equal(t, "last", *db.items[objects[0].ID.Hex()][dbColumnPayloadPrefix+".i"].S)
+
+	throttled := data.NewObjectIdFromTimestamp(now, 1000)
+	db.throttled[throttled.Hex()] = true
+	invalid := data.NewObjectIdFromTimestamp(now, 1001)
+	db.requests = 0
+
+	err := store.Put(context.Background(), []*data.WebHookObject{
+		{ID: throttled, JsonData: []byte(`{}`)},
+		{ID: invalid, JsonData: []byte(`not json`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 1002), JsonData: []byte(`{}`)},
+	})
+	assert.IsType(t, &PartialPutError{}, err)
+	assert.ElementsMatch(t, []data.ObjectID{throttled, invalid}, err.(*PartialPutError).FailedIds)
+	assert.Equal(t, []data.ObjectID{invalid}, err.(*PartialPutError).PermanentIds, "only the invalid json can't ever be saved")
+	assert.Equal(t, dbMaxAttempts, db.requests, "throttled items should be retried")
+	assert.Contains(t, db.items, data.NewObjectIdFromTimestamp(now, 1002).Hex())
+
+	// an item over the dynamodb limit isn't sent, so it doesn't fail the other items of its batch
+	tooBig := data.NewObjectIdFromTimestamp(now, 2000)
+	err = store.Put(context.Background(), []*data.WebHookObject{
+		{ID: tooBig, JsonData: []byte(`{"a":"` + strings.Repeat("x", dbMaxItemSize) + `"}`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 2001), JsonData: []byte(`{}`)},
+	})
+	assert.IsType(t, &PartialPutError{}, err)
+	assert.Equal(t, []data.ObjectID{tooBig}, err.(*PartialPutError).FailedIds)
+	assert.Equal(t, []data.ObjectID{tooBig}, err.(*PartialPutError).PermanentIds)
+	assert.Contains(t, db.items, data.NewObjectIdFromTimestamp(now, 2001).Hex())
+
+	// the raw layout can't save big payloads without an overflow bucket
+	rawStore := dbStorage{db: db, tableName: "webhooks", options: DynamoDbStoreOptions{Layout: DynamoDbLayoutRaw}}
+	err = rawStore.Put(context.Background(), []*data.WebHookObject{
+		{ID: tooBig, JsonData: []byte(`{"a":"` + strings.Repeat("x", dbMaxRawPayloadSize) + `"}`)},
+	})
+	assert.IsType(t, &PartialPutError{}, err)
+	assert.Equal(t, []data.ObjectID{tooBig}, err.(*PartialPutError).PermanentIds)
+}
+
+func TestDynamoDbSources(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDynamoDb(100)
+	now := time.Now()
+
+	defaultStore := dbStorage{db: db, tableName: "webhooks"}
+	githubStore := dbStorage{db: db, tableName: "webhooks", options: DynamoDbStoreOptions{Source: "github"}}
+
+	// the fake keeps the items by id only, the ids differ only because of that
+	defaultId := data.NewObjectIdFromTimestamp(now, 1)
+	githubId := data.NewObjectIdFromTimestamp(now, 2)
+	assert.NoError(t, defaultStore.Put(ctx, []*data.WebHookObject{{ID: defaultId, JsonData: []byte(`{"a":1}`)}}))
+	assert.NoError(t, githubStore.Put(ctx, []*data.WebHookObject{{ID: githubId, JsonData: []byte(`{"a":2}`)}}))
+
+	assert.Equal(t, now.UTC().Format(dbDateFormat), *defaultStore.itemKey(defaultId)[dbColumnDate].S)
+	assert.Equal(t, "github#"+now.UTC().Format(dbDateFormat), *githubStore.itemKey(githubId)[dbColumnDate].S)
+
+	keys, err := LoadStorageKeysSync(ctx, defaultStore, now.Add(-time.Minute), now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{defaultId}, keys)
+	keys, err = LoadStorageKeysSync(ctx, githubStore, now.Add(-time.Minute), now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{githubId}, keys)
+
+	objects, err := LoadStorageObjectsSync(ctx, WithSource("github", githubStore), []data.ObjectID{githubId})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":2}`, string(objects[0].JsonData))
+	assert.Equal(t, "github", objects[0].Source)
+}
+
+func TestDynamoDbObjects(t *testing.T) {
+	now := time.Now()
+	db := newFakeDynamoDb(2)
+
+	ids := make([]data.ObjectID, 5)
+	for i := range ids {
+		ids[i] = data.NewObjectIdFromTimestamp(now.Add(time.Second*time.Duration(i)), uint32(i))
+		item := dbStorage{}.itemKey(ids[i])
+		item[dbColumnPayloadPrefix+".n"] = &dynamodb.AttributeValue{N: aws.String("12345678901234567890")}
+		item[dbColumnPayloadPrefix+".l"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{
+			{S: aws.String("a")},
+			{NULL: aws.Bool(true)},
+			{M: map[string]*dynamodb.AttributeValue{"b": {BOOL: aws.Bool(true)}}},
+		}}
+		db.items[ids[i].Hex()] = item
+	}
+
+	store := dbStorage{db: db, tableName: "webhooks"}
+
+	requested := []data.ObjectID{ids[3], ids[0], ids[4], ids[1], ids[2], ids[0]}
+	objects, err := LoadStorageObjectsSync(context.Background(), store, requested)
+	assert.NoError(t, err)
+	assert.Len(t, objects, len(requested))
+	for i, obj := range objects {
+		assert.Equal(t, requested[i], obj.ID, "objects should be sent in the requested order")
+		assert.JSONEq(t, `{"n":12345678901234567890,"l":["a",null,{"b":true}]}`, string(obj.JsonData))
+	}
+
+	_, err = LoadStorageObjectsSync(context.Background(), store, []data.ObjectID{data.NewObjectIdFromTimestamp(now, 100)})
+	assert.Error(t, err)
+}
+
+func TestDynamoDbRawLayout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	db := newFakeDynamoDb(100)
+	bucket := newFakeS3(1000)
+
+	store := dbStorage{
+		db:        db,
+		s3:        bucket,
+		tableName: "webhooks",
+		options: DynamoDbStoreOptions{
+			Layout:         DynamoDbLayoutRaw,
+			Compress:       true,
+			IndexedFields:  []string{"type", "missing"},
+			OverflowBucket: "overflow",
+		},
+	}
+
+	// random data doesn't compress, so it won't fit in an item
+	big := make([]byte, dbMaxRawPayloadSize)
+	rand.Read(big)
+	bigJson, err := json.Marshal(map[string]interface{}{"type": "big", "data": big})
+	assert.NoError(t, err)
+
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"type":"a", "n":1.10, "":""}`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: bigJson},
+	}
+	assert.NoError(t, store.Put(ctx, objects))
+
+	item := db.items[objects[0].ID.Hex()]
+	assert.Equal(t, "a", *item[dbColumnPayloadPrefix+".type"].S, "indexed fields should be saved too")
+	assert.NotContains(t, item, dbColumnPayloadPrefix+".missing")
+	assert.Equal(t, dbPayloadEncodingGzip, *item[dbColumnPayloadEncoding].S)
+	assert.Contains(t, db.items[objects[1].ID.Hex()], dbColumnPayloadS3Key)
+	assert.Len(t, bucket.objects, 1)
+
+	loaded, err := LoadStorageObjectsSync(ctx, store, []data.ObjectID{objects[0].ID, objects[1].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, objects, loaded, "payloads should be returned exactly as they were saved")
+
+	store.options.OverflowBucket = ""
+	assert.Error(t, store.Put(ctx, objects[1:]), "big payloads need an overflow bucket")
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"webhooks/common/data"
+)
+
+const (
+	// id + payload length
+	fileRecordHeaderSize = 8 + 4
+	// crc32c of the header and payload
+	fileRecordTrailerSize = 4
+)
+
+var (
+	fileRecordTable = crc32.MakeTable(crc32.Castagnoli)
+
+	corruptFileRecordError = errors.New("corrupt record")
+)
+
+// implements Store using a single append only file - meant to be used by slaves, so they don't need any cloud storage
+// each record is written as [id 8 bytes][payload length 4 bytes][payload][crc32c 4 bytes]
+// an index of all ids is kept in memory and rebuilt when the file is opened
+// saving an id that already exists replaces it
+func NewFileStore(path string) (Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{
+		file:  f,
+		index: newObjectIndex(),
+	}
+
+	if err = s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type fileStore struct {
+	file  *os.File
+	mux   sync.RWMutex
+	index *objectIndex // ObjectID -> fileRecordPos
+	size  int64        // offset where the next record is written
+}
+
+// position of a record's payload in the file
+type fileRecordPos struct {
+	offset int64
+	length uint32
+}
+
+// reads all records and builds the index
+// a partially written record at the end of the file (ex the process crashed while writing it) is discarded
+// a corrupt record followed by other records fails the load instead, truncating the file there would lose them
+func (s *fileStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.file)
+	var offset int64
+
+	for {
+		id, payload, err := readFileRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == corruptFileRecordError && offset+int64(fileRecordHeaderSize+len(payload)+fileRecordTrailerSize) < info.Size() {
+			return fmt.Errorf("%s: corrupt record at offset %d, followed by %d more bytes", s.file.Name(), offset, info.Size()-offset)
+		}
+		if err == io.ErrUnexpectedEOF || err == corruptFileRecordError {
+			// the last write didn't make it to disk entirely
+			if err = s.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		s.index.Set(id, fileRecordPos{
+			offset: offset + fileRecordHeaderSize,
+			length: uint32(len(payload)),
+		})
+		offset += int64(fileRecordHeaderSize + len(payload) + fileRecordTrailerSize)
+	}
+
+	s.size = offset
+	return nil
+}
+
+func readFileRecord(r io.Reader) (data.ObjectID, []byte, error) {
+	var header [fileRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return data.ZeroObjectID, nil, err
+	}
+
+	var id data.ObjectID
+	copy(id[:], header[:8])
+	length := binary.BigEndian.Uint32(header[8:])
+
+	body := make([]byte, int(length)+fileRecordTrailerSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return data.ZeroObjectID, nil, err
+	}
+
+	payload := body[:length]
+	checksum := crc32.Update(crc32.Checksum(header[:], fileRecordTable), fileRecordTable, payload)
+	if checksum != binary.BigEndian.Uint32(body[length:]) {
+		// the payload is returned anyway, so the caller knows where the next record starts
+		return data.ZeroObjectID, payload, corruptFileRecordError
+	}
+
+	return id, payload, nil
+}
+
+// the record payload is the object's EncodePayload, returns its length
+func writeFileRecord(dest *bytes.Buffer, item *data.WebHookObject) int {
+	payload := item.EncodePayload()
+
+	var header [fileRecordHeaderSize]byte
+	copy(header[:8], item.ID[:])
+	binary.BigEndian.PutUint32(header[8:], uint32(len(payload)))
+
+	checksum := crc32.Update(crc32.Checksum(header[:], fileRecordTable), fileRecordTable, payload)
+
+	var trailer [fileRecordTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[:], checksum)
+
+	dest.Write(header[:])
+	dest.Write(payload)
+	dest.Write(trailer[:])
+	return len(payload)
+}
+
+// builds an object out of a record read by readFileRecord
+func newFileRecordObject(id data.ObjectID, payload []byte) (*data.WebHookObject, error) {
+	obj := &data.WebHookObject{ID: id}
+	if err := obj.DecodePayload(payload); err != nil {
+		return nil, fmt.Errorf("object %s: %v", id.Hex(), err)
+	}
+	return obj, nil
+}
+
+// appends all objects with a single write, the index is updated only after the data was synced to disk
+func (s *fileStore) Put(ctx context.Context, data []*data.WebHookObject) error {
+	var buf bytes.Buffer
+	lengths := make([]int, len(data))
+	for i, item := range data {
+		lengths[i] = writeFileRecord(&buf, item)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, err := s.file.WriteAt(buf.Bytes(), s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	offset := s.size
+	for i, item := range data {
+		s.index.Set(item.ID, fileRecordPos{
+			offset: offset + fileRecordHeaderSize,
+			length: uint32(lengths[i]),
+		})
+		offset += int64(fileRecordHeaderSize + lengths[i] + fileRecordTrailerSize)
+	}
+	s.size = offset
+
+	return nil
+}
+
+func (s *fileStore) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan data.ObjectID, <-chan error) {
+	resChan := make(chan data.ObjectID)
+	errChan := make(chan error, 1)
+
+	s.mux.RLock()
+	ids := s.index.Keys(fromTime, toTime)
+	s.mux.RUnlock()
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		for _, id := range ids {
+			select {
+			case resChan <- id:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+// emits the objects in the same order they were requested
+func (s *fileStore) Objects(ctx context.Context, objectIds []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
+	resChan := make(chan *data.WebHookObject)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		for _, id := range objectIds {
+			obj, err := s.readObject(id)
+			if err != nil {
+				errChan <- err
+				return
+			}
+
+			select {
+			case resChan <- obj:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+func (s *fileStore) readObject(id data.ObjectID) (*data.WebHookObject, error) {
+	s.mux.RLock()
+	value, ok := s.index.Get(id)
+	s.mux.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", id.Hex())
+	}
+	pos := value.(fileRecordPos)
+
+	// records are never modified once written, so they can be read without holding the lock
+	payload := make([]byte, pos.length)
+	if _, err := s.file.ReadAt(payload, pos.offset); err != nil {
+		return nil, err
+	}
+
+	return newFileRecordObject(id, payload)
+}
+
+var _ Store = &fileStore{}
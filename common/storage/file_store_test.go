@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	path := filepath.Join(dir, "webhooks.data")
+	now := time.Unix(time.Now().Unix(), 0)
+
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second*2), 1), JsonData: []byte(`{"a":3}`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second), 3), JsonData: []byte(`{"a":2}`)},
+	}
+
+	store, err := NewFileStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put(ctx, objects[:2]))
+	assert.NoError(t, store.Put(ctx, objects[2:]))
+
+	// same id is saved again - it should be replaced
+	assert.NoError(t, store.Put(ctx, []*data.WebHookObject{
+		{ID: objects[0].ID, JsonData: []byte(`{"a":"replaced"}`)},
+	}))
+
+	// a partially written record at the end of the file should be dropped when reopening
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 10, '{'})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	store, err = NewFileStore(path)
+	assert.NoError(t, err)
+
+	ids, err := LoadStorageKeysSync(ctx, store, now, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{objects[1].ID, objects[2].ID}, ids)
+
+	ids, err = LoadStorageKeysSync(ctx, store, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, ids, 3)
+
+	loaded, err := LoadStorageObjectsSync(ctx, store, ids)
+	assert.NoError(t, err)
+	assert.Equal(t, []*data.WebHookObject{
+		objects[1],
+		objects[2],
+		{ID: objects[0].ID, JsonData: []byte(`{"a":"replaced"}`)},
+	}, loaded)
+
+	// the store should still be writable after the bad record was dropped
+	assert.NoError(t, store.Put(ctx, []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second*3), 4), JsonData: []byte(`{"a":4}`)},
+	}))
+	store, err = NewFileStore(path)
+	assert.NoError(t, err)
+	ids, err = LoadStorageKeysSync(ctx, store, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, ids, 4)
+
+	_, err = LoadStorageObjectsSync(ctx, store, []data.ObjectID{data.NewObjectIdFromTimestamp(now, 100)})
+	assert.Error(t, err)
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	path := filepath.Join(dir, "webhooks.data")
+	now := time.Unix(time.Now().Unix(), 0)
+
+	store, err := NewFileStore(path)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, store.Put(ctx, []*data.WebHookObject{
+			{ID: data.NewObjectIdFromTimestamp(now, uint32(i)), JsonData: []byte(`{"a":1}`)},
+		}))
+	}
+	recordSize := int64(fileRecordHeaderSize + len(`{"a":1}`) + fileRecordTrailerSize)
+	// overwrites the first byte of the json payload of a record
+	setPayloadByte := func(record int64, b byte) {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		_, err = f.WriteAt([]byte{b}, record*recordSize+fileRecordHeaderSize)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+
+	// a bad record in the middle of the file isn't a torn write - the records after it must not be dropped
+	setPayloadByte(1, 'x')
+	_, err = NewFileStore(path)
+	assert.Error(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*recordSize, info.Size(), "the file shouldn't be truncated")
+
+	// a bad last record is a write that didn't make it to disk entirely
+	setPayloadByte(1, '{')
+	setPayloadByte(2, 'x')
+	store, err = NewFileStore(path)
+	assert.NoError(t, err)
+	ids, err := LoadStorageKeysSync(ctx, store, now, now)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 2)
+	info, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*recordSize, info.Size(), "only the torn last record should be truncated")
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+const testHashAlgorithm = "crc32c-canonical-json-v2"
+
+func TestPayloadEnvelope(t *testing.T) {
+	for _, obj := range []*data.WebHookObject{
+		{JsonData: []byte(`{"a":1}`), HashAlgorithm: testHashAlgorithm},
+		{JsonData: []byte(`{"a":1}`), HashAlgorithm: testHashAlgorithm, Metadata: testWebHookMetadata()},
+		{JsonData: []byte(`{"a":"1"}`), HashAlgorithm: testHashAlgorithm, RawData: []byte("a=1"), ContentType: "application/x-www-form-urlencoded", Metadata: testWebHookMetadata()},
+	} {
+		decoded := &data.WebHookObject{}
+		assert.NoError(t, decoded.DecodePayload(obj.EncodePayload()))
+		assert.Equal(t, obj, decoded)
+	}
+
+	// objects saved before the algorithm was recorded
+	legacy := &data.WebHookObject{JsonData: []byte(`{"a":1}`)}
+	assert.Equal(t, legacy.JsonData, legacy.EncodePayload())
+
+	payload := (&data.WebHookObject{JsonData: []byte(`{"a":1}`), HashAlgorithm: testHashAlgorithm}).EncodePayload()
+	for i := 1; i < len(payload); i++ {
+		assert.Error(t, (&data.WebHookObject{}).DecodePayload(payload[:i]), "truncated at %d", i)
+	}
+	assert.Error(t, (&data.WebHookObject{}).DecodePayload(append(payload, 0)))
+
+	// fields added by later versions are skipped
+	unknownField := append([]byte{payload[0], payload[1] + 1, 0xff, 0, 0, 0, 1, 'x'}, payload[2:]...)
+	decoded := &data.WebHookObject{}
+	assert.NoError(t, decoded.DecodePayload(unknownField))
+	assert.Equal(t, testHashAlgorithm, decoded.HashAlgorithm)
+	assert.Equal(t, `{"a":1}`, string(decoded.JsonData))
+}
+
+// the algorithm the ids were hashed with is kept by every store
+func TestStoresKeepHashAlgorithm(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":"1"}`), HashAlgorithm: testHashAlgorithm},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"b":"2"}`), RawData: []byte("b=2"), ContentType: "application/x-www-form-urlencoded", Metadata: testWebHookMetadata(), HashAlgorithm: testHashAlgorithm},
+		{ID: data.NewObjectIdFromTimestamp(now, 3), JsonData: []byte(`{"c":"3"}`)},
+	}
+	ids := []data.ObjectID{objects[0].ID, objects[1].ID, objects[2].ID}
+
+	dir, err := ioutil.TempDir("", "hash")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileStore(filepath.Join(dir, "webhooks.data"))
+	assert.NoError(t, err)
+
+	stores := map[string]Store{
+		"file":       fileStore,
+		"segments":   newS3SegmentStore(newFakeS3(10), "webhooks", S3StoreOptions{}),
+		"dynamo":     dbStorage{db: newFakeDynamoDb(10), tableName: "webhooks"},
+		"dynamo raw": dbStorage{db: newFakeDynamoDb(10), tableName: "webhooks", options: DynamoDbStoreOptions{Layout: DynamoDbLayoutRaw}},
+	}
+	for name, store := range stores {
+		assert.NoError(t, store.Put(ctx, objects), name)
+		loaded, err := LoadStorageObjectsSync(ctx, store, ids)
+		assert.NoError(t, err, name)
+		if !assert.Len(t, loaded, 3, name) {
+			continue
+		}
+		assert.Equal(t, testHashAlgorithm, loaded[0].HashAlgorithm, name)
+		assert.Equal(t, testHashAlgorithm, loaded[1].HashAlgorithm, name)
+		assert.Equal(t, testWebHookMetadata(), loaded[1].Metadata, name)
+		assert.Empty(t, loaded[2].HashAlgorithm, name)
+	}
+
+	// s3 keeps it in the user metadata, the body stays the json payload
+	userMetadata := s3ObjectMetadata(objects[0])
+	monitor := &downloadMonitor{List: list.New(), ctx: ctx}
+	monitor.AddIds(ids[:1])
+	state := monitor.Front().Value.(*downloadItemState)
+	outChan := make(chan *data.WebHookObject, 1)
+	assert.NoError(t, monitor.setItemDownloaded(state, objects[0].JsonData, s3UserMetadata{hashAlgorithm: *userMetadata[s3HashAlgorithmKey]}, outChan))
+	assert.Equal(t, testHashAlgorithm, (<-outChan).HashAlgorithm)
+
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Append(objects[0]))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	replayed, _, err := wal.Replay()
+	assert.NoError(t, err)
+	if assert.Len(t, replayed, 1) {
+		assert.Equal(t, testHashAlgorithm, replayed[0].HashAlgorithm)
+	}
+	assert.NoError(t, wal.Close())
+}
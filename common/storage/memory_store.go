@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"webhooks/common/data"
+)
+
+var (
+	MemoryStoreFaultError    = errors.New("memory store fault")
+	MemoryStoreRejectedError = errors.New("memory store rejected the object")
+)
+
+// implements Store in memory - meant for tests and local development
+// the fault injection fields can be used for simulating a slow or failing backend, they need to be set before the store is used
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		index: newObjectIndex(),
+	}
+}
+
+type MemoryStore struct {
+	// delay applied to each Put call and to each item emitted by Keys and Objects
+	Latency time.Duration
+	// once this many items were saved or emitted, every operation fails - 0 disables it
+	// a Put that would go past it fails without saving any of its objects
+	FailAfter int
+	// error returned once FailAfter is reached, defaults to MemoryStoreFaultError
+	FailError error
+	// the objects it returns true for are never saved, Put lists them as permanent failures - nil accepts all of them
+	Reject func(obj *data.WebHookObject) bool
+
+	mux       sync.RWMutex
+	index     *objectIndex // ObjectID -> *data.WebHookObject
+	itemCount int          // items saved or emitted so far, checked against FailAfter
+}
+
+// counts an item that's about to be emitted, returns an error if FailAfter was reached
+func (s *MemoryStore) countItem() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.faultError(1); err != nil {
+		return err
+	}
+	s.itemCount += 1
+	return nil
+}
+
+// the error to fail with if n more items would go past FailAfter, nil otherwise - mux has to be held
+func (s *MemoryStore) faultError(n int) error {
+	if s.FailAfter <= 0 || s.itemCount+n <= s.FailAfter {
+		return nil
+	}
+	if s.FailError != nil {
+		return s.FailError
+	}
+	return MemoryStoreFaultError
+}
+
+func (s *MemoryStore) delay(ctx context.Context) error {
+	if s.Latency <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(s.Latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// saves all objects or none of them, saving an id that already exists replaces it
+// the rejected objects aside - the others are saved and a PartialPutError lists the rejected ones
+func (s *MemoryStore) Put(ctx context.Context, objects []*data.WebHookObject) error {
+	if err := s.delay(ctx); err != nil {
+		return err
+	}
+
+	accepted := make([]*data.WebHookObject, 0, len(objects))
+	rejected := make([]data.ObjectID, 0)
+	for _, item := range objects {
+		if s.Reject != nil && s.Reject(item) {
+			rejected = append(rejected, item.ID)
+		} else {
+			accepted = append(accepted, item)
+		}
+	}
+
+	// the objects are counted only once they're saved
+	s.mux.Lock()
+	if err := s.faultError(len(accepted)); err != nil {
+		s.mux.Unlock()
+		return err
+	}
+	for _, item := range accepted {
+		s.index.Set(item.ID, item)
+	}
+	s.itemCount += len(accepted)
+	s.mux.Unlock()
+
+	if len(rejected) > 0 {
+		return &PartialPutError{FailedIds: rejected, PermanentIds: rejected, Err: MemoryStoreRejectedError}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan data.ObjectID, <-chan error) {
+	resChan := make(chan data.ObjectID)
+	errChan := make(chan error, 1)
+
+	s.mux.RLock()
+	ids := s.index.Keys(fromTime, toTime)
+	s.mux.RUnlock()
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		for _, id := range ids {
+			if err := s.delay(ctx); err != nil {
+				errChan <- err
+				return
+			}
+			if err := s.countItem(); err != nil {
+				errChan <- err
+				return
+			}
+
+			select {
+			case resChan <- id:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+// emits the objects in the same order they were requested
+func (s *MemoryStore) Objects(ctx context.Context, objectIds []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
+	resChan := make(chan *data.WebHookObject)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		for _, id := range objectIds {
+			s.mux.RLock()
+			value, ok := s.index.Get(id)
+			s.mux.RUnlock()
+
+			if !ok {
+				errChan <- fmt.Errorf("object %s not found", id.Hex())
+				return
+			}
+			if err := s.delay(ctx); err != nil {
+				errChan <- err
+				return
+			}
+			if err := s.countItem(); err != nil {
+				errChan <- err
+				return
+			}
+
+			select {
+			case resChan <- value.(*data.WebHookObject):
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+// number of objects in the store
+func (s *MemoryStore) Len() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.index.Len()
+}
+
+var _ Store = &MemoryStore{}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+
+	store := NewMemoryStore()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second), 1), JsonData: []byte(`{"a":2}`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second*2), 3), JsonData: []byte(`{"a":3}`)},
+	}
+	assert.NoError(t, store.Put(ctx, objects))
+	assert.Equal(t, 3, store.Len())
+
+	ids, err := LoadStorageKeysSync(ctx, store, now, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{objects[1].ID, objects[0].ID}, ids, "keys should be sorted and both range ends included")
+
+	ids, err = LoadStorageKeysSync(ctx, store, now.Add(time.Second*3), now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	loaded, err := LoadStorageObjectsSync(ctx, store, []data.ObjectID{objects[2].ID, objects[1].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, []*data.WebHookObject{objects[2], objects[1]}, loaded, "objects should be sent in the requested order")
+
+	_, err = LoadStorageObjectsSync(ctx, store, []data.ObjectID{data.NewObjectIdFromTimestamp(now, 100)})
+	assert.Error(t, err)
+}
+
+func TestMemoryStoreFaults(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+
+	store := NewMemoryStore()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"a":2}`)},
+	}
+	assert.NoError(t, store.Put(ctx, objects))
+
+	store.FailAfter = 3
+	ids, err := LoadStorageKeysSync(ctx, store, now, now)
+	assert.Equal(t, MemoryStoreFaultError, err, "the 4th item should fail")
+	assert.Nil(t, ids)
+
+	assert.Equal(t, MemoryStoreFaultError, store.Put(ctx, objects))
+
+	// a Put going past FailAfter saves nothing, and its objects aren't counted
+	store = NewMemoryStore()
+	store.FailAfter = 3
+	assert.NoError(t, store.Put(ctx, objects))
+	more := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 3), JsonData: []byte(`{"a":3}`)},
+		{ID: data.NewObjectIdFromTimestamp(now, 4), JsonData: []byte(`{"a":4}`)},
+	}
+	assert.Equal(t, MemoryStoreFaultError, store.Put(ctx, more))
+	assert.Equal(t, 2, store.Len())
+	assert.NoError(t, store.Put(ctx, more[:1]), "the failed Put shouldn't count towards FailAfter")
+	assert.Equal(t, 3, store.Len())
+
+	store = NewMemoryStore()
+	store.Latency = time.Millisecond * 50
+	assert.NoError(t, store.Put(ctx, objects))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	_, err = LoadStorageKeysSync(timeoutCtx, store, now, now)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func testWebHookMetadata() *data.WebHookMetadata {
+	return &data.WebHookMetadata{
+		Method:     "POST",
+		RemoteAddr: "203.0.113.7",
+		Query:      "event=push&retry=1",
+		Headers:    map[string][]string{"User-Agent": {"sender/1.0"}, "X-Event-Type": {"push", "ping"}},
+		ReceivedAt: time.Date(2020, 3, 4, 5, 6, 7, 123456789, time.UTC),
+	}
+}
+
+// the metadata of the request is kept by every store, objects without it are read back without it
+func TestStoresKeepMetadata(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":"1"}`), Metadata: testWebHookMetadata()},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"b":"2"}`), RawData: []byte("b=2"), ContentType: "application/x-www-form-urlencoded", Metadata: testWebHookMetadata()},
+		{ID: data.NewObjectIdFromTimestamp(now, 3), JsonData: []byte(`{"c":"3"}`)},
+	}
+	ids := []data.ObjectID{objects[0].ID, objects[1].ID, objects[2].ID}
+
+	dir, err := ioutil.TempDir("", "metadata")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileStore(filepath.Join(dir, "webhooks.data"))
+	assert.NoError(t, err)
+
+	stores := map[string]Store{
+		"file":       fileStore,
+		"segments":   newS3SegmentStore(newFakeS3(10), "webhooks", S3StoreOptions{}),
+		"dynamo":     dbStorage{db: newFakeDynamoDb(10), tableName: "webhooks"},
+		"dynamo raw": dbStorage{db: newFakeDynamoDb(10), tableName: "webhooks", options: DynamoDbStoreOptions{Layout: DynamoDbLayoutRaw}},
+	}
+	for name, store := range stores {
+		assert.NoError(t, store.Put(ctx, objects), name)
+		loaded, err := LoadStorageObjectsSync(ctx, store, ids)
+		assert.NoError(t, err, name)
+		if !assert.Len(t, loaded, 3, name) {
+			continue
+		}
+		assert.JSONEq(t, `{"a":"1"}`, string(loaded[0].JsonData), name)
+		assert.Equal(t, testWebHookMetadata(), loaded[0].Metadata, name)
+		assert.Empty(t, loaded[0].RawData, name)
+		assert.Equal(t, []byte("b=2"), loaded[1].RawData, name)
+		assert.Equal(t, testWebHookMetadata(), loaded[1].Metadata, name)
+		assert.Nil(t, loaded[2].Metadata, name)
+	}
+
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Append(objects[0]))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	replayed, _, err := wal.Replay()
+	assert.NoError(t, err)
+	if assert.Len(t, replayed, 1) {
+		assert.Equal(t, testWebHookMetadata(), replayed[0].Metadata)
+	}
+	assert.NoError(t, wal.Close())
+}
+
+func TestS3ObjectMetadata(t *testing.T) {
+	assert.Nil(t, s3ObjectMetadata(&data.WebHookObject{}))
+
+	metadata := testWebHookMetadata()
+	userMetadata := s3ObjectMetadata(&data.WebHookObject{Metadata: metadata})
+	assert.NotContains(t, userMetadata, s3HashAlgorithmKey)
+	decoded, err := decodeS3ObjectMetadata(*userMetadata[s3MetadataKey])
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, decoded)
+
+	userMetadata = s3ObjectMetadata(&data.WebHookObject{HashAlgorithm: "crc32c-canonical-json-v2"})
+	assert.Equal(t, map[string]*string{s3HashAlgorithmKey: aws.String("crc32c-canonical-json-v2")}, userMetadata)
+
+	// the headers are dropped first, then the query
+	metadata.Headers["X-Big"] = []string{strings.Repeat("x", s3MaxMetadataSize)}
+	decoded, err = decodeS3ObjectMetadata(*s3ObjectMetadata(&data.WebHookObject{Metadata: metadata, HashAlgorithm: "crc32c-canonical-json-v2"})[s3MetadataKey])
+	assert.NoError(t, err)
+	assert.Nil(t, decoded.Headers)
+	assert.Equal(t, metadata.Query, decoded.Query)
+
+	metadata.Query = strings.Repeat("q", s3MaxMetadataSize)
+	decoded, err = decodeS3ObjectMetadata(*s3ObjectMetadata(&data.WebHookObject{Metadata: metadata, HashAlgorithm: "crc32c-canonical-json-v2"})[s3MetadataKey])
+	assert.NoError(t, err)
+	assert.Empty(t, decoded.Query)
+	assert.Equal(t, metadata.RemoteAddr, decoded.RemoteAddr)
+	assert.Equal(t, metadata.ReceivedAt, decoded.ReceivedAt)
+
+	decoded, err = decodeS3ObjectMetadata("")
+	assert.NoError(t, err)
+	assert.Nil(t, decoded)
+}
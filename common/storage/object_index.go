@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"time"
+	"webhooks/common/data"
+)
+
+// keeps values sorted by their object id
+// ids are compared byte by byte, which means they're sorted by timestamp first
+// not safe for concurrent use
+type objectIndex struct {
+	entries []objectIndexEntry
+}
+
+type objectIndexEntry struct {
+	id    data.ObjectID
+	value interface{}
+}
+
+func newObjectIndex() *objectIndex {
+	return &objectIndex{
+		entries: make([]objectIndexEntry, 0),
+	}
+}
+
+// position of the first entry having an id >= the given one
+func (idx *objectIndex) search(id data.ObjectID) int {
+	return sort.Search(len(idx.entries), func(i int) bool {
+		return bytes.Compare(idx.entries[i].id[:], id[:]) >= 0
+	})
+}
+
+// adds or replaces the value for the given id
+func (idx *objectIndex) Set(id data.ObjectID, value interface{}) {
+	i := idx.search(id)
+	if i < len(idx.entries) && idx.entries[i].id == id {
+		idx.entries[i].value = value
+		return
+	}
+	idx.entries = append(idx.entries, objectIndexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = objectIndexEntry{id: id, value: value}
+}
+
+func (idx *objectIndex) Get(id data.ObjectID) (interface{}, bool) {
+	i := idx.search(id)
+	if i < len(idx.entries) && idx.entries[i].id == id {
+		return idx.entries[i].value, true
+	}
+	return nil, false
+}
+
+// returns the ids having their timestamp between fromTime and toTime(both inclusive), sorted
+func (idx *objectIndex) Keys(fromTime, toTime time.Time) []data.ObjectID {
+	start := idx.search(data.NewObjectIdFromTimestamp(fromTime, 0))
+	// first id having a timestamp > toTime
+	end := idx.search(data.NewObjectIdFromTimestamp(toTime.Add(time.Second), 0))
+	if end < start {
+		end = start
+	}
+
+	res := make([]data.ObjectID, 0, end-start)
+	for i := start; i < end; i++ {
+		res = append(res, idx.entries[i].id)
+	}
+	return res
+}
+
+func (idx *objectIndex) Len() int {
+	return len(idx.entries)
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+// objects converted from another format keep their original payload in every store
+func TestStoresKeepOriginalPayload(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":"1"}`), RawData: []byte("a=1"), ContentType: "application/x-www-form-urlencoded"},
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"b":"2"}`)},
+	}
+
+	dir, err := ioutil.TempDir("", "original")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileStore(filepath.Join(dir, "webhooks.data"))
+	assert.NoError(t, err)
+
+	stores := map[string]Store{
+		"file":     fileStore,
+		"segments": newS3SegmentStore(newFakeS3(10), "webhooks", S3StoreOptions{}),
+		"dynamo":   dbStorage{db: newFakeDynamoDb(10), tableName: "webhooks"},
+		"dynamo raw": dbStorage{db: newFakeDynamoDb(10), tableName: "webhooks", options: DynamoDbStoreOptions{
+			Layout:   DynamoDbLayoutRaw,
+			Compress: true,
+		}},
+	}
+	for name, store := range stores {
+		assert.NoError(t, store.Put(ctx, objects), name)
+		loaded, err := LoadStorageObjectsSync(ctx, store, []data.ObjectID{objects[0].ID, objects[1].ID})
+		assert.NoError(t, err, name)
+		if !assert.Len(t, loaded, 2, name) {
+			continue
+		}
+		assert.JSONEq(t, string(objects[0].JsonData), string(loaded[0].JsonData), name)
+		assert.Equal(t, objects[0].RawData, loaded[0].RawData, name)
+		assert.Equal(t, objects[0].ContentType, loaded[0].ContentType, name)
+		assert.JSONEq(t, string(objects[1].JsonData), string(loaded[1].JsonData), name)
+		assert.Empty(t, loaded[1].RawData, name)
+	}
+
+	// reopening replays the records
+	fileStore, err = NewFileStore(filepath.Join(dir, "webhooks.data"))
+	assert.NoError(t, err)
+	loaded, err := LoadStorageObjectsSync(ctx, fileStore, []data.ObjectID{objects[0].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, objects[0].RawData, loaded[0].RawData)
+
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Append(objects[0]))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	replayed, _, err := wal.Replay()
+	assert.NoError(t, err)
+	assert.Equal(t, []*data.WebHookObject{{ID: objects[0].ID, JsonData: objects[0].JsonData, RawData: objects[0].RawData, ContentType: objects[0].ContentType}}, replayed)
+	assert.NoError(t, wal.Close())
+}
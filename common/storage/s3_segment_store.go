@@ -0,0 +1,425 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"webhooks/common/data"
+)
+
+const (
+	s3SegmentPrefix = "segments/"
+	// id + record offset + record length
+	s3SegmentIndexEntrySize = 8 + 4 + 4
+	// index entries count + crc32c of the index + magic
+	s3SegmentTrailerSize = 4 + 4 + 4
+	s3SegmentMagic       = "WHS1"
+	// footers of older segments are dropped once the cache grows past this
+	s3SegmentFooterCacheSize = 1000
+)
+
+var corruptS3SegmentError = errors.New("corrupt segment")
+
+// returned by footer when the trailer or the index of a segment doesn't match its checksum
+type corruptS3SegmentFooterError struct {
+	key string
+}
+
+func (e *corruptS3SegmentFooterError) Error() string {
+	return fmt.Sprintf("segment %s: %v", e.key, corruptS3SegmentError)
+}
+
+// implements Store by saving each Put as a single s3 object (segment) instead of one object per webhook
+// a segment is made of records in the file store format, sorted by id, followed by a footer:
+// [id 8 bytes][record offset 4 bytes][record length 4 bytes] for each record, then [entries count 4 bytes][crc32c 4 bytes]["WHS1"]
+// segments are saved as [<source>/]segments/yyyy/mm/dd/hh/<first id>-<last id>-<crc32c>, a Put spanning multiple hours creates one segment per hour
+// Keys reads only the footers of the segments overlapping the range, Objects uses ranged gets for the records
+func newS3SegmentStore(client s3iface.S3API, bucket string, options S3StoreOptions) *s3SegmentStore {
+	return &s3SegmentStore{
+		client:            client,
+		bucket:            bucket,
+		options:           options,
+		listKeysBatchSize: 1000,
+		footers:           make(map[string][]s3SegmentIndexEntry),
+	}
+}
+
+type s3SegmentStore struct {
+	client            s3iface.S3API
+	bucket            string
+	listKeysBatchSize int
+	options           S3StoreOptions
+
+	// segments are never modified once written, so their footers can be cached
+	footersMux sync.Mutex
+	footers    map[string][]s3SegmentIndexEntry
+}
+
+// segments/ for DefaultSource, <source>/segments/ for the others
+func (s *s3SegmentStore) segmentPrefix() string {
+	return sourcePrefix(s.options.Source, "/") + s3SegmentPrefix
+}
+
+type s3SegmentIndexEntry struct {
+	id     data.ObjectID
+	offset uint32
+	length uint32
+}
+
+// a segment as found when listing the bucket
+type s3SegmentKey struct {
+	key     string
+	firstId data.ObjectID
+	lastId  data.ObjectID
+}
+
+func (s *s3SegmentStore) Put(ctx context.Context, objects []*data.WebHookObject) error {
+	objects = dedupeObjects(objects)
+
+	hours := make(map[string][]*data.WebHookObject)
+	for _, obj := range objects {
+		prefix := obj.ID.Timestamp().UTC().Format(s3HourlyPrefixFormat)
+		hours[prefix] = append(hours[prefix], obj)
+	}
+
+	for prefix, items := range hours {
+		key, body := encodeS3Segment(s.segmentPrefix(), prefix, items)
+
+		_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Body:        bytes.NewReader(body),
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String("application/octet-stream"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sorts the items and returns the segment key + content
+func encodeS3Segment(segmentPrefix string, prefix string, items []*data.WebHookObject) (string, []byte) {
+	sort.Slice(items, func(i, j int) bool {
+		return bytes.Compare(items[i].ID[:], items[j].ID[:]) < 0
+	})
+
+	var buf bytes.Buffer
+	var footer bytes.Buffer
+	var entry [s3SegmentIndexEntrySize]byte
+
+	for _, item := range items {
+		offset := buf.Len()
+		writeFileRecord(&buf, item)
+
+		copy(entry[:8], item.ID[:])
+		binary.BigEndian.PutUint32(entry[8:], uint32(offset))
+		binary.BigEndian.PutUint32(entry[12:], uint32(buf.Len()-offset))
+		footer.Write(entry[:])
+	}
+
+	var trailer [s3SegmentTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[:4], uint32(len(items)))
+	binary.BigEndian.PutUint32(trailer[4:8], crc32.Checksum(footer.Bytes(), fileRecordTable))
+	copy(trailer[8:], s3SegmentMagic)
+
+	buf.Write(footer.Bytes())
+	buf.Write(trailer[:])
+
+	key := fmt.Sprintf("%s%s%s-%s-%08x", segmentPrefix, prefix,
+		items[0].ID.Hex(), items[len(items)-1].ID.Hex(), crc32.Checksum(buf.Bytes(), fileRecordTable))
+
+	return key, buf.Bytes()
+}
+
+func parseS3SegmentKey(key string) (s3SegmentKey, error) {
+	parts := strings.Split(key[strings.LastIndex(key, "/")+1:], "-")
+	if len(parts) != 3 {
+		return s3SegmentKey{}, errors.New("expected <first id>-<last id>-<checksum>")
+	}
+
+	firstId, err := data.NewObjectIdFromHex(parts[0])
+	if err != nil {
+		return s3SegmentKey{}, err
+	}
+	lastId, err := data.NewObjectIdFromHex(parts[1])
+	if err != nil {
+		return s3SegmentKey{}, err
+	}
+
+	return s3SegmentKey{key: key, firstId: firstId, lastId: lastId}, nil
+}
+
+// lists the segments of the given hour which may contain ids between fromTime and toTime
+func (s *s3SegmentStore) listSegments(ctx context.Context, hour time.Time, fromTime, toTime time.Time) ([]s3SegmentKey, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(s.segmentPrefix() + hour.UTC().Format(s3HourlyPrefixFormat)),
+		MaxKeys: aws.Int64(int64(s.listKeysBatchSize)),
+	}
+
+	res := make([]s3SegmentKey, 0)
+	for {
+		resp, err := s.client.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range resp.Contents {
+			segment, err := parseS3SegmentKey(aws.StringValue(obj.Key))
+			if err != nil {
+				if err = s.options.malformedKey(s.bucket, aws.StringValue(obj.Key), err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if segment.lastId.Timestamp().Before(fromTime.Truncate(time.Second)) || segment.firstId.Timestamp().After(toTime) {
+				continue
+			}
+			res = append(res, segment)
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			return res, nil
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+func (s *s3SegmentStore) getRange(ctx context.Context, key string, byteRange string) ([]byte, error) {
+	resp, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// reads the index of a segment with two ranged gets - the trailer and then the index entries
+func (s *s3SegmentStore) footer(ctx context.Context, key string) ([]s3SegmentIndexEntry, error) {
+	s.footersMux.Lock()
+	entries, ok := s.footers[key]
+	s.footersMux.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	trailer, err := s.getRange(ctx, key, fmt.Sprintf("bytes=-%d", s3SegmentTrailerSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(trailer) != s3SegmentTrailerSize || string(trailer[8:]) != s3SegmentMagic {
+		return nil, &corruptS3SegmentFooterError{key: key}
+	}
+	count := int(binary.BigEndian.Uint32(trailer[:4]))
+
+	index, err := s.getRange(ctx, key, fmt.Sprintf("bytes=-%d", count*s3SegmentIndexEntrySize+s3SegmentTrailerSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(index) != count*s3SegmentIndexEntrySize+s3SegmentTrailerSize {
+		return nil, &corruptS3SegmentFooterError{key: key}
+	}
+	index = index[:len(index)-s3SegmentTrailerSize]
+	if crc32.Checksum(index, fileRecordTable) != binary.BigEndian.Uint32(trailer[4:8]) {
+		return nil, &corruptS3SegmentFooterError{key: key}
+	}
+
+	entries = make([]s3SegmentIndexEntry, count)
+	for i := range entries {
+		entry := index[i*s3SegmentIndexEntrySize:]
+		copy(entries[i].id[:], entry[:8])
+		entries[i].offset = binary.BigEndian.Uint32(entry[8:])
+		entries[i].length = binary.BigEndian.Uint32(entry[12:])
+	}
+
+	s.footersMux.Lock()
+	if len(s.footers) >= s3SegmentFooterCacheSize {
+		s.footers = make(map[string][]s3SegmentIndexEntry)
+	}
+	s.footers[key] = entries
+	s.footersMux.Unlock()
+
+	return entries, nil
+}
+
+// the index entries of all segments of the given hour, between fromTime and toTime
+// each entry is paired with its segment key, entries are sorted by id and deduplicated
+func (s *s3SegmentStore) hourIndex(ctx context.Context, hour time.Time, fromTime, toTime time.Time) ([]s3SegmentIndexEntry, []string, error) {
+	segments, err := s.listSegments(ctx, hour, fromTime, toTime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := newObjectIndex()
+	for _, segment := range segments {
+		entries, err := s.footer(ctx, segment.key)
+		if _, ok := err.(*corruptS3SegmentFooterError); ok {
+			// a segment with a corrupt footer can't be indexed, skip it like a malformed key rather than failing the hour
+			if err = s.options.malformedKey(s.bucket, segment.key, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			index.Set(entry.id, s3SegmentLocation{key: segment.key, entry: entry})
+		}
+	}
+
+	ids := index.Keys(fromTime, toTime)
+	entries := make([]s3SegmentIndexEntry, len(ids))
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		value, _ := index.Get(id)
+		entries[i] = value.(s3SegmentLocation).entry
+		keys[i] = value.(s3SegmentLocation).key
+	}
+	return entries, keys, nil
+}
+
+type s3SegmentLocation struct {
+	key   string
+	entry s3SegmentIndexEntry
+}
+
+func (s *s3SegmentStore) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan data.ObjectID, <-chan error) {
+	resChan := make(chan data.ObjectID, s.listKeysBatchSize)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		for hour := fromTime.UTC().Truncate(time.Hour); !hour.After(toTime); hour = hour.Add(time.Hour) {
+			entries, _, err := s.hourIndex(ctx, hour, fromTime, toTime)
+			if err != nil {
+				errChan <- err
+				return
+			}
+
+			for _, entry := range entries {
+				select {
+				case resChan <- entry.id:
+				case <-ctx.Done():
+					errChan <- ctx.Err()
+					return
+				}
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+// finds the segments containing the requested ids, then downloads the records of each segment with a single ranged get
+// the objects are emitted in the same order they were requested
+func (s *s3SegmentStore) Objects(ctx context.Context, objectIds []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
+	resChan := make(chan *data.WebHookObject)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(resChan)
+		defer close(errChan)
+
+		found, err := s.loadObjects(ctx, objectIds)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		for _, id := range objectIds {
+			obj, ok := found[id]
+			if !ok {
+				errChan <- fmt.Errorf("object %s not found", id.Hex())
+				return
+			}
+
+			select {
+			case resChan <- obj:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
+
+func (s *s3SegmentStore) loadObjects(ctx context.Context, objectIds []data.ObjectID) (map[data.ObjectID]*data.WebHookObject, error) {
+	requested := make(map[data.ObjectID]bool, len(objectIds))
+	hours := make(map[time.Time]bool)
+	for _, id := range objectIds {
+		requested[id] = true
+		hours[id.Timestamp().UTC().Truncate(time.Hour)] = true
+	}
+
+	// segment key -> the entries to read from it
+	wanted := make(map[string][]s3SegmentIndexEntry)
+	for hour := range hours {
+		entries, keys, err := s.hourIndex(ctx, hour, hour, hour.Add(time.Hour-time.Second))
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			if requested[entry.id] {
+				wanted[keys[i]] = append(wanted[keys[i]], entry)
+			}
+		}
+	}
+
+	res := make(map[data.ObjectID]*data.WebHookObject, len(objectIds))
+	for key, entries := range wanted {
+		start, end := entries[0].offset, entries[0].offset+entries[0].length
+		for _, entry := range entries {
+			if entry.offset < start {
+				start = entry.offset
+			}
+			if entry.offset+entry.length > end {
+				end = entry.offset + entry.length
+			}
+		}
+
+		chunk, err := s.getRange(ctx, key, fmt.Sprintf("bytes=%d-%d", start, end-1))
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) != int(end-start) {
+			return nil, fmt.Errorf("segment %s: %v", key, corruptS3SegmentError)
+		}
+
+		for _, entry := range entries {
+			id, payload, err := readFileRecord(bytes.NewReader(chunk[entry.offset-start : entry.offset-start+entry.length]))
+			if err != nil || id != entry.id {
+				return nil, fmt.Errorf("segment %s, object %s: %v", key, entry.id.Hex(), corruptS3SegmentError)
+			}
+			if res[id], err = newFileRecordObject(id, payload); err != nil {
+				return nil, fmt.Errorf("segment %s: %v", key, err)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+var _ Store = &s3SegmentStore{}
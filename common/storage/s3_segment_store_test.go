@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestS3SegmentStore(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3(2)
+	store := newS3SegmentStore(client, "webhooks", S3StoreOptions{})
+	start := time.Date(2020, 2, 3, 23, 50, 0, 0, time.UTC)
+
+	objects := make([]*data.WebHookObject, 0)
+	for i := 0; i < 30; i++ {
+		objects = append(objects, &data.WebHookObject{
+			ID:       data.NewObjectIdFromTimestamp(start.Add(time.Minute*time.Duration(i)), uint32(i)),
+			JsonData: []byte(fmt.Sprintf(`{"i":%d}`, i)),
+		})
+	}
+
+	// overlapping batches, both crossing the hour
+	assert.NoError(t, store.Put(ctx, objects[:12]))
+	assert.NoError(t, store.Put(ctx, objects[8:]))
+	assert.Len(t, client.objects, 4, "a segment is saved for each hour of a batch")
+	for key := range client.objects {
+		assert.True(t, strings.HasPrefix(key, "segments/2020/02/0"), key)
+	}
+
+	keys, err := LoadStorageKeysSync(ctx, store, start, start.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 30)
+	for i, id := range keys {
+		assert.Equal(t, objects[i].ID, id)
+	}
+
+	keys, err = LoadStorageKeysSync(ctx, store, start.Add(time.Minute*5), start.Add(time.Minute*14))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 10)
+	assert.Equal(t, objects[5].ID, keys[0])
+
+	// footers are cached - a listing for each hour + a ranged get for each segment
+	client.requests = 0
+	requested := []data.ObjectID{objects[20].ID, objects[3].ID, objects[9].ID}
+	loaded, err := LoadStorageObjectsSync(ctx, store, requested)
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 3)
+	for i, obj := range loaded {
+		assert.Equal(t, requested[i], obj.ID)
+	}
+	assert.Equal(t, `{"i":20}`, string(loaded[0].JsonData))
+	assert.Equal(t, `{"i":3}`, string(loaded[1].JsonData))
+	assert.Equal(t, 5, client.requests)
+
+	_, err = LoadStorageObjectsSync(ctx, store, []data.ObjectID{data.NewObjectIdFromTimestamp(start, 999)})
+	assert.Error(t, err)
+}
+
+func TestS3SegmentStoreCorruptFooter(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3(10)
+	store := newS3SegmentStore(client, "webhooks", S3StoreOptions{})
+	now := time.Now()
+	corruptId := data.NewObjectIdFromTimestamp(now, 1)
+	validId := data.NewObjectIdFromTimestamp(now, 2)
+
+	assert.NoError(t, store.Put(ctx, []*data.WebHookObject{{ID: corruptId, JsonData: []byte(`{"a":1}`)}}))
+	corruptKey := ""
+	for key, body := range client.objects {
+		corruptKey = key
+		body[len(body)-s3SegmentTrailerSize-1] ^= 0xff
+		client.objects[key] = body
+	}
+	assert.NoError(t, store.Put(ctx, []*data.WebHookObject{{ID: validId, JsonData: []byte(`{"a":2}`)}}))
+
+	_, err := LoadStorageKeysSync(ctx, store, now.Add(-time.Minute), now.Add(time.Second))
+	assert.Error(t, err)
+
+	// in lenient mode the segment is reported and skipped, the rest of the hour can still be read
+	skipped := make([]string, 0)
+	store.options.MalformedKeys = S3MalformedKeysLenient
+	store.options.OnMalformedKey = func(key string, err error) {
+		skipped = append(skipped, key)
+	}
+	keys, err := LoadStorageKeysSync(ctx, store, now.Add(-time.Minute), now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{validId}, keys)
+	assert.Equal(t, []string{corruptKey}, skipped)
+}
@@ -4,27 +4,152 @@ import (
 	"bytes"
 	"container/list"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"math"
+	"strings"
 	"sync"
 	"time"
 	"webhooks/common/data"
 )
 
+type S3KeyLayout int
+
+const (
+	// objects are saved under their id - <objectid>
+	S3KeyLayoutFlat S3KeyLayout = iota
+	// objects are grouped by the hour they were received in - yyyy/mm/dd/hh/<objectid>
+	// spreads the writes over multiple prefixes and lets us list only the prefixes of a time range
+	S3KeyLayoutHourly
+)
+
+const s3HourlyPrefixFormat = "2006/01/02/15/"
+
+// the user metadata holding the webhook metadata and the hash algorithm of an object
+const (
+	s3MetadataKey         = "webhook-metadata"
+	s3MetadataHeader      = "X-Amz-Meta-Webhook-Metadata"
+	s3HashAlgorithmKey    = "webhook-hash-algorithm"
+	s3HashAlgorithmHeader = "X-Amz-Meta-Webhook-Hash-Algorithm"
+	s3MaxMetadataSize     = 2 * 1024
+)
+
+// returns the key an object is saved under
+func (l S3KeyLayout) ObjectKey(id data.ObjectID) string {
+	if l == S3KeyLayoutHourly {
+		return id.Timestamp().UTC().Format(s3HourlyPrefixFormat) + id.Hex()
+	}
+	return id.Hex()
+}
+
+// returns the id of the object saved under the given key
+// fails for keys which aren't exactly the ones ObjectKey returns (ex uppercase hex, objects under the wrong hour)
+func (l S3KeyLayout) ParseKey(key string) (data.ObjectID, error) {
+	id, err := data.NewObjectIdFromHex(key[strings.LastIndex(key, "/")+1:])
+	if err != nil {
+		return data.ZeroObjectID, err
+	}
+	if l.ObjectKey(id) != key {
+		return data.ZeroObjectID, fmt.Errorf("expected the key %s", l.ObjectKey(id))
+	}
+	return id, nil
+}
+
+// the prefixes which need to be listed for finding all objects between fromTime and toTime
+func (l S3KeyLayout) prefixes(fromTime, toTime time.Time) []string {
+	if l != S3KeyLayoutHourly {
+		return []string{""}
+	}
+
+	res := make([]string, 0)
+	for t := fromTime.UTC().Truncate(time.Hour); !t.After(toTime); t = t.Add(time.Hour) {
+		res = append(res, t.Format(s3HourlyPrefixFormat))
+	}
+	return res
+}
+
+type S3MalformedKeysMode int
+
+const (
+	// Keys fails on the first key which isn't an object id
+	S3MalformedKeysStrict S3MalformedKeysMode = iota
+	// Keys skips the keys which aren't object ids and reports them through S3StoreOptions.OnMalformedKey
+	S3MalformedKeysLenient
+)
+
+type S3StoreOptions struct {
+	KeyLayout S3KeyLayout
+	// the objects of sources other than DefaultSource are saved under a <source>/ prefix
+	Source string
+	// saves each Put as a single segment object, KeyLayout is ignored - see newS3SegmentStore
+	Segments      bool
+	MalformedKeys S3MalformedKeysMode
+	// called for each key skipped in lenient mode, ex for counting them
+	OnMalformedKey func(key string, err error)
+}
+
+// returns the error Keys should fail with, nil if the key can be skipped
+func (o S3StoreOptions) malformedKey(bucket string, key string, err error) error {
+	if o.MalformedKeys != S3MalformedKeysLenient {
+		return fmt.Errorf("unexpected key %q in bucket %s: %v", key, bucket, err)
+	}
+	if o.OnMalformedKey != nil {
+		o.OnMalformedKey(key, err)
+	}
+	return nil
+}
+
+// implements Store for s3, using the flat key layout
 func NewS3Store(awsSession *session.Session, bucket string) Store {
+	return NewS3StoreWithOptions(awsSession, bucket, S3StoreOptions{})
+}
+
+func NewS3StoreWithOptions(awsSession *session.Session, bucket string, options S3StoreOptions) Store {
+	if options.Segments {
+		return newS3SegmentStore(s3.New(awsSession), bucket, options)
+	}
 	return s3Storage{
 		session:           awsSession,
+		client:            s3.New(awsSession),
 		bucket:            bucket,
 		listKeysBatchSize: 1000,
+		options:           options,
 	}
 }
 
 type s3Storage struct {
 	session           *session.Session
+	client            s3iface.S3API
 	bucket            string
 	listKeysBatchSize int
+	options           S3StoreOptions
+}
+
+// the prefix of all keys of a source - empty for the default source
+func S3SourcePrefix(source string) string {
+	return sourcePrefix(source, "/")
+}
+
+func (s s3Storage) keyPrefix() string {
+	return S3SourcePrefix(s.options.Source)
+}
+
+func (s s3Storage) objectKey(id data.ObjectID) string {
+	return s.keyPrefix() + s.options.KeyLayout.ObjectKey(id)
+}
+
+func (s s3Storage) parseKey(key string) (data.ObjectID, error) {
+	if !strings.HasPrefix(key, s.keyPrefix()) {
+		return data.ZeroObjectID, fmt.Errorf("expected the %s prefix", s.keyPrefix())
+	}
+	return s.options.KeyLayout.ParseKey(strings.TrimPrefix(key, s.keyPrefix()))
 }
 
 func (s s3Storage) Put(ctx context.Context, data []*data.WebHookObject) error {
@@ -32,15 +157,24 @@ func (s s3Storage) Put(ctx context.Context, data []*data.WebHookObject) error {
 
 	for i := 0; i < len(data); i++ {
 		payload := data[i]
+		// objects converted from another format are saved together with their original payload
+		contentType := "application/json"
+		if len(payload.RawData) > 0 {
+			contentType = "application/octet-stream"
+		}
+		// the metadata and the hash algorithm are saved as user metadata, so the body is still the json payload
+		body := *payload
+		body.Metadata, body.HashAlgorithm = nil, ""
 
 		objects[i] = s3manager.BatchUploadObject{
 			Object: &s3manager.UploadInput{
 				ACL:         nil,
-				Body:        bytes.NewReader(payload.JsonData),
+				Body:        bytes.NewReader(body.EncodePayload()),
 				Bucket:      aws.String(s.bucket),
-				Key:         aws.String(payload.ID.Hex()),
-				ContentType: aws.String("application/json"),
-				ContentMD5:  aws.String(payload.Md5()),
+				Key:         aws.String(s.objectKey(payload.ID)),
+				ContentType: aws.String(contentType),
+				ContentMD5:  aws.String(body.Md5()),
+				Metadata:    s3ObjectMetadata(payload),
 			},
 		}
 	}
@@ -52,6 +186,77 @@ func (s s3Storage) Put(ctx context.Context, data []*data.WebHookObject) error {
 	})
 }
 
+// the user metadata of an object - its hash algorithm and the webhook metadata json, base64 encoded since user metadata has to be ascii
+// s3 limits user metadata to 2KB, so the headers and then the query are dropped if it doesn't fit
+func s3ObjectMetadata(obj *data.WebHookObject) map[string]*string {
+	res := make(map[string]*string)
+	size := 0
+	if obj.HashAlgorithm != "" {
+		res[s3HashAlgorithmKey] = aws.String(obj.HashAlgorithm)
+		size += len(s3HashAlgorithmKey) + len(obj.HashAlgorithm)
+	}
+	if obj.Metadata == nil {
+		if len(res) == 0 {
+			return nil
+		}
+		return res
+	}
+
+	m := *obj.Metadata
+	for {
+		jsonData, _ := json.Marshal(&m)
+		value := base64.StdEncoding.EncodeToString(jsonData)
+		if size+len(s3MetadataKey)+len(value) <= s3MaxMetadataSize || (m.Headers == nil && m.Query == "") {
+			res[s3MetadataKey] = aws.String(value)
+			return res
+		}
+		if m.Headers != nil {
+			m.Headers = nil
+		} else {
+			m.Query = ""
+		}
+	}
+}
+
+// reads the value of the s3MetadataHeader of an object - nil if it didn't have one
+func decodeS3ObjectMetadata(value string) (*data.WebHookMetadata, error) {
+	if value == "" {
+		return nil, nil
+	}
+	jsonData, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &data.WebHookMetadata{}
+	if err = json.Unmarshal(jsonData, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// the user metadata headers of a downloaded object
+type s3UserMetadata struct {
+	metadata      string // s3MetadataHeader
+	hashAlgorithm string // s3HashAlgorithmHeader
+}
+
+// request option saving the user metadata of the downloaded object
+// big objects are downloaded in concurrent parts, each of them having the headers
+func withS3ObjectMetadata(dest *s3UserMetadata) request.Option {
+	var once sync.Once
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(req *request.Request) {
+			if req.Error == nil && req.HTTPResponse != nil {
+				once.Do(func() {
+					dest.metadata = req.HTTPResponse.Header.Get(s3MetadataHeader)
+					dest.hashAlgorithm = req.HTTPResponse.Header.Get(s3HashAlgorithmHeader)
+				})
+			}
+		})
+	}
+}
+
+// lists only the prefixes overlapping the given range, the ids are sent in timestamp order
 func (s s3Storage) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan data.ObjectID, <-chan error) {
 
 	resChan := make(chan data.ObjectID, s.listKeysBatchSize)
@@ -62,76 +267,85 @@ func (s s3Storage) Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan
 		defer close(resChan)
 		defer close(errChan)
 
-		startObjectId := data.NewObjectIdFromTimestamp(fromTime, 0)
-
-		awsS3 := s3.New(s.session)
-
-		for !startObjectId.IsZero() {
-			resp, err := awsS3.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
-				Bucket:  aws.String(s.bucket),
-				Marker:  aws.String(startObjectId.Hex()),
-				MaxKeys: aws.Int64(int64(s.listKeysBatchSize)),
-			})
+		// StartAfter is exclusive, this is the biggest id before fromTime
+		startAfter := data.NewObjectIdFromTimestamp(fromTime.Add(-time.Second), math.MaxUint32)
 
+		for _, prefix := range s.options.KeyLayout.prefixes(fromTime, toTime) {
+			isDone, err := s.listKeys(ctx, s.keyPrefix()+prefix, s.objectKey(startAfter), toTime, resChan)
 			if err != nil {
 				errChan <- err
 				return
 			}
-
-			if len(resp.Contents) == 0 {
+			if isDone {
 				return
 			}
+		}
 
-			endIndex := len(resp.Contents) - 1
-
-			// in case th page size == response size => we need to find the start key for the next request
-			if endIndex == s.listKeysBatchSize-1 { // assuming pageSize >= 2
-				endIndex -= 1
-				for i := endIndex; i >= 0; i-- {
-					//TODO handle bad data and errors
-					currentItem, _ := data.NewObjectIdFromHex(*resp.Contents[i].Key)
-					nextItem, _ := data.NewObjectIdFromHex(*resp.Contents[i+1].Key)
+	}()
 
-					startObjectId = nextItem
+	return resChan, errChan
+}
 
-					if !currentItem.Timestamp().Equal(nextItem.Timestamp()) {
-						break
-					}
-				}
-			} else {
-				startObjectId = data.ZeroObjectID
-			}
+// sends the ids of all objects under the given prefix, following the continuation tokens
+// returns true once an id after toTime was found
+func (s s3Storage) listKeys(ctx context.Context, prefix string, startAfter string, toTime time.Time, resChan chan<- data.ObjectID) (bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		MaxKeys: aws.Int64(int64(s.listKeysBatchSize)),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if s.options.KeyLayout == S3KeyLayoutFlat {
+		// the objects of the other sources are under <source>/ prefixes
+		input.Delimiter = aws.String("/")
+	}
+	if startAfter > prefix {
+		input.StartAfter = aws.String(startAfter)
+	}
 
-			for i := 0; i <= endIndex; i++ {
-				//TODO handle bad data and errors
-				objId, _ := data.NewObjectIdFromHex(*resp.Contents[i].Key)
+	for {
+		resp, err := s.client.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return false, err
+		}
 
-				if objId.Timestamp().After(toTime) {
-					return
+		for _, obj := range resp.Contents {
+			objId, err := s.parseKey(aws.StringValue(obj.Key))
+			if err != nil {
+				if err = s.options.malformedKey(s.bucket, aws.StringValue(obj.Key), err); err != nil {
+					return false, err
 				}
+				continue
+			}
 
-				select {
-				case <-ctx.Done():
-					return
-				case resChan <- objId:
-					continue
-				}
+			if objId.Timestamp().After(toTime) {
+				return true, nil
 			}
 
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case resChan <- objId:
+			}
 		}
 
-	}()
-
-	return resChan, errChan
+		if !aws.BoolValue(resp.IsTruncated) {
+			return false, nil
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
 }
 
 func (s s3Storage) Objects(ctx context.Context, objectIds []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
 
 	monitor := &downloadMonitor{
-		List:    list.New(),
-		ctx:     ctx,
-		bucket:  s.bucket,
-		session: s.session,
+		List:      list.New(),
+		ctx:       ctx,
+		bucket:    s.bucket,
+		session:   s.session,
+		keyLayout: s.options.KeyLayout,
+		keyPrefix: s.keyPrefix(),
 	}
 
 	monitor.AddIds(objectIds)
@@ -152,6 +366,8 @@ type downloadMonitor struct {
 	ctx         context.Context
 	bucket      string
 	session     *session.Session
+	keyLayout   S3KeyLayout
+	keyPrefix   string
 }
 
 // enqueue an item for download
@@ -174,7 +390,7 @@ func (m *downloadMonitor) AddIds(objectIds []data.ObjectID) {
 
 // we need to emit items in the same order they were requested
 // item N can't be sent back unless all items before it were done and sent
-func (m *downloadMonitor) setItemDownloaded(item *downloadItemState, jsonData []byte, outChan chan<- *data.WebHookObject) error {
+func (m *downloadMonitor) setItemDownloaded(item *downloadItemState, payload []byte, userMetadata s3UserMetadata, outChan chan<- *data.WebHookObject) error {
 	m.itemDoneMux.Lock()
 	defer m.itemDoneMux.Unlock()
 
@@ -183,7 +399,14 @@ func (m *downloadMonitor) setItemDownloaded(item *downloadItemState, jsonData []
 	for current := m.Front(); current != nil; current = current.Next() {
 		stateObj := current.Value.(*downloadItemState)
 		if stateObj == item {
-			stateObj.obj.JsonData = jsonData
+			if err := stateObj.obj.DecodePayload(payload); err != nil {
+				return fmt.Errorf("object %s: %v", stateObj.obj.ID.Hex(), err)
+			}
+			var err error
+			if stateObj.obj.Metadata, err = decodeS3ObjectMetadata(userMetadata.metadata); err != nil {
+				return fmt.Errorf("object %s: invalid metadata: %v", stateObj.obj.ID.Hex(), err)
+			}
+			stateObj.obj.HashAlgorithm = userMetadata.hashAlgorithm
 			stateObj.isDone = true
 			if current == front {
 				isFront = true
@@ -225,36 +448,32 @@ func (m *downloadMonitor) Run() (<-chan *data.WebHookObject, chan error) {
 		defer close(resChan)
 		defer close(errChan)
 
-		objects := make([]s3manager.BatchDownloadObject, m.Len())
-		i := 0
+		states := make([]*downloadItemState, 0, m.Len())
 		for current := m.Front(); current != nil; current = current.Next() {
-			stateObj := current.Value.(*downloadItemState)
-
-			writer := aws.NewWriteAtBuffer([]byte{})
-
-			objects[i] = s3manager.BatchDownloadObject{
-				Object: &s3.GetObjectInput{
-					Bucket: aws.String(m.bucket),
-					Key:    aws.String(stateObj.obj.ID.Hex()),
-				},
-				Writer: writer,
-				After: func() error {
-					return m.setItemDownloaded(stateObj, writer.Bytes(), resChan)
-				},
-			}
-
-			i += 1
+			states = append(states, current.Value.(*downloadItemState))
 		}
 
 		downloader := s3manager.NewDownloader(m.session)
 
-		err := downloader.DownloadWithIterator(m.ctx, &s3manager.DownloadObjectsIterator{
-			Objects: objects,
-		})
+		// downloads the objects one by one like DownloadWithIterator, but keeps the metadata header of each of them
+		for _, stateObj := range states {
+			writer := aws.NewWriteAtBuffer([]byte{})
+			key := m.keyPrefix + m.keyLayout.ObjectKey(stateObj.obj.ID)
+			var userMetadata s3UserMetadata
 
-		if err != nil {
-			errChan <- err
-			return
+			_, err := downloader.DownloadWithContext(m.ctx, writer, &s3.GetObjectInput{
+				Bucket: aws.String(m.bucket),
+				Key:    aws.String(key),
+			}, s3manager.WithDownloaderRequestOptions(withS3ObjectMetadata(&userMetadata)))
+			if err != nil {
+				errChan <- fmt.Errorf("couldn't download %s: %v", key, err)
+				return
+			}
+
+			if err = m.setItemDownloaded(stateObj, writer.Bytes(), userMetadata, resChan); err != nil {
+				errChan <- err
+				return
+			}
 		}
 
 	}()
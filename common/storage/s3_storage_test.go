@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects  map[string][]byte
+	maxKeys  int
+	requests int
+}
+
+func newFakeS3(maxKeys int) *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		maxKeys: maxKeys,
+	}
+}
+
+func (s *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.objects[*input.Key] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (s *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	s.requests += 1
+	body, ok := s.objects[*input.Key]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", *input.Key)
+	}
+
+	// supports only "bytes=start-end" and "bytes=-suffixLength"
+	if input.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*input.Range, "bytes=-%d", &end); err == nil {
+			start = len(body) - end
+			if start < 0 {
+				start = 0
+			}
+			end = len(body) - 1
+		} else if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, fmt.Errorf("unsupported range %s", *input.Range)
+		}
+		if end >= len(body) {
+			end = len(body) - 1
+		}
+		body = body[start : end+1]
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// continuation tokens are the last key of the previous page
+func (s *fakeS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	s.requests += 1
+
+	after := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		after = *input.ContinuationToken
+	}
+
+	keys := make([]string, 0)
+	for k := range s.objects {
+		rest := strings.TrimPrefix(k, aws.StringValue(input.Prefix))
+		// the keys grouped under common prefixes aren't listed
+		if input.Delimiter != nil && strings.Contains(rest, *input.Delimiter) {
+			continue
+		}
+		if strings.HasPrefix(k, aws.StringValue(input.Prefix)) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, k := range keys {
+		if len(out.Contents) == s.maxKeys {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = out.Contents[len(out.Contents)-1].Key
+			break
+		}
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
+func TestS3KeyLayout(t *testing.T) {
+	id := data.NewObjectIdFromTimestamp(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC), 7)
+
+	for _, layout := range []S3KeyLayout{S3KeyLayoutFlat, S3KeyLayoutHourly} {
+		parsed, err := layout.ParseKey(layout.ObjectKey(id))
+		assert.NoError(t, err)
+		assert.Equal(t, id, parsed)
+	}
+	assert.Equal(t, "2020/02/03/04/"+id.Hex(), S3KeyLayoutHourly.ObjectKey(id))
+
+	assert.Equal(t, []string{"2020/02/03/23/", "2020/02/04/00/", "2020/02/04/01/"}, S3KeyLayoutHourly.prefixes(
+		time.Date(2020, 2, 3, 23, 59, 0, 0, time.UTC),
+		time.Date(2020, 2, 4, 1, 0, 0, 0, time.UTC),
+	))
+}
+
+func TestS3Keys(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 2, 3, 23, 50, 0, 0, time.UTC)
+
+	ids := make([]data.ObjectID, 0)
+	for i := 0; i < 20; i++ {
+		// 5 objects having the same timestamp every 10 minutes
+		ids = append(ids, data.NewObjectIdFromTimestamp(start.Add(time.Minute*time.Duration(i/5)*10), uint32(i)))
+	}
+
+	for _, layout := range []S3KeyLayout{S3KeyLayoutFlat, S3KeyLayoutHourly} {
+		client := newFakeS3(2)
+		for _, id := range ids {
+			client.objects[layout.ObjectKey(id)] = []byte(`{}`)
+		}
+		store := s3Storage{client: client, bucket: "webhooks", listKeysBatchSize: 2, options: S3StoreOptions{KeyLayout: layout}}
+
+		keys, err := LoadStorageKeysSync(ctx, store, start, start.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, ids, keys, "pages ending on identical timestamps shouldn't skip or repeat ids")
+
+		keys, err = LoadStorageKeysSync(ctx, store, start.Add(time.Minute*10), start.Add(time.Minute*20))
+		assert.NoError(t, err)
+		assert.Equal(t, ids[5:15], keys)
+
+		if layout == S3KeyLayoutHourly {
+			client.requests = 0
+			keys, err = LoadStorageKeysSync(ctx, store, start.Add(time.Minute*15), start.Add(time.Minute*25))
+			assert.NoError(t, err)
+			assert.Equal(t, ids[10:15], keys)
+			assert.Equal(t, 3, client.requests, "only the prefix of the requested hour should be listed")
+		}
+	}
+}
+
+func TestS3KeysUnexpectedKey(t *testing.T) {
+	client := newFakeS3(10)
+	client.objects["not-an-id"] = []byte(`{}`)
+	store := s3Storage{client: client, bucket: "webhooks", listKeysBatchSize: 10}
+
+	_, err := LoadStorageKeysSync(context.Background(), store, time.Now().Add(-time.Hour), time.Now())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not-an-id")
+}
+
+func TestS3KeysMalformedKeys(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 2, 3, 4, 0, 0, 0, time.UTC)
+
+	for _, layout := range []S3KeyLayout{S3KeyLayoutFlat, S3KeyLayoutHourly} {
+		client := newFakeS3(2)
+		ids := make([]data.ObjectID, 0)
+		for i := 0; i < 6; i++ {
+			id := data.NewObjectIdFromTimestamp(start.Add(time.Minute), uint32(i))
+			ids = append(ids, id)
+			client.objects[layout.ObjectKey(id)] = []byte(`{}`)
+		}
+
+		// keys which aren't ids placed between and after the valid ones, some of them filling whole pages
+		prefix := start.Format(s3HourlyPrefixFormat)
+		if layout == S3KeyLayoutFlat {
+			prefix = ""
+		}
+		malformed := []string{
+			prefix + ids[0].Hex() + ".json",
+			prefix + ids[3].Hex() + "-copy", prefix + ids[3].Hex() + "-copy2",
+			prefix + "zzz", prefix + "zzzz",
+		}
+		if layout == S3KeyLayoutHourly {
+			// an id saved under the wrong hour
+			malformed = append(malformed, prefix+data.NewObjectIdFromTimestamp(start.Add(time.Hour), 1).Hex())
+		}
+		for _, key := range malformed {
+			client.objects[key] = []byte(`{}`)
+		}
+
+		store := s3Storage{client: client, bucket: "webhooks", listKeysBatchSize: 2, options: S3StoreOptions{KeyLayout: layout}}
+		_, err := LoadStorageKeysSync(ctx, store, start, start.Add(time.Hour-time.Second))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "webhooks")
+
+		skipped := make([]string, 0)
+		store.options.MalformedKeys = S3MalformedKeysLenient
+		store.options.OnMalformedKey = func(key string, err error) {
+			assert.Error(t, err)
+			skipped = append(skipped, key)
+		}
+		keys, err := LoadStorageKeysSync(ctx, store, start, start.Add(time.Hour-time.Second))
+		assert.NoError(t, err)
+		assert.Equal(t, ids, keys)
+		assert.ElementsMatch(t, malformed, skipped)
+	}
+}
+
+func TestS3KeysSources(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 2, 3, 4, 0, 0, 0, time.UTC)
+
+	for _, layout := range []S3KeyLayout{S3KeyLayoutFlat, S3KeyLayoutHourly} {
+		client := newFakeS3(10)
+		stores := make(map[string]s3Storage)
+		ids := make(map[string][]data.ObjectID)
+
+		for i, source := range []string{DefaultSource, "github", "stripe"} {
+			store := s3Storage{client: client, bucket: "webhooks", listKeysBatchSize: 10, options: S3StoreOptions{KeyLayout: layout, Source: source}}
+			stores[source] = store
+			for j := 0; j < 3; j++ {
+				id := data.NewObjectIdFromTimestamp(start.Add(time.Minute*time.Duration(j)), uint32(i*10+j))
+				ids[source] = append(ids[source], id)
+				client.objects[store.objectKey(id)] = []byte(`{}`)
+			}
+		}
+		assert.Contains(t, client.objects, "github/"+layout.ObjectKey(ids["github"][0]))
+		assert.Contains(t, client.objects, layout.ObjectKey(ids[DefaultSource][0]), "the default source shouldn't have a prefix")
+
+		for source, store := range stores {
+			keys, err := LoadStorageKeysSync(ctx, store, start, start.Add(time.Hour))
+			assert.NoError(t, err)
+			assert.Equal(t, ids[source], keys, "the keys of the other sources shouldn't be listed")
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"webhooks/common/data"
+)
+
+// the source of the webhooks which don't come from a configured integration
+// stores keep its objects without any prefix, so data saved before sources existed stays readable
+const DefaultSource = "default"
+
+// prefix of the keys/partitions holding the objects of a source
+func sourcePrefix(source string, separator string) string {
+	if source == "" || source == DefaultSource {
+		return ""
+	}
+	return source + separator
+}
+
+// sets the source of the objects loaded from a store holding the objects of a single source
+func WithSource(source string, store Store) Store {
+	return sourceStore{Store: store, source: source}
+}
+
+type sourceStore struct {
+	Store
+	source string
+}
+
+func (s sourceStore) Objects(ctx context.Context, ids []data.ObjectID) (<-chan *data.WebHookObject, <-chan error) {
+	objects, errChan := s.Store.Objects(ctx, ids)
+	resChan := make(chan *data.WebHookObject)
+
+	go func() {
+		defer close(resChan)
+		for obj := range objects {
+			obj.Source = s.source
+			select {
+			case resChan <- obj:
+			case <-ctx.Done():
+				// the wrapped store notices ctx too, let it stop on its own
+				for range objects {
+				}
+				return
+			}
+		}
+	}()
+
+	return resChan, errChan
+}
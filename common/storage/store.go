@@ -2,11 +2,13 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"time"
 	"webhooks/common/data"
 )
 
 type Store interface {
+	// either saves all objects or returns an error - a PartialPutError if only some of them were saved
 	Put(ctx context.Context, data []*data.WebHookObject) error
 
 	Keys(ctx context.Context, fromTime, toTime time.Time) (<-chan data.ObjectID, <-chan error)
@@ -14,6 +16,48 @@ type Store interface {
 	Objects(ctx context.Context, ids []data.ObjectID) (<-chan *data.WebHookObject, <-chan error)
 }
 
+// returned by Put when some of the objects couldn't be saved, all the others were saved
+type PartialPutError struct {
+	FailedIds []data.ObjectID
+	// the failed objects which will never be saved, whatever the number of retries - a subset of FailedIds
+	PermanentIds []data.ObjectID
+	Err          error // the last error that caused an object not to be saved
+}
+
+func (e *PartialPutError) Error() string {
+	return fmt.Sprintf("%d objects couldn't be saved: %v", len(e.FailedIds), e.Err)
+}
+
+// returned by Put when none of the objects will ever be saved, ex they're too big or can't be encoded
+type PermanentPutError struct {
+	Err error
+}
+
+func (e *PermanentPutError) Error() string {
+	return e.Err.Error()
+}
+
+// whether retrying the Put call that failed with err is pointless
+func IsPermanentPutError(err error) bool {
+	_, ok := err.(*PermanentPutError)
+	return ok
+}
+
+// removes the objects having the same id, keeping the last one - some stores reject duplicate keys in the same batch
+func dedupeObjects(objects []*data.WebHookObject) []*data.WebHookObject {
+	positions := make(map[data.ObjectID]int, len(objects))
+	res := make([]*data.WebHookObject, 0, len(objects))
+	for _, obj := range objects {
+		if i, ok := positions[obj.ID]; ok {
+			res[i] = obj
+			continue
+		}
+		positions[obj.ID] = len(res)
+		res = append(res, obj)
+	}
+	return res
+}
+
 func LoadStorageKeysSync(ctx context.Context, store Store, rangeStart, rangeEnd time.Time) ([]data.ObjectID, error) {
 	idsChan, errChan := store.Keys(ctx, rangeStart, rangeEnd)
 	res := make([]data.ObjectID, 0)
@@ -26,12 +70,17 @@ func LoadStorageKeysSync(ctx context.Context, store Store, rangeStart, rangeEnd
 			} else {
 				isDone = true
 			}
-		case err := <-errChan:
-			if err != nil {
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else if err != nil {
 				return nil, err
 			}
 		}
 	}
+	if err := DrainErrors(errChan); err != nil {
+		return nil, err
+	}
 	return res, nil
 }
 
@@ -47,11 +96,30 @@ func LoadStorageObjectsSync(ctx context.Context, store Store, ids []data.ObjectI
 			} else {
 				isDone = true
 			}
-		case err := <-errChan:
-			if err != nil {
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else if err != nil {
 				return nil, err
 			}
 		}
 	}
+	if err := DrainErrors(errChan); err != nil {
+		return nil, err
+	}
 	return res, nil
 }
+
+// returns the first error sent on errChan, waiting for it to be closed
+// stores close errChan once they're done, so an error sent right before the results channel was closed isn't missed
+func DrainErrors(errChan <-chan error) error {
+	if errChan == nil {
+		return nil
+	}
+	for err := range errChan {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
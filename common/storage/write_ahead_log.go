@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"webhooks/common/data"
+)
+
+const walSegmentExt = ".wal"
+
+// durable log of the objects which were accepted but not saved in a Store yet
+// the log is split in segments, records use the file store format
+// Append writes to the current segment, Rotate starts a new one and Remove deletes a segment once its objects were saved
+func NewWriteAheadLog(dir string) (*WriteAheadLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &WriteAheadLog{dir: dir, syncFile: (*os.File).Sync}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	// never append to a segment left by a previous run, its tail may be torn
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1] + 1
+	}
+
+	if w.file, err = w.open(w.seq); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+type WriteAheadLog struct {
+	dir  string
+	mux  sync.Mutex
+	seq  uint64
+	file *os.File
+
+	// records are synced in groups, a single fsync covers all records written before it started
+	syncMux  sync.Mutex
+	written  uint64 // records written so far, guarded by mux
+	synced   uint64 // records synced so far, guarded by syncMux
+	syncFile func(f *os.File) error
+}
+
+func (w *WriteAheadLog) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walSegmentExt))
+}
+
+// sequence numbers of all segments on disk, sorted
+func (w *WriteAheadLog) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]uint64, 0)
+	for _, f := range files {
+		var seq uint64
+		if !strings.HasSuffix(f.Name(), walSegmentExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%d"+walSegmentExt, &seq); err != nil {
+			continue
+		}
+		res = append(res, seq)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+func (w *WriteAheadLog) open(seq uint64) (*os.File, error) {
+	return os.OpenFile(w.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// returns once the object was synced to disk
+func (w *WriteAheadLog) Append(item *data.WebHookObject) error {
+	position, err := w.Write(item)
+	if err != nil {
+		return err
+	}
+	return w.Sync(position)
+}
+
+// writes the object to the current segment without waiting for it to reach the disk
+// returns the position Sync has to be called with before relying on the object
+func (w *WriteAheadLog) Write(item *data.WebHookObject) (uint64, error) {
+	var buf bytes.Buffer
+	writeFileRecord(&buf, item)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.written += 1
+	return w.written, nil
+}
+
+// returns once all records up to position were synced to disk
+// the callers waiting meanwhile share the next fsync
+func (w *WriteAheadLog) Sync(position uint64) error {
+	w.syncMux.Lock()
+	defer w.syncMux.Unlock()
+
+	if w.synced >= position {
+		return nil
+	}
+
+	// the records written during the fsync wait for the next one
+	w.mux.Lock()
+	file, written := w.file, w.written
+	w.mux.Unlock()
+
+	if err := w.syncFile(file); err != nil {
+		return err
+	}
+	w.synced = written
+	return nil
+}
+
+// closes the current segment and starts a new one
+// returns the sequence of the closed segment, objects appended from now on go in later segments
+// if the new segment can't be created, the current one is kept and stays open
+func (w *WriteAheadLog) Rotate() (uint64, error) {
+	w.syncMux.Lock()
+	defer w.syncMux.Unlock()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	next, err := w.open(w.seq + 1)
+	if err != nil {
+		return 0, err
+	}
+	// the records written but not synced yet are in the closed segment
+	if err = w.syncFile(w.file); err != nil {
+		next.Close()
+		os.Remove(next.Name())
+		return 0, err
+	}
+	w.synced = w.written
+
+	// every record was synced already, nothing is lost if close fails
+	w.file.Close()
+	w.file = next
+	w.seq += 1
+	return w.seq - 1, nil
+}
+
+// deletes a closed segment
+func (w *WriteAheadLog) Remove(seq uint64) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if seq == w.seq {
+		return fmt.Errorf("segment %d is still open", seq)
+	}
+	return os.Remove(w.segmentPath(seq))
+}
+
+// reads the objects of all closed segments, oldest first - returns the segments they were read from too
+// a torn record at the end of a segment (ex the process crashed while writing it) ends that segment
+func (w *WriteAheadLog) Replay() ([]*data.WebHookObject, []uint64, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := make([]*data.WebHookObject, 0)
+	closed := make([]uint64, 0)
+	for _, seq := range segments {
+		if seq == w.seq {
+			break
+		}
+		if res, err = w.replaySegment(seq, res); err != nil {
+			return nil, nil, err
+		}
+		closed = append(closed, seq)
+	}
+	return res, closed, nil
+}
+
+func (w *WriteAheadLog) replaySegment(seq uint64, res []*data.WebHookObject) ([]*data.WebHookObject, error) {
+	f, err := os.Open(w.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		id, payload, err := readFileRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == corruptFileRecordError {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+		obj, err := newFileRecordObject(id, payload)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, obj)
+	}
+}
+
+func (w *WriteAheadLog) Close() error {
+	w.syncMux.Lock()
+	defer w.syncMux.Unlock()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if err := w.syncFile(w.file); err != nil {
+		w.file.Close()
+		return err
+	}
+	w.synced = w.written
+	return w.file.Close()
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestWriteAheadLogGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wal, err := NewWriteAheadLog(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// a slow disk - each fsync takes 20ms
+	var syncMux sync.Mutex
+	syncs := 0
+	wal.syncFile = func(f *os.File) error {
+		time.Sleep(time.Millisecond * 20)
+		syncMux.Lock()
+		syncs += 1
+		syncMux.Unlock()
+		return f.Sync()
+	}
+
+	const appends = 50
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, wal.Append(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(time.Now(), uint32(i)), JsonData: []byte(`{}`)}))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Less(t, syncs, appends/2, "concurrent appends should share their fsync")
+	assert.Less(t, int64(time.Since(start)), int64(time.Millisecond*20*appends/2))
+
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	replayed, _, err := wal.Replay()
+	assert.NoError(t, err)
+	assert.Len(t, replayed, appends)
+}
+
+func TestWriteAheadLogRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wal, err := NewWriteAheadLog(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	now := time.Now()
+	assert.NoError(t, wal.Append(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{}`)}))
+
+	// a directory in place of the next segment, it can't be opened for writing
+	blocker := wal.segmentPath(1)
+	assert.NoError(t, os.Mkdir(blocker, 0755))
+	_, err = wal.Rotate()
+	assert.Error(t, err)
+
+	// the current segment is still the open one
+	assert.NoError(t, wal.Append(&data.WebHookObject{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{}`)}))
+	assert.Error(t, wal.Remove(0), "the current segment shouldn't be removed")
+
+	assert.NoError(t, os.Remove(blocker))
+	seq, err := wal.Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), seq)
+
+	replayed, segments, err := wal.Replay()
+	assert.NoError(t, err)
+	assert.Len(t, replayed, 2)
+	assert.Equal(t, []uint64{0}, segments)
+}
@@ -0,0 +1,268 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+// number of missing objects loaded from storage at once
+const syncReplyBatchSize = 100
+
+// reads a sync request from in and writes to out all the objects which were found in store but not in master
+// the master ids are read as they come in and merged with the store keys on the fly, so neither of them is loaded in memory
+// the reply is written as soon as we know an object is missing from master
+// cancelling ctx or failing to write to out stops everything
+// store holds the objects of the default source, requests for other sources are rejected
+// requests from a master hashing with another algorithm are matched by hashing the objects again with the master's algorithm
+// requests with an unknown hash algorithm are rejected
+func ReplyToSync(ctx context.Context, in io.Reader, out io.Writer, store storage.Store) error {
+	return ReplyToSourceSync(ctx, in, out, func(source string) (storage.Store, error) {
+		if source != storage.DefaultSource {
+			return nil, fmt.Errorf("unknown source %s", source)
+		}
+		return store, nil
+	})
+}
+
+// same as ReplyToSync, but the store is picked by the source of the request - stores returns an error for unknown sources
+func ReplyToSourceSync(ctx context.Context, in io.Reader, out io.Writer, stores func(source string) (storage.Store, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := NewSyncRequestReader(in)
+	if err != nil {
+		return err
+	}
+	if !IsKnownHashAlgorithm(req.HashAlgorithm) {
+		return fmt.Errorf("unsupported hash algorithm %s", req.HashAlgorithm)
+	}
+
+	source := req.Source
+	if source == "" {
+		source = storage.DefaultSource
+	}
+	store, err := stores(source)
+	if err != nil {
+		return err
+	}
+
+	masterIds := newSyncIdWindow(req, SyncMaxTimeSpan)
+	slaveIds, slaveErrs := store.Keys(ctx, req.RangeStart, req.RangeEnd)
+
+	// the ids can be matched as they are only when master hashes like us
+	// otherwise every object is loaded and matched in writeRehashedMissingObjects
+	rehash := req.HashAlgorithm != CurrentHashAlgorithm
+	writeBatch := func(ids []data.ObjectID) error {
+		if rehash {
+			return writeRehashedMissingObjects(ctx, out, store, ids, masterIds, req.HashAlgorithm)
+		}
+		return writeMissingObjects(ctx, out, store, ids)
+	}
+
+	missing := make([]data.ObjectID, 0, syncReplyBatchSize)
+
+	for slaveIds != nil {
+		select {
+		case id, ok := <-slaveIds:
+			if !ok {
+				slaveIds = nil
+				break
+			}
+			if !rehash {
+				found, err := masterIds.Match(id)
+				if err != nil {
+					return err
+				}
+				if found {
+					continue
+				}
+			}
+			missing = append(missing, id)
+			if len(missing) >= syncReplyBatchSize {
+				if err = writeBatch(missing); err != nil {
+					return err
+				}
+				missing = missing[:0]
+			}
+		case err, ok := <-slaveErrs:
+			if !ok {
+				slaveErrs = nil
+			} else if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := storage.DrainErrors(slaveErrs); err != nil {
+		return err
+	}
+
+	if err = writeBatch(missing); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writeSyncReplyDone(&buf)
+	return writeSyncReplyChunk(out, &buf)
+}
+
+// loads the objects for the given ids and writes them to out
+func writeMissingObjects(ctx context.Context, out io.Writer, store storage.Store, ids []data.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := loadSyncObjects(ctx, store, ids, func(obj *data.WebHookObject) {
+		writeSyncReplyItem(&buf, obj)
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeSyncReplyChunk(out, &buf)
+}
+
+// loads the objects for the given ids, hashes them with the master's algorithm and writes to out the ones master doesn't have
+// ids need to be sorted by timestamp, the objects are matched in the same order
+// objects which were hashed with the master's algorithm keep their id hash, the others are hashed again from their json
+func writeRehashedMissingObjects(ctx context.Context, out io.Writer, store storage.Store, ids []data.ObjectID, masterIds *syncIdWindow, algorithm HashAlgorithm) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// stores don't always return the objects in the order they were requested
+	objects := make(map[data.ObjectID]*data.WebHookObject, len(ids))
+	err := loadSyncObjects(ctx, store, ids, func(obj *data.WebHookObject) {
+		objects[obj.ID] = obj
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, id := range ids {
+		obj, ok := objects[id]
+		if !ok {
+			continue
+		}
+		matchId := id
+		if ObjectHashAlgorithm(obj) != algorithm {
+			hash, err := WebHookHash(algorithm, obj.JsonData)
+			if err != nil {
+				return fmt.Errorf("couldn't hash %s with %s: %v", id.Hex(), algorithm, err)
+			}
+			matchId = data.NewObjectIdFromTimestamp(id.Timestamp(), hash)
+		}
+		found, err := masterIds.Match(matchId)
+		if err != nil {
+			return err
+		}
+		if !found {
+			writeSyncReplyItem(&buf, obj)
+		}
+	}
+
+	return writeSyncReplyChunk(out, &buf)
+}
+
+// loads the objects for the given ids, calling fn for each of them
+func loadSyncObjects(ctx context.Context, store storage.Store, ids []data.ObjectID, fn func(obj *data.WebHookObject)) error {
+	objects, errs := store.Objects(ctx, ids)
+
+	for objects != nil {
+		select {
+		case obj, ok := <-objects:
+			if !ok {
+				objects = nil
+				break
+			}
+			fn(obj)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return storage.DrainErrors(errs)
+}
+
+func writeSyncReplyChunk(out io.Writer, buf *bytes.Buffer) error {
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if f, ok := out.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// keeps the master ids which are within the time span of the slave id being checked
+// master ids are read from the request only when they are needed
+type syncIdWindow struct {
+	req     *SyncRequestReader
+	maxDiff int64
+	ids     []data.ObjectID
+	isEOF   bool
+}
+
+func newSyncIdWindow(req *SyncRequestReader, maxTimeSpan time.Duration) *syncIdWindow {
+	return &syncIdWindow{
+		req:     req,
+		maxDiff: int64(maxTimeSpan.Seconds()),
+		ids:     make([]data.ObjectID, 0),
+	}
+}
+
+// checks whether master has an id with the same hash as slaveId within the allowed time span
+// slave ids need to be checked in timestamp order
+// a matching master id is removed from the window - each master record accounts for a single slave record
+func (w *syncIdWindow) Match(slaveId data.ObjectID) (bool, error) {
+	slaveCreatedAt := slaveId.Timestamp().Unix()
+	minTs := slaveCreatedAt - w.maxDiff
+	maxTs := slaveCreatedAt + w.maxDiff
+
+	// read master ids until we're past the time span of this slave id
+	for !w.isEOF && (len(w.ids) == 0 || w.ids[len(w.ids)-1].Timestamp().Unix() <= maxTs) {
+		id, err := w.req.Next()
+		if err == io.EOF {
+			w.isEOF = true
+		} else if err != nil {
+			return false, err
+		} else {
+			w.ids = append(w.ids, id)
+		}
+	}
+
+	// the following slave ids won't be older than this one, so master ids before minTs are no longer needed
+	start := 0
+	for start < len(w.ids) && w.ids[start].Timestamp().Unix() < minTs {
+		start += 1
+	}
+	w.ids = w.ids[start:]
+
+	for i, masterId := range w.ids {
+		if masterId.Timestamp().Unix() > maxTs {
+			break
+		}
+		if masterId.Hash() == slaveId.Hash() {
+			w.ids = append(w.ids[:i], w.ids[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,213 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+func TestReplyToSync(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+
+	slaveObjects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second*10), 2), JsonData: []byte(`{"a":2}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Minute*3), 3), JsonData: []byte(`{"a":3}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Minute*4), 4), JsonData: []byte(`{"a":4}`)},
+	}
+	slaveStore := storage.NewMemoryStore()
+	assert.NoError(t, slaveStore.Put(ctx, slaveObjects))
+
+	req, err := json.Marshal(&MasterSyncRequestData{
+		HashAlgorithm:   CurrentHashAlgorithm,
+		SlaveRangeStart: int(now.Unix()),
+		SlaveRangeEnd:   int(now.Add(time.Minute * 5).Unix()),
+		MasterIds: SyncIdList{
+			data.NewObjectIdFromTimestamp(now.Add(time.Second*30), 1), // within the time span of the first slave object
+			data.NewObjectIdFromTimestamp(now.Add(time.Minute), 3),    // too far from the third one
+			data.NewObjectIdFromTimestamp(now.Add(time.Minute*4), 4),
+		},
+	})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, ReplyToSync(ctx, bytes.NewReader(req), &out, slaveStore))
+
+	received := make([]*data.WebHookObject, 0)
+	assert.NoError(t, ReadSyncReply(&out, func(obj *data.WebHookObject) error {
+		received = append(received, obj)
+		return nil
+	}))
+	assert.Len(t, received, 2)
+	for i, expected := range []*data.WebHookObject{slaveObjects[1], slaveObjects[2]} {
+		assert.Equal(t, expected.ID, received[i].ID)
+		assert.JSONEq(t, string(expected.JsonData), string(received[i].JsonData))
+	}
+
+	// the store fails midway through the sync - the reply is not marked as done
+	slaveStore.FailAfter = len(slaveObjects) + 2
+	out.Reset()
+	assert.Equal(t, storage.MemoryStoreFaultError, ReplyToSync(ctx, bytes.NewReader(req), &out, slaveStore))
+	assert.Equal(t, io.ErrUnexpectedEOF, ReadSyncReply(&out, func(obj *data.WebHookObject) error {
+		return nil
+	}))
+}
+
+func TestReplyToSourceSync(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+
+	stores := map[string]*storage.MemoryStore{
+		storage.DefaultSource: storage.NewMemoryStore(),
+		"orders":              storage.NewMemoryStore(),
+	}
+	assert.NoError(t, stores[storage.DefaultSource].Put(ctx, []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":1}`)},
+	}))
+	assert.NoError(t, stores["orders"].Put(ctx, []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 2), JsonData: []byte(`{"order":2}`)},
+	}))
+	resolve := func(source string) (storage.Store, error) {
+		if store, ok := stores[source]; ok {
+			return store, nil
+		}
+		return nil, fmt.Errorf("unknown source %s", source)
+	}
+
+	for source, expected := range map[string]uint32{"": 1, storage.DefaultSource: 1, "orders": 2} {
+		req, err := json.Marshal(&MasterSyncRequestData{
+			Source:          source,
+			SlaveRangeStart: int(now.Unix()),
+			SlaveRangeEnd:   int(now.Add(time.Minute).Unix()),
+		})
+		assert.NoError(t, err)
+
+		var out bytes.Buffer
+		assert.NoError(t, ReplyToSourceSync(ctx, bytes.NewReader(req), &out, resolve))
+		received := make([]*data.WebHookObject, 0)
+		assert.NoError(t, ReadSyncReply(&out, func(obj *data.WebHookObject) error {
+			received = append(received, obj)
+			return nil
+		}))
+		if assert.Len(t, received, 1, source) {
+			assert.Equal(t, expected, received[0].ID.Hash(), source)
+		}
+	}
+
+	req, err := json.Marshal(&MasterSyncRequestData{
+		Source:          "unknown",
+		SlaveRangeStart: int(now.Unix()),
+		SlaveRangeEnd:   int(now.Add(time.Minute).Unix()),
+	})
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	assert.Error(t, ReplyToSourceSync(ctx, bytes.NewReader(req), &out, resolve))
+	assert.Zero(t, out.Len())
+
+	// a single store only serves the default source
+	assert.Error(t, ReplyToSync(ctx, bytes.NewReader(req), &out, stores["orders"]))
+}
+
+func TestReplyToSyncOriginalPayload(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+
+	obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":"1"}`), RawData: []byte("<a>1</a>"), ContentType: "text/xml; charset=utf-8", HashAlgorithm: string(CurrentHashAlgorithm)}
+	obj.Metadata = &data.WebHookMetadata{Method: "POST", RemoteAddr: "203.0.113.7", Headers: map[string][]string{"User-Agent": {"sender"}}, ReceivedAt: now.Add(123).UTC()}
+	slaveStore := storage.NewMemoryStore()
+	assert.NoError(t, slaveStore.Put(ctx, []*data.WebHookObject{obj}))
+
+	req, err := json.Marshal(&MasterSyncRequestData{SlaveRangeStart: int(now.Unix()), SlaveRangeEnd: int(now.Add(time.Minute).Unix())})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, ReplyToSync(ctx, bytes.NewReader(req), &out, slaveStore))
+	received := make([]*data.WebHookObject, 0)
+	assert.NoError(t, ReadSyncReply(&out, func(obj *data.WebHookObject) error {
+		received = append(received, obj)
+		return nil
+	}))
+	assert.Len(t, received, 1)
+	assert.Equal(t, obj.RawData, received[0].RawData)
+	assert.Equal(t, obj.ContentType, received[0].ContentType)
+	assert.Equal(t, obj.Metadata, received[0].Metadata)
+	assert.Equal(t, obj.HashAlgorithm, received[0].HashAlgorithm)
+}
+
+func TestReplyToSyncHashAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(time.Now().Unix(), 0)
+
+	newObject := func(ts time.Time, jsonData string, algorithm HashAlgorithm) *data.WebHookObject {
+		hash, err := WebHookHash(algorithm, []byte(jsonData))
+		assert.NoError(t, err)
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(ts, hash), JsonData: []byte(jsonData)}
+		if algorithm != HashAlgorithmConcat {
+			obj.HashAlgorithm = string(algorithm)
+		}
+		return obj
+	}
+	// saved before the slave was upgraded, then after it
+	legacy := newObject(now, `{"a":{"b":1}}`, HashAlgorithmConcat)
+	current := newObject(now.Add(time.Second*10), `{"a":[2]}`, CurrentHashAlgorithm)
+	slaveStore := storage.NewMemoryStore()
+	assert.NoError(t, slaveStore.Put(ctx, []*data.WebHookObject{legacy, current}))
+
+	sync := func(algorithm HashAlgorithm, masterIds SyncIdList) ([]data.ObjectID, error) {
+		req, err := json.Marshal(&MasterSyncRequestData{
+			HashAlgorithm:   algorithm,
+			SlaveRangeStart: int(now.Unix()),
+			SlaveRangeEnd:   int(now.Add(time.Minute).Unix()),
+			MasterIds:       masterIds,
+		})
+		assert.NoError(t, err)
+
+		var out bytes.Buffer
+		if err = ReplyToSync(ctx, bytes.NewReader(req), &out, slaveStore); err != nil {
+			assert.Zero(t, out.Len(), "nothing is written for a rejected request")
+			return nil, err
+		}
+		received := make([]data.ObjectID, 0)
+		assert.NoError(t, ReadSyncReply(&out, func(obj *data.WebHookObject) error {
+			received = append(received, obj.ID)
+			return nil
+		}))
+		return received, nil
+	}
+
+	// a master which wasn't upgraded hashes both objects with the legacy algorithm
+	concatIds := SyncIdList{
+		newObject(now.Add(time.Second*5), string(legacy.JsonData), HashAlgorithmConcat).ID,
+		newObject(now.Add(time.Second*15), string(current.JsonData), HashAlgorithmConcat).ID,
+	}
+	received, err := sync(HashAlgorithmConcat, concatIds)
+	assert.NoError(t, err)
+	assert.Empty(t, received, "objects are hashed again with the master's algorithm")
+
+	received, err = sync(HashAlgorithmConcat, concatIds[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{current.ID}, received, "the slave id is sent back, not the rehashed one")
+
+	received, err = sync("", concatIds)
+	assert.NoError(t, err)
+	assert.Empty(t, received, "masters which don't send the algorithm hash with the legacy one")
+
+	// an upgraded master matches the ids as they are - legacy objects are reconciled by master
+	received, err = sync(CurrentHashAlgorithm, SyncIdList{
+		newObject(now.Add(time.Second*5), string(legacy.JsonData), CurrentHashAlgorithm).ID,
+		newObject(now.Add(time.Second*15), string(current.JsonData), CurrentHashAlgorithm).ID,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{legacy.ID}, received)
+
+	_, err = sync("crc32c-unknown-v9", concatIds)
+	assert.EqualError(t, err, "unsupported hash algorithm crc32c-unknown-v9")
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"webhooks/common/data"
+)
+
+var unsortedSyncReplyError = errors.New("slave reply is not sorted by timestamp")
+
+// reads the objects sent back by a slave in reply to a sync request
+// the reply is a sequence of newline delimited {id, data} json objects, sorted by their timestamp and ended by {done:true}
+// fn is called for each object as soon as it was read, so whatever was received before an error is still handled
+// the ids are the ones assigned by the slave, they are never recomputed
+// returns io.ErrUnexpectedEOF if the reply ended before the slave marked it as done
+func ReadSyncReply(in io.Reader, fn func(obj *data.WebHookObject) error) error {
+	dec := json.NewDecoder(in)
+
+	var prev data.ObjectID
+
+	for {
+		item := SlaveSyncReplyItem{}
+		err := dec.Decode(&item)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		if item.Done {
+			return nil
+		}
+
+		if item.ID.IsZero() {
+			return fmt.Errorf("slave reply contains an object without id")
+		}
+		if len(item.Data) == 0 || item.Data[0] != '{' {
+			return fmt.Errorf("slave reply contains an object without a valid json payload %s", item.ID.Hex())
+		}
+		if item.ID.Timestamp().Before(prev.Timestamp()) {
+			return unsortedSyncReplyError
+		}
+		prev = item.ID
+
+		if err = fn(&data.WebHookObject{
+			ID:            item.ID,
+			JsonData:      item.Data,
+			RawData:       item.Raw,
+			ContentType:   item.ContentType,
+			Metadata:      item.Metadata,
+			HashAlgorithm: item.HashAlgorithm,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// write a json entry to the buffer
+// format is {id:objectId, data:original json data }
+// note that data is this time a json object, not a binary array
+// objects converted from another format also have raw:base64 original payload and content_type
+// objects received with their request metadata also have metadata
+// objects having their hash algorithm recorded also have hash_algorithm
+func writeSyncReplyItem(dest *bytes.Buffer, item *data.WebHookObject) {
+	dest.WriteString(DelimiterObjectStart.String())
+	dest.WriteString(fmt.Sprintf("\"id\":\"%s\",", item.ID.Hex()))
+	dest.WriteString("\"data\":")
+	dest.Write(item.JsonData) // this is a binary array
+	if len(item.RawData) > 0 {
+		contentType, _ := json.Marshal(item.ContentType)
+		dest.WriteString(fmt.Sprintf(",\"raw\":\"%s\",\"content_type\":%s", base64.StdEncoding.EncodeToString(item.RawData), contentType))
+	}
+	if item.Metadata != nil {
+		metadata, _ := json.Marshal(item.Metadata)
+		dest.WriteString(",\"metadata\":")
+		dest.Write(metadata)
+	}
+	if item.HashAlgorithm != "" {
+		dest.WriteString(fmt.Sprintf(",\"hash_algorithm\":%q", item.HashAlgorithm))
+	}
+	dest.WriteString(DelimiterObjectEnd.String())
+	dest.WriteByte('\n')
+}
+
+// marks the end of a complete reply
+func writeSyncReplyDone(dest *bytes.Buffer) {
+	dest.WriteString("{\"done\":true}\n")
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestReadSyncReply(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	ids := []data.ObjectID{
+		data.NewObjectIdFromTimestamp(now, 1),
+		data.NewObjectIdFromTimestamp(now.Add(time.Second), 2),
+		data.NewObjectIdFromTimestamp(now.Add(time.Second*2), 3),
+	}
+	line := func(id data.ObjectID, payload string) string {
+		return fmt.Sprintf("{\"id\":\"%s\",\"data\":%s}\n", id.Hex(), payload)
+	}
+	done := "{\"done\":true}\n"
+
+	cases := []struct {
+		name  string
+		reply string
+		read  int   // objects handed to fn before the reply ended
+		fails bool  // the reply is rejected
+		err   error // the exact error, when it's a known one
+	}{
+		{"complete", line(ids[0], `{"a":1}`) + line(ids[1], `{"a":2}`) + done, 2, false, nil},
+		{"empty", done, 0, false, nil},
+		{"no reply", "", 0, true, io.ErrUnexpectedEOF},
+		{"truncated without done", line(ids[0], `{"a":1}`) + line(ids[1], `{"a":2}`), 2, true, io.ErrUnexpectedEOF},
+		{"truncated mid line", line(ids[0], `{"a":1}`) + line(ids[1], `{"a":2}`)[:20], 1, true, io.ErrUnexpectedEOF},
+		{"malformed line mid stream", line(ids[0], `{"a":1}`) + "{\"id\":\n" + line(ids[2], `{"a":3}`) + done, 1, true, nil},
+		{"payload is not an object", line(ids[0], `{"a":1}`) + line(ids[1], `[1]`) + done, 1, true, nil},
+		{"unsorted", line(ids[1], `{"a":2}`) + line(ids[0], `{"a":1}`) + done, 1, true, unsortedSyncReplyError},
+	}
+
+	for _, c := range cases {
+		read := 0
+		err := ReadSyncReply(strings.NewReader(c.reply), func(obj *data.WebHookObject) error {
+			read++
+			return nil
+		})
+		if !c.fails {
+			assert.NoError(t, err, c.name)
+		} else if c.err != nil {
+			assert.Equal(t, c.err, err, c.name)
+		} else {
+			assert.Error(t, err, c.name)
+		}
+		assert.Equal(t, c.read, read, c.name)
+	}
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+const (
+	syncRequestKeySource        = "source"
+	syncRequestKeyHashAlgorithm = "hash_algorithm"
+	syncRequestKeyRangeStart    = "slave_range_start"
+	syncRequestKeyRangeEnd      = "slave_range_end"
+	syncRequestKeyMasterIds     = "master_ids"
+
+	// number of ids written before the request stream is flushed
+	syncRequestFlushSize = 1000
+)
+
+var unsortedSyncRequestError = errors.New("master ids are not sorted by timestamp")
+
+// a list of ids encoded as a flat json array of numbers - [timestamp1, hash1, ..., timestampN, hashN]
+type SyncIdList []data.ObjectID
+
+func (l SyncIdList) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(DelimiterArrayStart.String())
+	for i, id := range l {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeSyncId(&buf, id)
+	}
+	buf.WriteString(DelimiterArrayEnd.String())
+	return buf.Bytes(), nil
+}
+
+func (l *SyncIdList) UnmarshalJSON(b []byte) error {
+	values := make([]uint32, 0)
+	if err := json.Unmarshal(b, &values); err != nil {
+		return err
+	}
+	if len(values)%2 != 0 {
+		return fmt.Errorf("expected timestamp, hash pairs but got %d values", len(values))
+	}
+	res := make(SyncIdList, len(values)/2)
+	for i := 0; i < len(res); i++ {
+		res[i] = data.NewObjectIdFromTimestamp(time.Unix(int64(values[2*i]), 0), values[2*i+1])
+	}
+	*l = res
+	return nil
+}
+
+func writeSyncId(dest *bytes.Buffer, id data.ObjectID) {
+	dest.WriteString(strconv.FormatInt(id.Timestamp().Unix(), 10))
+	dest.WriteByte(',')
+	dest.WriteString(strconv.FormatUint(uint64(id.Hash()), 10))
+}
+
+// streams a sync request to out - the ids are written as soon as they are read from idsChan
+// the ids need to be sorted by timestamp, the output has the same format as a marshalled MasterSyncRequestData
+// the ids are the ones of the given source, the slave replies with the objects of the same source
+// the request tells the slave that master hashes with CurrentHashAlgorithm
+func WriteSyncRequest(ctx context.Context, out io.Writer, source string, rangeStart, rangeEnd time.Time, idsChan <-chan data.ObjectID, errChan <-chan error) error {
+	w := bufio.NewWriter(out)
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	if source != "" {
+		sourceJson, err := json.Marshal(source)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(fmt.Sprintf("%q:%s,", syncRequestKeySource, sourceJson))
+	}
+	buf.WriteString(fmt.Sprintf("%q:%q,%q:%d,%q:%d,%q:[",
+		syncRequestKeyHashAlgorithm, CurrentHashAlgorithm,
+		syncRequestKeyRangeStart, rangeStart.Unix(),
+		syncRequestKeyRangeEnd, rangeEnd.Unix(),
+		syncRequestKeyMasterIds,
+	))
+
+	var prev data.ObjectID
+	count := 0
+
+	for idsChan != nil {
+		select {
+		case id, ok := <-idsChan:
+			if !ok {
+				idsChan = nil
+				break
+			}
+			if id.Timestamp().Before(prev.Timestamp()) {
+				return unsortedSyncRequestError
+			}
+			prev = id
+
+			if count > 0 {
+				buf.WriteByte(',')
+			}
+			writeSyncId(&buf, id)
+			count += 1
+
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+
+			if count%syncRequestFlushSize == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := storage.DrainErrors(errChan); err != nil {
+		return err
+	}
+
+	buf.WriteString("]}")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// reads a sync request as it comes in
+// the source and range fields are read when it's created, master ids are then read one by one using Next
+type SyncRequestReader struct {
+	// empty for the default source
+	Source string
+	// the algorithm master hashes with, HashAlgorithmConcat for masters which don't send it
+	HashAlgorithm HashAlgorithm
+	RangeStart    time.Time
+	RangeEnd      time.Time
+
+	dec     *json.Decoder
+	prev    data.ObjectID
+	hasMore bool
+}
+
+func NewSyncRequestReader(in io.Reader) (*SyncRequestReader, error) {
+	r := &SyncRequestReader{
+		HashAlgorithm: HashAlgorithmConcat,
+		dec:           json.NewDecoder(in),
+	}
+	if err := r.readHeader(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reads everything up to the start of the master ids array
+// the source, hash algorithm and range fields need to be sent before the ids, otherwise we'd have to buffer all of them
+func (r *SyncRequestReader) readHeader() error {
+	if err := r.expectDelim(DelimiterObjectStart); err != nil {
+		return err
+	}
+
+	var hasStart, hasEnd bool
+
+	for r.dec.More() {
+		tkn, err := r.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tkn.(string)
+		if !ok {
+			return malformedJsonError
+		}
+
+		switch key {
+		case syncRequestKeySource:
+			if err = r.dec.Decode(&r.Source); err != nil {
+				return err
+			}
+		case syncRequestKeyHashAlgorithm:
+			if err = r.dec.Decode(&r.HashAlgorithm); err != nil {
+				return err
+			}
+		case syncRequestKeyRangeStart, syncRequestKeyRangeEnd:
+			var ts int64
+			if err = r.dec.Decode(&ts); err != nil {
+				return err
+			}
+			if key == syncRequestKeyRangeStart {
+				r.RangeStart, hasStart = time.Unix(ts, 0), true
+			} else {
+				r.RangeEnd, hasEnd = time.Unix(ts, 0), true
+			}
+		case syncRequestKeyMasterIds:
+			if !hasStart || !hasEnd {
+				return fmt.Errorf("%s must be sent after %s and %s", syncRequestKeyMasterIds, syncRequestKeyRangeStart, syncRequestKeyRangeEnd)
+			}
+			tkn, err = r.dec.Token()
+			if err != nil {
+				return err
+			}
+			if tkn == nil {
+				continue
+			}
+			if delim, ok := tkn.(json.Delim); !ok || delim.String() != DelimiterArrayStart.String() {
+				return malformedJsonError
+			}
+			r.hasMore = true
+			return nil
+		default:
+			var skip json.RawMessage
+			if err = r.dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !hasStart || !hasEnd {
+		return fmt.Errorf("missing %s or %s", syncRequestKeyRangeStart, syncRequestKeyRangeEnd)
+	}
+
+	return r.expectDelim(DelimiterObjectEnd)
+}
+
+// returns the next master id, io.EOF once all of them were read
+func (r *SyncRequestReader) Next() (data.ObjectID, error) {
+	if !r.hasMore {
+		return data.ZeroObjectID, io.EOF
+	}
+
+	if !r.dec.More() {
+		r.hasMore = false
+		if err := r.expectDelim(DelimiterArrayEnd); err != nil {
+			return data.ZeroObjectID, err
+		}
+		return data.ZeroObjectID, io.EOF
+	}
+
+	var ts, hash uint32
+	if err := r.dec.Decode(&ts); err != nil {
+		return data.ZeroObjectID, err
+	}
+	if !r.dec.More() {
+		return data.ZeroObjectID, fmt.Errorf("missing hash for timestamp %d", ts)
+	}
+	if err := r.dec.Decode(&hash); err != nil {
+		return data.ZeroObjectID, err
+	}
+
+	id := data.NewObjectIdFromTimestamp(time.Unix(int64(ts), 0), hash)
+	if id.Timestamp().Before(r.prev.Timestamp()) {
+		return data.ZeroObjectID, unsortedSyncRequestError
+	}
+	r.prev = id
+
+	return id, nil
+}
+
+func (r *SyncRequestReader) expectDelim(expected *JsonDelimiter) error {
+	tkn, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tkn.(json.Delim); !ok || delim.String() != expected.String() {
+		return malformedJsonError
+	}
+	return nil
+}
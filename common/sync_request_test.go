@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/data"
+)
+
+func TestWriteSyncRequest(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	ids := SyncIdList{
+		data.NewObjectIdFromTimestamp(now, 1),
+		data.NewObjectIdFromTimestamp(now, 2),
+		data.NewObjectIdFromTimestamp(now.Add(time.Second), 3),
+	}
+
+	idsChan := make(chan data.ObjectID, len(ids))
+	errChan := make(chan error)
+	for _, id := range ids {
+		idsChan <- id
+	}
+	close(idsChan)
+	close(errChan)
+
+	var buf bytes.Buffer
+	err := WriteSyncRequest(context.Background(), &buf, "orders", now.Add(-time.Minute), now, idsChan, errChan)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(&MasterSyncRequestData{
+		Source:          "orders",
+		HashAlgorithm:   CurrentHashAlgorithm,
+		SlaveRangeStart: int(now.Add(-time.Minute).Unix()),
+		SlaveRangeEnd:   int(now.Unix()),
+		MasterIds:       ids,
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), buf.String())
+
+	reqData := MasterSyncRequestData{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &reqData))
+	assert.Equal(t, ids, reqData.MasterIds)
+
+	r, err := NewSyncRequestReader(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "orders", r.Source)
+	assert.Equal(t, CurrentHashAlgorithm, r.HashAlgorithm)
+	assert.Equal(t, now.Add(-time.Minute), r.RangeStart)
+	assert.Equal(t, now, r.RangeEnd)
+
+	for _, id := range ids {
+		next, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, id, next)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSyncRequestReader(t *testing.T) {
+	_, err := NewSyncRequestReader(strings.NewReader(`{"master_ids":[1,2],"slave_range_start":1,"slave_range_end":2}`))
+	assert.Error(t, err, "ids sent before the range")
+
+	r, err := NewSyncRequestReader(strings.NewReader(`{"slave_range_start":1,"slave_range_end":2,"master_ids":null}`))
+	assert.NoError(t, err)
+	assert.Equal(t, HashAlgorithmConcat, r.HashAlgorithm, "masters which don't send the algorithm hash with the legacy one")
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	r, err = NewSyncRequestReader(strings.NewReader(`{"slave_range_start":1,"slave_range_end":2,"master_ids":[5,1,4,1]}`))
+	assert.NoError(t, err)
+	_, err = r.Next()
+	assert.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, unsortedSyncRequestError, err)
+}
+
+func TestSyncIdWindow(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	masterIds := SyncIdList{
+		data.NewObjectIdFromTimestamp(now, 1),
+		data.NewObjectIdFromTimestamp(now.Add(time.Second*30), 2),
+		data.NewObjectIdFromTimestamp(now.Add(time.Minute*5), 3),
+	}
+	payload, err := json.Marshal(&MasterSyncRequestData{MasterIds: masterIds})
+	assert.NoError(t, err)
+
+	r, err := NewSyncRequestReader(bytes.NewReader(payload))
+	assert.NoError(t, err)
+	w := newSyncIdWindow(r, SyncMaxTimeSpan)
+
+	cases := []struct {
+		id    data.ObjectID
+		found bool
+	}{
+		{data.NewObjectIdFromTimestamp(now.Add(time.Second*20), 1), true},
+		{data.NewObjectIdFromTimestamp(now.Add(time.Second*20), 1), false}, // already matched
+		{data.NewObjectIdFromTimestamp(now.Add(time.Minute*2), 2), false},  // outside the time span
+		{data.NewObjectIdFromTimestamp(now.Add(time.Minute*4), 3), true},
+		{data.NewObjectIdFromTimestamp(now.Add(time.Minute*10), 4), false},
+	}
+
+	for _, c := range cases {
+		found, err := w.Match(c.id)
+		assert.NoError(t, err)
+		assert.Equal(t, c.found, found, "unexpected match result for %s", c.id)
+	}
+}
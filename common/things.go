@@ -1,14 +1,41 @@
 package common
 
 import (
+	"encoding/json"
 	"github.com/sirupsen/logrus"
+	"time"
 	"webhooks/common/data"
 )
 
 var Logger *logrus.Logger = logrus.New()
 
+// two records having the same hash are considered identical if their timestamps are at most this far apart
+const SyncMaxTimeSpan = time.Minute
+
+// the json format of a sync request
+// MasterIds need to be sorted by timestamp, they are sent as [timestamp1, hash1, ..., timestampN, hashN]
+// big requests should be streamed with WriteSyncRequest, which produces the same json
+// an empty Source means the default source
 type MasterSyncRequestData struct {
-	SlaveRangeStart int             `json:"slave_range_start"`
-	SlaveRangeEnd   int             `json:"slave_range_end"`
-	MasterIds       []data.ObjectID `json:"master_ids"`
+	Source string `json:"source,omitempty"`
+	// the algorithm master hashes the objects it receives with, missing for masters hashing with HashAlgorithmConcat
+	HashAlgorithm   HashAlgorithm `json:"hash_algorithm,omitempty"`
+	SlaveRangeStart int           `json:"slave_range_start"`
+	SlaveRangeEnd   int           `json:"slave_range_end"`
+	MasterIds       SyncIdList    `json:"master_ids"`
+}
+
+// a single entry of the slave's reply to a sync request - an object which is missing from master
+// the last entry of a complete reply has only Done set
+// Raw and ContentType are set only for objects converted from another format
+type SlaveSyncReplyItem struct {
+	ID          data.ObjectID   `json:"id"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	Raw         []byte          `json:"raw,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	// the request which delivered the object, if the slave captured it
+	Metadata *data.WebHookMetadata `json:"metadata,omitempty"`
+	// the algorithm the id was hashed with, missing for objects hashed with HashAlgorithmConcat
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	Done          bool   `json:"done,omitempty"`
 }
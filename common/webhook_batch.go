@@ -0,0 +1,78 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"webhooks/common/data"
+)
+
+// one item of a webhook batch - Err is set instead of Object if the item isn't a valid webhook object
+type WebHookBatchItem struct {
+	Object *data.WebHookObject
+	Err    error
+}
+
+// reads a json array of webhook objects, each of them gets its own id
+// items which aren't objects are reported in their WebHookBatchItem, an array which isn't valid json fails the whole batch
+func ReadWebHookArray(in io.Reader) ([]*WebHookBatchItem, error) {
+	dec := json.NewDecoder(in)
+
+	t, err := dec.Token()
+	if err == io.EOF {
+		return nil, EmptyWebHookError
+	} else if err != nil {
+		return nil, err
+	}
+	if delim, ok := t.(json.Delim); !ok || delim.String() != DelimiterArrayStart.value {
+		return nil, malformedJsonError
+	}
+
+	items := make([]*WebHookBatchItem, 0)
+	for dec.More() {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		obj, err := ReadWebHookObject(bytes.NewReader(raw))
+		items = append(items, &WebHookBatchItem{Object: obj, Err: err})
+	}
+
+	if _, err = dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, malformedJsonError
+	}
+	if len(items) == 0 {
+		return nil, EmptyWebHookError
+	}
+	return items, nil
+}
+
+// reads newline delimited json objects, each of them gets its own id - blank lines are skipped
+// lines are independent of each other, so a malformed line is reported in its WebHookBatchItem
+func ReadWebHookNdjson(in io.Reader) ([]*WebHookBatchItem, error) {
+	r := bufio.NewReader(in)
+	items := make([]*WebHookBatchItem, 0)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			obj, objErr := ReadWebHookObject(bytes.NewReader(trimmed))
+			items = append(items, &WebHookBatchItem{Object: obj, Err: objErr})
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, EmptyWebHookError
+	}
+	return items, nil
+}
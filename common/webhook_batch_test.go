@@ -0,0 +1,35 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestReadWebHookArray(t *testing.T) {
+	items, err := ReadWebHookArray(strings.NewReader(`[{"a":1}, 2, {"b":{"c":[1,2]}}]`))
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.JSONEq(t, `{"a":1}`, string(items[0].Object.JsonData))
+	assert.Equal(t, NonObjectWebHookError, items[1].Err)
+	assert.Nil(t, items[1].Object)
+	assert.JSONEq(t, `{"b":{"c":[1,2]}}`, string(items[2].Object.JsonData))
+	assert.NotEqual(t, items[0].Object.ID.Hash(), items[2].Object.ID.Hash())
+
+	for _, payload := range []string{``, `[]`, `{"a":1}`, `[{"a":1}`, `[{"a":1}]]`} {
+		_, err = ReadWebHookArray(strings.NewReader(payload))
+		assert.Error(t, err, payload)
+	}
+}
+
+func TestReadWebHookNdjson(t *testing.T) {
+	items, err := ReadWebHookNdjson(strings.NewReader("{\"a\":1}\r\n\n  \n{\"a\":\n{\"a\":2}"))
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.JSONEq(t, `{"a":1}`, string(items[0].Object.JsonData))
+	assert.Error(t, items[1].Err)
+	assert.JSONEq(t, `{"a":2}`, string(items[2].Object.JsonData))
+
+	_, err = ReadWebHookNdjson(strings.NewReader("\n\n"))
+	assert.Equal(t, EmptyWebHookError, err)
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"webhooks/common/data"
+)
+
+var malformedXmlError = errors.New("invalid xml")
+
+// reads an application/x-www-form-urlencoded payload as a json object of strings, repeated keys become arrays of strings
+// the object keeps the original payload in RawData
+func ReadFormWebHookObject(in io.Reader) (*data.WebHookObject, error) {
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, EmptyWebHookError
+	}
+
+	values, err := url.ParseQuery(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if len(v) == 1 {
+			res[k] = v[0]
+		} else {
+			res[k] = v
+		}
+	}
+	return convertedWebHookObject(res, raw)
+}
+
+// reads an xml document as a json object holding its root element - {"root": {...}}
+// attributes become "@name" keys, repeated child elements become arrays and the text of elements which also have
+// attributes or children goes in "#text" - namespace prefixes and declarations are dropped
+// the object keeps the original payload in RawData
+func ReadXmlWebHookObject(in io.Reader) (*data.WebHookObject, error) {
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := readXmlTree(xml.NewDecoder(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, err
+	}
+	return convertedWebHookObject(map[string]interface{}{root.name: root.value()}, raw)
+}
+
+// hashes the converted json exactly like a json payload, so the same data gets the same hash whatever its format
+func convertedWebHookObject(converted map[string]interface{}, raw []byte) (*data.WebHookObject, error) {
+	jsonData, err := json.Marshal(converted)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := ReadWebHookObject(bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	obj.RawData = raw
+	return obj, nil
+}
+
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     strings.Builder
+}
+
+func readXmlTree(dec *xml.Decoder) (*xmlNode, error) {
+	var root *xmlNode
+	stack := make([]*xmlNode, 0)
+
+	for {
+		tkn, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tkn.(type) {
+		case xml.StartElement:
+			if root != nil && len(stack) == 0 {
+				// a document has a single root element
+				return nil, malformedXmlError
+			}
+			node := &xmlNode{name: t.Name.Local, attrs: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, malformedXmlError
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, EmptyWebHookError
+	}
+	return root, nil
+}
+
+// the json value of an element - a string if it has only text, an object otherwise
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+
+	res := make(map[string]interface{})
+	for _, attr := range n.attrs {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		res["@"+attr.Name.Local] = attr.Value
+	}
+	if len(res) == 0 && len(n.children) == 0 {
+		return text
+	}
+
+	for _, child := range n.children {
+		value := child.value()
+		switch existing := res[child.name].(type) {
+		case nil:
+			res[child.name] = value
+		case []interface{}:
+			res[child.name] = append(existing, value)
+		default:
+			res[child.name] = []interface{}{existing, value}
+		}
+	}
+	if text != "" {
+		res["#text"] = text
+	}
+	return res
+}
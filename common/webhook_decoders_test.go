@@ -0,0 +1,51 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestReadFormWebHookObject(t *testing.T) {
+	payload := "From=%2B15551234567&Body=hi+there&MediaUrl=a&MediaUrl=b"
+	obj, err := ReadFormWebHookObject(strings.NewReader(payload))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"From":"+15551234567","Body":"hi there","MediaUrl":["a","b"]}`, string(obj.JsonData))
+	assert.Equal(t, payload, string(obj.RawData))
+
+	same, err := ReadWebHookObject(strings.NewReader(`{"MediaUrl":["a","b"],"From":"+15551234567","Body":"hi there"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, same.ID.Hash(), obj.ID.Hash(), "the same data has the same hash whatever its format")
+
+	_, err = ReadFormWebHookObject(strings.NewReader(" "))
+	assert.Equal(t, EmptyWebHookError, err)
+	_, err = ReadFormWebHookObject(strings.NewReader("a=%zz"))
+	assert.Error(t, err)
+}
+
+func TestReadXmlWebHookObject(t *testing.T) {
+	payload := `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+	<soap:Body>
+		<Payment id="7" currency="EUR">12.50</Payment>
+		<Item>a</Item>
+		<Item>b</Item>
+		<Note/>
+	</soap:Body>
+</soap:Envelope>`
+	obj, err := ReadXmlWebHookObject(strings.NewReader(payload))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Envelope":{"Body":{
+		"Payment":{"@id":"7","@currency":"EUR","#text":"12.50"},
+		"Item":["a","b"],
+		"Note":""
+	}}}`, string(obj.JsonData))
+	assert.Equal(t, payload, string(obj.RawData))
+
+	for _, invalid := range []string{`<a>`, `<a></b>`, `<a/><b/>`, `text<a/>`, `{"a":1}`} {
+		_, err = ReadXmlWebHookObject(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+	_, err = ReadXmlWebHookObject(strings.NewReader(`<?xml version="1.0"?>`))
+	assert.Equal(t, EmptyWebHookError, err)
+}
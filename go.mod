@@ -4,7 +4,7 @@ go 1.13
 
 require (
 	github.com/apex/gateway v1.1.1
-	github.com/aws/aws-lambda-go v1.13.3 // indirect
+	github.com/aws/aws-lambda-go v1.13.3
 	github.com/aws/aws-sdk-go v1.28.12
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.4.2
@@ -3,82 +3,98 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"github.com/apex/gateway"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/lambda"
 	"log"
 	"net/http"
-	"time"
+	"os"
+	"sync"
 	"webhooks/common"
 	"webhooks/common/app"
 	"webhooks/common/storage"
 )
 
-var App *app.App
+var (
+	App         *app.App
+	Checkpoints storage.CheckpointStore
+	Slaves      []*SlaveConfig
+)
 
 func init() {
 	App = app.AppInitStrict(app.StorageTypeDynamoDb)
-}
-
-func main() {
-	http.HandleFunc("/webhook", App.CreateWebHookHttpHandler())
-	http.HandleFunc("/trigger_sync", performSyncHandler)
-	log.Fatal(gateway.ListenAndServe(":3000", nil))
-}
 
-func performSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if path := os.Getenv("CHECKPOINT_FILE"); path != "" {
+		Checkpoints = storage.NewFileCheckpointStore(path)
+	} else {
+		Checkpoints = storage.NewDynamoDbCheckpointStore(App.Session, os.Getenv("DYNAMO_TABLE"))
+	}
 
-	err := performSync(r.Context())
+	slaves, err := LoadSlaveRegistry(App.Session)
 	if err != nil {
-		common.Logger.WithError(err).Error("sync failed")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		panic(err)
 	}
-
-	w.WriteHeader(http.StatusOK)
-
+	Slaves = slaves
 }
 
-func performSync(ctx context.Context) error {
-
-	now := time.Now()
-
-	existingIds, err := storage.LoadStorageKeysSync(ctx, App.Store, now.Add(time.Minute*-5), now.Add(time.Minute*-1))
-
-	if err != nil {
-		return err
+func main() {
+	http.HandleFunc("/webhook", App.CreateWebHookHttpHandler())
+	http.HandleFunc("/webhook/", App.CreateWebHookHttpHandler())
+	http.HandleFunc("/trigger_sync", performSyncHandler)
+	http.HandleFunc("/rewind_sync", rewindSyncHandler)
+	go func() {
+		if err := App.ListenAndServe(nil); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := app.WaitForShutdownSignal()
+	common.Logger.Infof("received %v, saving the buffered webhooks", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout)
+	defer cancel()
+	if err := App.Shutdown(ctx); err != nil {
+		common.Logger.WithError(err).Error("couldn't save all buffered webhooks")
+		os.Exit(1)
 	}
+}
 
-	syncReqData := &common.MasterSyncRequestData{
-		SlaveRangeStart: int(now.Add(time.Minute * -5).Unix()),
-		SlaveRangeEnd:   int(now.Add(time.Minute * -1).Unix()),
-		MasterIds:       existingIds,
-	}
+// syncs with all slaves and replies with the outcome for each of them
+func performSyncHandler(w http.ResponseWriter, r *http.Request) {
 
-	jsonData, err := json.Marshal(syncReqData)
-	if err != nil {
-		return err
-	}
+	results := performSync(r.Context())
 
-	input := &lambda.InvokeInput{
-		FunctionName:   aws.String("slave-diff"),
-		InvocationType: aws.String("RequestResponse"),
-		LogType:        aws.String("Tail"),
-		Payload:        jsonData,
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			common.Logger.WithField("slave", res.Slave).WithField("source", res.Source).Errorf("sync failed: %s", res.Error)
+			status = http.StatusInternalServerError
+		}
 	}
 
-	svc := lambda.New(App.Session)
-
-	result, err := svc.Invoke(input)
-	if err != nil {
-		return err
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		common.Logger.WithError(err).Error("couldn't write sync results")
 	}
+}
 
-	if *result.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code %v", *result.StatusCode)
+// syncs every source with all slaves at the same time
+// objects of a source reported by more than one slave are saved only once
+// the results are grouped by source, in the order of the slaves
+func performSync(ctx context.Context) []*SlaveSyncResult {
+	sources := App.SourceNames()
+	results := make([]*SlaveSyncResult, len(Slaves)*len(sources))
+
+	var wg sync.WaitGroup
+	for s, source := range sources {
+		synced := newSyncedIdSet()
+		for i, slave := range Slaves {
+			wg.Add(1)
+			go func(i int, slave *SlaveConfig, source string, synced *syncedIdSet) {
+				defer wg.Done()
+				results[i] = syncSlave(ctx, slave, source, synced)
+			}(s*len(Slaves)+i, slave, source, synced)
+		}
 	}
+	wg.Wait()
 
-	panic("TODO")
-
+	return results
 }
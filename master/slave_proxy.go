@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+)
+
+// the path the slave serves sync requests on
+const slaveSyncPath = "/master_sync"
+
+// the slave lambda is served through api gateway, so the sync request is sent as an api gateway proxy event
+func newSlaveSyncEvent(body []byte) ([]byte, error) {
+	return json.Marshal(&events.APIGatewayProxyRequest{
+		Path:       slaveSyncPath,
+		HTTPMethod: http.MethodPost,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	})
+}
+
+// reads the sync reply out of the api gateway proxy response the slave lambda returned
+func slaveSyncReplyBody(payload []byte) ([]byte, error) {
+	resp := events.APIGatewayProxyResponse{}
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected slave status code %v", resp.StatusCode)
+	}
+
+	if resp.IsBase64Encoded {
+		return base64.StdEncoding.DecodeString(resp.Body)
+	}
+	return []byte(resp.Body), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestSlaveSyncEvent(t *testing.T) {
+	payload, err := newSlaveSyncEvent([]byte(`{"rangeStart":1}`))
+	assert.NoError(t, err)
+
+	event := events.APIGatewayProxyRequest{}
+	assert.NoError(t, json.Unmarshal(payload, &event))
+	assert.Equal(t, slaveSyncPath, event.Path)
+	assert.Equal(t, http.MethodPost, event.HTTPMethod)
+	assert.Equal(t, `{"rangeStart":1}`, event.Body)
+}
+
+func TestSlaveSyncReplyBody(t *testing.T) {
+	reply := "{\"id\":\"0000000100000002\",\"data\":{}}\n"
+	for _, resp := range []events.APIGatewayProxyResponse{
+		{StatusCode: http.StatusOK, Body: reply},
+		{StatusCode: http.StatusOK, Body: base64.StdEncoding.EncodeToString([]byte(reply)), IsBase64Encoded: true},
+	} {
+		payload, err := json.Marshal(&resp)
+		assert.NoError(t, err)
+		body, err := slaveSyncReplyBody(payload)
+		assert.NoError(t, err)
+		assert.Equal(t, reply, string(body))
+	}
+
+	payload, _ := json.Marshal(&events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError})
+	_, err := slaveSyncReplyBody(payload)
+	assert.Error(t, err)
+	_, err = slaveSyncReplyBody([]byte("not json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	SlaveTransportLambda = "lambda"
+	SlaveTransportHttp   = "http"
+
+	defaultSlaveFunctionName = "slave-master-sync"
+)
+
+// describes how the master reaches a slave
+type SlaveConfig struct {
+	Name      string `json:"name"` // identifies the slave, used for its sync checkpoint
+	Transport string `json:"transport"`
+	Function  string `json:"function,omitempty"` // lambda function name
+	Url       string `json:"url,omitempty"`      // base url of the slave's http server
+
+	transport SyncTransport
+}
+
+func (c *SlaveConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("slave name is required")
+	}
+	switch c.Transport {
+	case SlaveTransportLambda:
+		if c.Function == "" {
+			return fmt.Errorf("slave %s: function is required for the %s transport", c.Name, c.Transport)
+		}
+	case SlaveTransportHttp:
+		if c.Url == "" {
+			return fmt.Errorf("slave %s: url is required for the %s transport", c.Name, c.Transport)
+		}
+	default:
+		return fmt.Errorf("slave %s: unknown transport %q", c.Name, c.Transport)
+	}
+	return nil
+}
+
+func (c *SlaveConfig) initTransport(awsSession *session.Session) {
+	switch c.Transport {
+	case SlaveTransportLambda:
+		c.transport = NewLambdaSyncTransport(awsSession, c.Function)
+	case SlaveTransportHttp:
+		c.transport = NewHttpSyncTransport(http.DefaultClient, c.Url)
+	}
+}
+
+// the configured slave with the given name, nil if there's none
+func findSlave(name string) *SlaveConfig {
+	for _, slave := range Slaves {
+		if slave.Name == name {
+			return slave
+		}
+	}
+	return nil
+}
+
+// loads the slaves the master syncs with
+//   - from the json file SLAVES_CONFIG points to - [{name, transport, function|url}]
+//   - otherwise from SLAVE_FUNCTIONS, a comma separated list of lambda function names
+func LoadSlaveRegistry(awsSession *session.Session) ([]*SlaveConfig, error) {
+	var slaves []*SlaveConfig
+
+	if path := os.Getenv("SLAVES_CONFIG"); path != "" {
+		jsonData, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(jsonData, &slaves); err != nil {
+			return nil, fmt.Errorf("invalid slaves config %s: %v", path, err)
+		}
+	} else {
+		functions := os.Getenv("SLAVE_FUNCTIONS")
+		if functions == "" {
+			functions = defaultSlaveFunctionName
+		}
+		for _, fn := range strings.Split(functions, ",") {
+			fn = strings.TrimSpace(fn)
+			if fn == "" {
+				continue
+			}
+			slaves = append(slaves, &SlaveConfig{
+				Name:      fn,
+				Transport: SlaveTransportLambda,
+				Function:  fn,
+			})
+		}
+	}
+
+	if len(slaves) == 0 {
+		return nil, errors.New("no slaves configured")
+	}
+
+	names := make(map[string]bool, len(slaves))
+	for _, slave := range slaves {
+		if err := slave.validate(); err != nil {
+			return nil, err
+		}
+		if names[slave.Name] {
+			return nil, fmt.Errorf("duplicate slave name %s", slave.Name)
+		}
+		names[slave.Name] = true
+		slave.initTransport(awsSession)
+	}
+
+	return slaves, nil
+}
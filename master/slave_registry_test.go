@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadSlaveRegistry(t *testing.T) {
+	defer os.Unsetenv("SLAVE_FUNCTIONS")
+	defer os.Unsetenv("SLAVES_CONFIG")
+
+	os.Setenv("SLAVE_FUNCTIONS", "eu-slave, us-slave")
+	slaves, err := LoadSlaveRegistry(nil)
+	assert.NoError(t, err)
+	assert.Len(t, slaves, 2)
+	for i, name := range []string{"eu-slave", "us-slave"} {
+		assert.Equal(t, name, slaves[i].Name)
+		assert.Equal(t, SlaveTransportLambda, slaves[i].Transport)
+		assert.Equal(t, name, slaves[i].Function)
+		assert.IsType(t, &lambdaSyncTransport{}, slaves[i].transport)
+	}
+
+	f, err := ioutil.TempFile("", "slaves")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[{"name":"a","transport":"lambda","function":"fn-a"},{"name":"a","transport":"http","url":"http://slave:3000"}]`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	os.Setenv("SLAVES_CONFIG", f.Name())
+	_, err = LoadSlaveRegistry(nil)
+	assert.Error(t, err, "duplicate slave names")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"webhooks/common"
+	"webhooks/common/app"
+)
+
+const (
+	// how far back the first sync of a slave goes
+	syncInitialLookBack = time.Minute * 5
+	// records newer than this might not have been flushed by the slave yet
+	syncMinAge = time.Minute
+	// each sync goes again over this much time before the checkpoint, the records master already has are matched and skipped
+	// slaves save a record up to a flush timeout (a minute by default) plus the flush retries (about 6 minutes with
+	// common.DefaultMaxFlushAttempts) after receiving it, so records saved behind the checkpoint are still synced
+	syncOverlap = time.Minute * 10
+	// max interval covered by a single sync - a master that was down catches up over multiple syncs
+	syncMaxWindow = time.Hour
+)
+
+// returns the interval the next sync should cover
+// sync(N).startTimestamp = sync(N-1).maxTimestamp - syncOverlap
+// ok is false if there's nothing to sync yet
+func nextSyncRange(now time.Time, checkpoint time.Time) (rangeStart time.Time, rangeEnd time.Time, ok bool) {
+	rangeEnd = now.Add(-syncMinAge)
+
+	if checkpoint.IsZero() {
+		rangeStart = now.Add(-syncInitialLookBack)
+	} else {
+		rangeStart = checkpoint.Add(-syncOverlap)
+	}
+
+	if rangeEnd.Sub(rangeStart) > syncMaxWindow {
+		rangeEnd = rangeStart.Add(syncMaxWindow)
+	}
+
+	return rangeStart, rangeEnd, rangeStart.Before(rangeEnd)
+}
+
+// checkpoints of the default source are saved under the slave name, as they were before sources existed
+func syncCheckpointKey(slave string, source string) string {
+	if source == "" || source == app.DefaultWebHookSource {
+		return slave
+	}
+	return slave + "/" + source
+}
+
+// moves back the sync checkpoint of a slave, so the next syncs will go over the same records again
+// expects the slave and timestamp(unix seconds) query params, source is optional and defaults to the default source
+func rewindSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	slave := r.URL.Query().Get("slave")
+	ts, err := strconv.ParseInt(r.URL.Query().Get("timestamp"), 10, 64)
+	if slave == "" || err != nil {
+		http.Error(w, "slave and timestamp are required", http.StatusBadRequest)
+		return
+	}
+	// a typo would save a checkpoint nothing ever reads
+	if findSlave(slave) == nil {
+		http.Error(w, fmt.Sprintf("unknown slave %s", slave), http.StatusNotFound)
+		return
+	}
+	rewindTo := time.Unix(ts, 0).UTC()
+	// a checkpoint in the future would skip the records received until then, even for a slave that was never synced
+	if rewindTo.After(time.Now()) {
+		http.Error(w, fmt.Sprintf("timestamp %d is in the future", ts), http.StatusBadRequest)
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	if _, ok := App.Source(source); source != "" && !ok {
+		http.Error(w, fmt.Sprintf("unknown source %s", source), http.StatusBadRequest)
+		return
+	}
+	key := syncCheckpointKey(slave, source)
+
+	checkpoint, err := Checkpoints.Load(r.Context(), key)
+	if err != nil {
+		common.Logger.WithError(err).Error("couldn't load sync checkpoint")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !checkpoint.IsZero() && rewindTo.After(checkpoint) {
+		http.Error(w, fmt.Sprintf("%s was synced only until %d", key, checkpoint.Unix()), http.StatusBadRequest)
+		return
+	}
+
+	if err = Checkpoints.Save(r.Context(), key, rewindTo); err != nil {
+		common.Logger.WithError(err).Error("couldn't save sync checkpoint")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	common.Logger.Infof("sync checkpoint for %s rewound from %d to %d", key, checkpoint.Unix(), rewindTo.Unix())
+	w.WriteHeader(http.StatusOK)
+}
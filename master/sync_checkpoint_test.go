@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webhooks/common/app"
+	"webhooks/common/storage"
+)
+
+func TestNextSyncRange(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+
+	start, end, ok := nextSyncRange(now, time.Time{})
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(-syncInitialLookBack), start)
+	assert.Equal(t, now.Add(-syncMinAge), end)
+
+	checkpoint := now.Add(-time.Minute * 3)
+	start, end, ok = nextSyncRange(now, checkpoint)
+	assert.True(t, ok)
+	assert.Equal(t, checkpoint.Add(-syncOverlap), start, "the records saved late by the slave are behind the checkpoint")
+	assert.Equal(t, now.Add(-syncMinAge), end)
+
+	checkpoint = now.Add(-time.Hour * 5)
+	start, end, ok = nextSyncRange(now, checkpoint)
+	assert.True(t, ok)
+	assert.Equal(t, checkpoint.Add(-syncOverlap), start)
+	assert.Equal(t, start.Add(syncMaxWindow), end, "catching up is done in bounded steps")
+
+	start, _, ok = nextSyncRange(now, now.Add(-syncMinAge))
+	assert.True(t, ok, "the overlap is synced again even if nothing is newer than the checkpoint")
+	assert.Equal(t, now.Add(-syncMinAge-syncOverlap), start)
+
+	_, _, ok = nextSyncRange(now, now.Add(syncOverlap))
+	assert.False(t, ok, "nothing to sync yet")
+}
+
+func TestRewindSyncHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	useMasterStores(map[string]storage.Store{app.DefaultWebHookSource: storage.NewMemoryStore()})
+	Checkpoints = storage.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	Slaves = []*SlaveConfig{{Name: "new"}, {Name: "synced"}}
+
+	now := time.Now()
+	rewind := func(slave string, ts time.Time) int {
+		w := httptest.NewRecorder()
+		rewindSyncHandler(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/rewind_sync?slave=%s&timestamp=%d", slave, ts.Unix()), nil))
+		return w.Code
+	}
+
+	// no checkpoint yet
+	assert.Equal(t, http.StatusBadRequest, rewind("new", now.Add(time.Hour)))
+	checkpoint, err := Checkpoints.Load(context.Background(), "new")
+	assert.NoError(t, err)
+	assert.True(t, checkpoint.IsZero())
+	assert.Equal(t, http.StatusOK, rewind("new", now.Add(-time.Hour)))
+
+	assert.NoError(t, Checkpoints.Save(context.Background(), "synced", now.Add(-time.Minute)))
+	assert.Equal(t, http.StatusBadRequest, rewind("synced", now.Add(time.Hour)))
+	assert.Equal(t, http.StatusBadRequest, rewind("synced", now.Add(-time.Second)), "past the checkpoint")
+	assert.Equal(t, http.StatusOK, rewind("synced", now.Add(-time.Hour)))
+	checkpoint, err = Checkpoints.Load(context.Background(), "synced")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), checkpoint.Unix())
+
+	assert.Equal(t, http.StatusNotFound, rewind("synced-typo", now.Add(-time.Hour)))
+	checkpoint, err = Checkpoints.Load(context.Background(), "synced-typo")
+	assert.NoError(t, err)
+	assert.True(t, checkpoint.IsZero(), "no checkpoint should be saved for an unknown slave")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+	"webhooks/common"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+// max number of objects received from a slave that are saved at once
+const syncPutBatchSize = 100
+
+// outcome of syncing the objects of a source with a single slave
+type SlaveSyncResult struct {
+	Slave       string `json:"slave"`
+	Source      string `json:"source"`
+	Synced      int    `json:"synced"`                 // number of objects saved in master
+	SyncedUntil int64  `json:"synced_until,omitempty"` // unix timestamp of the slave's checkpoint after the sync
+	Error       string `json:"error,omitempty"`
+}
+
+// asks the slave for the records of a source missing from master, starting from where the previous sync stopped
+func syncSlave(ctx context.Context, slave *SlaveConfig, source string, synced *syncedIdSet) *SlaveSyncResult {
+	res := &SlaveSyncResult{
+		Slave:  slave.Name,
+		Source: source,
+	}
+
+	store, err := App.SourceStore(source)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	checkpointKey := syncCheckpointKey(slave.Name, source)
+	checkpoint, err := Checkpoints.Load(ctx, checkpointKey)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if !checkpoint.IsZero() {
+		res.SyncedUntil = checkpoint.Unix()
+	}
+
+	rangeStart, rangeEnd, ok := nextSyncRange(time.Now(), checkpoint)
+	if !ok {
+		return res
+	}
+
+	reply, err := requestSlaveSync(ctx, slave, source, store, rangeStart, rangeEnd)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer reply.Close()
+
+	count, maxTimestamp, syncErr := persistSyncReply(ctx, reply, store, synced)
+	res.Synced = count
+	if syncErr == nil {
+		// everything up to the end of the range is now in master
+		maxTimestamp = rangeEnd
+	}
+
+	if maxTimestamp.After(checkpoint) {
+		if err = Checkpoints.Save(ctx, checkpointKey, maxTimestamp); err != nil {
+			common.Logger.WithError(err).Errorf("couldn't save the sync checkpoint for %s", checkpointKey)
+			if syncErr == nil {
+				syncErr = err
+			}
+		} else {
+			res.SyncedUntil = maxTimestamp.Unix()
+		}
+	}
+
+	if syncErr != nil {
+		res.Error = syncErr.Error()
+	}
+	return res
+}
+
+// streams the sync request to the slave and returns its reply
+// store holds the master records of the source
+func requestSlaveSync(ctx context.Context, slave *SlaveConfig, source string, store storage.Store, rangeStart, rangeEnd time.Time) (io.ReadCloser, error) {
+	// the slave matches records within SyncMaxTimeSpan, so it needs to know about the master records around the range too
+	idsChan, errChan := store.Keys(ctx, rangeStart.Add(-common.SyncMaxTimeSpan), rangeEnd.Add(common.SyncMaxTimeSpan))
+
+	reqReader, reqWriter := io.Pipe()
+	go func() {
+		reqWriter.CloseWithError(common.WriteSyncRequest(ctx, reqWriter, source, rangeStart, rangeEnd, idsChan, errChan))
+	}()
+
+	reply, err := slave.transport.Sync(ctx, reqReader)
+	if err != nil {
+		// unblocks the request writer in case the transport stopped reading
+		reqReader.CloseWithError(err)
+		return nil, err
+	}
+
+	return &syncReply{ReadCloser: reply, req: reqReader}, nil
+}
+
+// closes the request stream together with the reply
+type syncReply struct {
+	io.ReadCloser
+	req *io.PipeReader
+}
+
+func (r *syncReply) Close() error {
+	r.req.Close()
+	return r.ReadCloser.Close()
+}
+
+// reads the objects the slave replied with and saves them in batches
+// whatever was read before an error is still persisted
+// objects hashed with another algorithm which master already has are dropped, see dropRehashedDuplicates
+// returns the number of saved objects and the max timestamp among them
+func persistSyncReply(ctx context.Context, in io.Reader, store storage.Store, synced *syncedIdSet) (int, time.Time, error) {
+	pending := make([]*data.WebHookObject, 0, syncPutBatchSize)
+	var maxTimestamp time.Time
+	count := 0
+
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		objects, err := dropRehashedDuplicates(ctx, store, pending)
+		if err != nil {
+			return err
+		}
+		if len(objects) > 0 {
+			if err = store.Put(ctx, objects); err != nil {
+				return err
+			}
+		}
+		count += len(objects)
+		// the reply is sorted, so the last object has the max timestamp - dropped objects are already in master
+		maxTimestamp = pending[len(pending)-1].Timestamp()
+		pending = make([]*data.WebHookObject, 0, syncPutBatchSize)
+		return nil
+	}
+
+	readErr := common.ReadSyncReply(in, func(obj *data.WebHookObject) error {
+		if !synced.Claim(obj.ID) {
+			// another slave already sent this one
+			return nil
+		}
+		pending = append(pending, obj)
+		if len(pending) >= syncPutBatchSize {
+			return flush()
+		}
+		return nil
+	})
+
+	if err := flush(); err != nil {
+		return count, maxTimestamp, err
+	}
+
+	return count, maxTimestamp, readErr
+}
+
+// objects which weren't hashed with CurrentHashAlgorithm (sent by slaves which weren't upgraded, or saved before they were)
+// can't be matched by the slave against the master ids, so they are hashed again here
+// those having the same hash as a master id within SyncMaxTimeSpan are dropped, the others are saved with their original id
+// objects are sorted by timestamp, each master id accounts for a single object
+func dropRehashedDuplicates(ctx context.Context, store storage.Store, objects []*data.WebHookObject) ([]*data.WebHookObject, error) {
+	hashes := make(map[int]uint32)
+	var rangeStart, rangeEnd time.Time
+	for i, obj := range objects {
+		if common.ObjectHashAlgorithm(obj) == common.CurrentHashAlgorithm {
+			continue
+		}
+		hash, err := common.WebHookHash(common.CurrentHashAlgorithm, obj.JsonData)
+		if err != nil {
+			// it can't match anything master received, so it's kept
+			continue
+		}
+		if len(hashes) == 0 {
+			rangeStart = obj.Timestamp()
+		}
+		rangeEnd = obj.Timestamp()
+		hashes[i] = hash
+	}
+	if len(hashes) == 0 {
+		return objects, nil
+	}
+
+	masterIds, err := storage.LoadStorageKeysSync(ctx, store, rangeStart.Add(-common.SyncMaxTimeSpan), rangeEnd.Add(common.SyncMaxTimeSpan))
+	if err != nil {
+		return nil, err
+	}
+	byHash := make(map[uint32][]data.ObjectID)
+	for _, id := range masterIds {
+		byHash[id.Hash()] = append(byHash[id.Hash()], id)
+	}
+
+	res := make([]*data.WebHookObject, 0, len(objects))
+	for i, obj := range objects {
+		hash, ok := hashes[i]
+		if ok && claimMasterId(byHash, hash, obj.Timestamp()) {
+			continue
+		}
+		res = append(res, obj)
+	}
+	return res, nil
+}
+
+// removes from byHash the first master id having the given hash within SyncMaxTimeSpan of ts
+func claimMasterId(byHash map[uint32][]data.ObjectID, hash uint32, ts time.Time) bool {
+	ids := byHash[hash]
+	for i, id := range ids {
+		diff := id.Timestamp().Sub(ts)
+		if diff >= -common.SyncMaxTimeSpan && diff <= common.SyncMaxTimeSpan {
+			byHash[hash] = append(ids[:i], ids[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ids received during a sync - different slaves might reply with the same objects
+type syncedIdSet struct {
+	mux sync.Mutex
+	ids map[data.ObjectID]struct{}
+}
+
+func newSyncedIdSet() *syncedIdSet {
+	return &syncedIdSet{
+		ids: make(map[data.ObjectID]struct{}),
+	}
+}
+
+// returns false if the id was already claimed
+func (s *syncedIdSet) Claim(id data.ObjectID) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = struct{}{}
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+func TestPersistSyncReply(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0).Add(-time.Hour)
+	objects := make([]*data.WebHookObject, 0)
+	for i := 0; i < syncPutBatchSize*2+50; i++ {
+		objects = append(objects, &data.WebHookObject{
+			ID:       data.NewObjectIdFromTimestamp(now.Add(time.Duration(i)*time.Second), uint32(i)),
+			JsonData: []byte(fmt.Sprintf(`{"a":%d}`, i)),
+		})
+	}
+	reply := func(objects []*data.WebHookObject) string {
+		var b strings.Builder
+		for _, obj := range objects {
+			b.WriteString(fmt.Sprintf("{\"id\":\"%s\",\"data\":%s,\"hash_algorithm\":%q}\n", obj.ID.Hex(), obj.JsonData, common.CurrentHashAlgorithm))
+		}
+		return b.String()
+	}
+	done := "{\"done\":true}\n"
+
+	cases := []struct {
+		name      string
+		reply     string
+		failAfter int // MemoryStore.FailAfter
+		saved     int
+		fails     bool
+		err       error // the exact error, when it's a known one
+	}{
+		{"complete", reply(objects) + done, 0, len(objects), false, nil},
+		{"truncated without done", reply(objects[:150]), 0, 150, true, io.ErrUnexpectedEOF},
+		{"malformed line mid stream", reply(objects[:120]) + "{\"id\":\n" + reply(objects[120:]) + done, 0, 120, true, nil},
+		{"batch failing partway", reply(objects) + done, syncPutBatchSize + 50, syncPutBatchSize, true, storage.MemoryStoreFaultError},
+		{"last batch failing", reply(objects) + done, syncPutBatchSize*2 + 10, syncPutBatchSize * 2, true, storage.MemoryStoreFaultError},
+	}
+
+	for _, c := range cases {
+		store := storage.NewMemoryStore()
+		store.FailAfter = c.failAfter
+
+		count, maxTimestamp, err := persistSyncReply(context.Background(), strings.NewReader(c.reply), store, newSyncedIdSet())
+		if !c.fails {
+			assert.NoError(t, err, c.name)
+		} else if c.err != nil {
+			assert.Equal(t, c.err, err, c.name)
+		} else {
+			assert.Error(t, err, c.name)
+		}
+
+		// only the saved objects move the checkpoint
+		assert.Equal(t, c.saved, count, c.name)
+		assert.Equal(t, c.saved, store.Len(), c.name)
+		assert.Equal(t, objects[c.saved-1].Timestamp(), maxTimestamp, c.name)
+	}
+}
+
+func TestPersistSyncReplyClaimed(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0).Add(-time.Hour)
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now, 1), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(time.Second), 2), JsonData: []byte(`{"a":2}`)},
+	}
+	in := fmt.Sprintf("{\"id\":\"%s\",\"data\":%s}\n{\"id\":\"%s\",\"data\":%s}\n{\"done\":true}\n",
+		objects[0].ID.Hex(), objects[0].JsonData, objects[1].ID.Hex(), objects[1].JsonData)
+
+	// another slave already sent the second one
+	synced := newSyncedIdSet()
+	synced.Claim(objects[1].ID)
+
+	store := storage.NewMemoryStore()
+	count, maxTimestamp, err := persistSyncReply(context.Background(), strings.NewReader(in), store, synced)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, objects[0].Timestamp(), maxTimestamp)
+	assert.Equal(t, 1, store.Len())
+}
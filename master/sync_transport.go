@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// sends a sync request to a slave and returns its reply
+// req is read while the request is being sent, the reply should be closed once it was read
+type SyncTransport interface {
+	Sync(ctx context.Context, req io.Reader) (io.ReadCloser, error)
+}
+
+// posts the sync request to the slave's http endpoint
+// both the request and the reply are streamed
+func NewHttpSyncTransport(client *http.Client, baseUrl string) SyncTransport {
+	return &httpSyncTransport{
+		client: client,
+		url:    strings.TrimRight(baseUrl, "/") + slaveSyncPath,
+	}
+}
+
+type httpSyncTransport struct {
+	client *http.Client
+	url    string
+}
+
+func (t *httpSyncTransport) Sync(ctx context.Context, req io.Reader) (io.ReadCloser, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, t.url, req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// invokes the slave's lambda function - the slave is served through api gateway,
+// so the request is sent as an api gateway proxy event and the reply is read from the proxy response
+// lambda functions can't receive streamed requests, so the whole request is buffered
+func NewLambdaSyncTransport(awsSession *session.Session, function string) SyncTransport {
+	return &lambdaSyncTransport{
+		session:  awsSession,
+		function: function,
+	}
+}
+
+type lambdaSyncTransport struct {
+	session  *session.Session
+	function string
+}
+
+func (t *lambdaSyncTransport) Sync(ctx context.Context, req io.Reader) (io.ReadCloser, error) {
+	body, err := ioutil.ReadAll(req)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := newSlaveSyncEvent(body)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(t.function),
+		InvocationType: aws.String("RequestResponse"),
+		LogType:        aws.String("Tail"),
+		Payload:        payload,
+	}
+
+	svc := lambda.New(t.session)
+
+	result, err := svc.InvokeWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if *result.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %v", *result.StatusCode)
+	}
+
+	if result.FunctionError != nil {
+		return nil, fmt.Errorf("slave sync failed with %s: %s", *result.FunctionError, string(result.Payload))
+	}
+
+	reply, err := slaveSyncReplyBody(result.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(reply)), nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webhooks/common"
+	"webhooks/common/app"
+	"webhooks/common/data"
+	"webhooks/common/storage"
+)
+
+func useMasterStores(stores map[string]storage.Store) {
+	App.Sources = make(map[string]*app.Source)
+	for name, store := range stores {
+		App.Sources[name] = &app.Source{Name: name, Store: store}
+	}
+}
+
+func TestHttpSyncTransport(t *testing.T) {
+	now := time.Now()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*4), 1), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*3), 2), JsonData: []byte(`{"a":2}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*2), 3), JsonData: []byte(`{"a":3}`)},
+	}
+
+	slaveStore := storage.NewMemoryStore()
+	assert.NoError(t, slaveStore.Put(context.Background(), objects))
+
+	masterStore := storage.NewMemoryStore()
+	assert.NoError(t, masterStore.Put(context.Background(), objects[:1]))
+
+	slaveServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, slaveSyncPath, r.URL.Path)
+		if fd, ok := w.(interface{ EnableFullDuplex() error }); ok {
+			assert.NoError(t, fd.EnableFullDuplex())
+		}
+		assert.NoError(t, common.ReplyToSync(r.Context(), r.Body, w, slaveStore))
+	}))
+	defer slaveServer.Close()
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	useMasterStores(map[string]storage.Store{app.DefaultWebHookSource: masterStore})
+	Checkpoints = storage.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	Slaves = []*SlaveConfig{{Name: "local", Transport: SlaveTransportHttp, Url: slaveServer.URL}}
+	Slaves[0].initTransport(nil)
+
+	results := performSync(context.Background())
+	assert.Len(t, results, 1)
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, 2, results[0].Synced)
+	synced, err := storage.LoadStorageKeysSync(context.Background(), masterStore, now.Add(-time.Hour), now)
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{objects[0].ID, objects[1].ID, objects[2].ID}, synced)
+
+	checkpoint, err := Checkpoints.Load(context.Background(), "local")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-syncMinAge).Unix(), checkpoint.Unix())
+}
+
+func TestPerformSyncMultipleSlaves(t *testing.T) {
+	now := time.Now()
+	objects := []*data.WebHookObject{
+		{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*4), 1), JsonData: []byte(`{"a":1}`)},
+		{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*3), 2), JsonData: []byte(`{"a":2}`)},
+	}
+
+	servers := make([]*httptest.Server, 0)
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+
+	newSlave := func(name string, store storage.Store) *SlaveConfig {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := common.ReplyToSync(r.Context(), r.Body, w, store); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		servers = append(servers, server)
+
+		slave := &SlaveConfig{Name: name, Transport: SlaveTransportHttp, Url: server.URL}
+		slave.initTransport(nil)
+		return slave
+	}
+
+	// both slaves have the same objects, the third one is broken
+	Slaves = make([]*SlaveConfig, 0)
+	for _, name := range []string{"a", "b", "broken"} {
+		store := storage.NewMemoryStore()
+		assert.NoError(t, store.Put(context.Background(), objects))
+		if name == "broken" {
+			store.FailAfter = len(objects)
+		}
+		Slaves = append(Slaves, newSlave(name, store))
+	}
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	masterStore := storage.NewMemoryStore()
+	useMasterStores(map[string]storage.Store{app.DefaultWebHookSource: masterStore})
+	Checkpoints = storage.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+
+	results := performSync(context.Background())
+	assert.Len(t, results, 3)
+	assert.Empty(t, results[0].Error)
+	assert.Empty(t, results[1].Error)
+	assert.Equal(t, len(objects), results[0].Synced+results[1].Synced, "objects should be saved only once")
+	assert.NotEmpty(t, results[2].Error)
+	assert.Zero(t, results[2].SyncedUntil)
+	assert.Equal(t, len(objects), masterStore.Len())
+}
+
+func TestPerformSyncSources(t *testing.T) {
+	now := time.Now()
+	// the same id in both sources - they're synced separately, so neither of them is dropped
+	id := data.NewObjectIdFromTimestamp(now.Add(-time.Minute*3), 1)
+	slaveStores := map[string]*storage.MemoryStore{
+		app.DefaultWebHookSource: storage.NewMemoryStore(),
+		"orders":                 storage.NewMemoryStore(),
+	}
+	for source, store := range slaveStores {
+		assert.NoError(t, store.Put(context.Background(), []*data.WebHookObject{{ID: id, JsonData: []byte(`{"source":"` + source + `"}`)}}))
+	}
+
+	slaveServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, common.ReplyToSourceSync(r.Context(), r.Body, w, func(source string) (storage.Store, error) {
+			return slaveStores[source], nil
+		}))
+	}))
+	defer slaveServer.Close()
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	masterStores := map[string]storage.Store{
+		app.DefaultWebHookSource: storage.NewMemoryStore(),
+		"orders":                 storage.NewMemoryStore(),
+	}
+	useMasterStores(masterStores)
+	Checkpoints = storage.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	Slaves = []*SlaveConfig{{Name: "local", Transport: SlaveTransportHttp, Url: slaveServer.URL}}
+	Slaves[0].initTransport(nil)
+
+	results := performSync(context.Background())
+	assert.Len(t, results, 2)
+	for i, source := range []string{app.DefaultWebHookSource, "orders"} {
+		assert.Equal(t, source, results[i].Source)
+		assert.Empty(t, results[i].Error)
+		assert.Equal(t, 1, results[i].Synced)
+
+		objects, err := storage.LoadStorageObjectsSync(context.Background(), masterStores[source], []data.ObjectID{id})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"source":"`+source+`"}`, string(objects[0].JsonData))
+	}
+
+	for _, key := range []string{"local", "local/orders"} {
+		checkpoint, err := Checkpoints.Load(context.Background(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, now.Add(-syncMinAge).Unix(), checkpoint.Unix(), key)
+	}
+}
+
+func TestPerformSyncLegacySlave(t *testing.T) {
+	now := time.Now()
+	newObject := func(ts time.Time, jsonData string, algorithm common.HashAlgorithm) *data.WebHookObject {
+		hash, err := common.WebHookHash(algorithm, []byte(jsonData))
+		assert.NoError(t, err)
+		obj := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(ts, hash), JsonData: []byte(jsonData)}
+		if algorithm != common.HashAlgorithmConcat {
+			obj.HashAlgorithm = string(algorithm)
+		}
+		return obj
+	}
+
+	// the slave wasn't upgraded, its objects are hashed with the legacy algorithm and don't record it
+	received := newObject(now.Add(-time.Minute*3), `{"a":{"b":1}}`, common.CurrentHashAlgorithm)
+	duplicate := newObject(received.Timestamp().Add(time.Second*10), `{"a":{"b":1}}`, common.HashAlgorithmConcat)
+	missing := newObject(received.Timestamp().Add(time.Second*20), `{"a":[2]}`, common.HashAlgorithmConcat)
+
+	slaveStore := storage.NewMemoryStore()
+	assert.NoError(t, slaveStore.Put(context.Background(), []*data.WebHookObject{duplicate, missing}))
+	masterStore := storage.NewMemoryStore()
+	assert.NoError(t, masterStore.Put(context.Background(), []*data.WebHookObject{received}))
+
+	slaveServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, common.ReplyToSync(r.Context(), r.Body, w, slaveStore))
+	}))
+	defer slaveServer.Close()
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	useMasterStores(map[string]storage.Store{app.DefaultWebHookSource: masterStore})
+	Checkpoints = storage.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	Slaves = []*SlaveConfig{{Name: "legacy", Transport: SlaveTransportHttp, Url: slaveServer.URL}}
+	Slaves[0].initTransport(nil)
+
+	results := performSync(context.Background())
+	assert.Len(t, results, 1)
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, 1, results[0].Synced, "the object master already has under another hash isn't saved again")
+
+	synced, err := storage.LoadStorageObjectsSync(context.Background(), masterStore, []data.ObjectID{received.ID, missing.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, masterStore.Len())
+	if assert.Len(t, synced, 2) {
+		assert.Empty(t, synced[1].HashAlgorithm, "the legacy object keeps its id and algorithm")
+	}
+}
+
+func TestPerformSyncLateRecords(t *testing.T) {
+	now := time.Now()
+	synced := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*4), 1), JsonData: []byte(`{"a":1}`)}
+	late := &data.WebHookObject{ID: data.NewObjectIdFromTimestamp(now.Add(-time.Minute*3), 2), JsonData: []byte(`{"a":2}`)}
+
+	slaveStore := storage.NewMemoryStore()
+	assert.NoError(t, slaveStore.Put(context.Background(), []*data.WebHookObject{synced}))
+	slaveServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, common.ReplyToSync(r.Context(), r.Body, w, slaveStore))
+	}))
+	defer slaveServer.Close()
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	masterStore := storage.NewMemoryStore()
+	useMasterStores(map[string]storage.Store{app.DefaultWebHookSource: masterStore})
+	Checkpoints = storage.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	Slaves = []*SlaveConfig{{Name: "local", Transport: SlaveTransportHttp, Url: slaveServer.URL}}
+	Slaves[0].initTransport(nil)
+
+	results := performSync(context.Background())
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, 1, results[0].Synced)
+
+	// the slave saves a record received before the checkpoint, ex its flush was retried for a while
+	assert.NoError(t, slaveStore.Put(context.Background(), []*data.WebHookObject{late}))
+
+	results = performSync(context.Background())
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, 1, results[0].Synced, "only the late record should be synced, the other one is already in master")
+	ids, err := storage.LoadStorageKeysSync(context.Background(), masterStore, now.Add(-time.Hour), now)
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ObjectID{synced.ID, late.ID}, ids)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"os"
+	"webhooks/common"
+	"webhooks/common/app"
+	"webhooks/common/storage"
+)
+
+// moves the objects saved using the flat key layout (<objectid>) to the hourly one (yyyy/mm/dd/hh/<objectid>)
+// the objects of each source configured in WEBHOOK_SOURCES are moved within their <source>/ prefix
+// objects are copied first, the old keys are deleted only when -delete is given
+// it can be run multiple times, copying an object again is harmless
+func main() {
+	bucket := flag.String("bucket", os.Getenv("S3_BUCKET"), "bucket to migrate")
+	dryRun := flag.Bool("dry-run", false, "only log what would be done")
+	deleteOld := flag.Bool("delete", false, "delete the flat keys once they were copied")
+	flag.Parse()
+
+	sources, err := app.LoadSourceConfigs()
+	if err != nil {
+		common.Logger.WithError(err).Fatal("couldn't load the sources")
+	}
+
+	// only the s3 client is needed - the app would also create the stores, the buffers and their write ahead logs
+	sess, err := app.NewAwsSession()
+	if err != nil {
+		common.Logger.WithError(err).Fatal("couldn't create the aws session")
+	}
+
+	m := &migration{
+		client:    s3.New(sess),
+		bucket:    *bucket,
+		dryRun:    *dryRun,
+		deleteOld: *deleteOld,
+	}
+	for _, source := range sources {
+		if err = m.migrateSource(context.Background(), source.Name); err != nil {
+			common.Logger.WithError(err).Fatalf("migration of source %s failed", source.Name)
+		}
+	}
+
+	common.Logger.Infof("migrated %d objects, skipped %d keys", m.copied, m.skipped)
+}
+
+type migration struct {
+	client    s3iface.S3API
+	bucket    string
+	dryRun    bool
+	deleteOld bool
+
+	copied  int
+	skipped int
+}
+
+// the flat keys of a source are all directly under its prefix - the bucket root for the default source
+func (m *migration) migrateSource(ctx context.Context, source string) error {
+	prefix := storage.S3SourcePrefix(source)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(m.bucket),
+		Delimiter: aws.String("/"),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	var copyErr error
+	err := m.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if copyErr = m.migrateKey(ctx, prefix, aws.StringValue(obj.Key)); copyErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return copyErr
+}
+
+func (m *migration) migrateKey(ctx context.Context, prefix string, oldKey string) error {
+	id, err := storage.S3KeyLayoutFlat.ParseKey(oldKey[len(prefix):])
+	if err != nil {
+		common.Logger.Warnf("skipping %s, it's not an object id", oldKey)
+		m.skipped += 1
+		return nil
+	}
+	newKey := prefix + storage.S3KeyLayoutHourly.ObjectKey(id)
+
+	if m.dryRun {
+		common.Logger.Infof("%s -> %s", oldKey, newKey)
+		return nil
+	}
+
+	_, err = m.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(m.bucket),
+		CopySource: aws.String(m.bucket + "/" + oldKey), // object ids and source names don't need to be escaped
+		Key:        aws.String(newKey),
+	})
+	if err != nil {
+		common.Logger.WithError(err).Errorf("couldn't copy %s", oldKey)
+		return err
+	}
+
+	if m.deleteOld {
+		_, err = m.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(m.bucket),
+			Key:    aws.String(oldKey),
+		})
+		if err != nil {
+			common.Logger.WithError(err).Errorf("couldn't delete %s", oldKey)
+			return err
+		}
+	}
+	m.copied += 1
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"webhooks/common/app"
+	"webhooks/common/data"
+)
+
+// keeps only the keys, listed in a single page
+type fakeS3 struct {
+	s3iface.S3API
+	keys map[string]bool
+}
+
+func (s *fakeS3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	keys := make([]string, 0)
+	for k := range s.keys {
+		rest := strings.TrimPrefix(k, aws.StringValue(input.Prefix))
+		if strings.HasPrefix(k, aws.StringValue(input.Prefix)) && !strings.Contains(rest, aws.StringValue(input.Delimiter)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	fn(out, true)
+	return nil
+}
+
+func (s *fakeS3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	s.keys[*input.Key] = true
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (s *fakeS3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	delete(s.keys, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestMigrateSource(t *testing.T) {
+	id := data.NewObjectIdFromTimestamp(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC), 7)
+	client := &fakeS3{keys: map[string]bool{
+		id.Hex():                           true,
+		"orders/" + id.Hex():               true,
+		"orders/not-an-id":                 true,
+		"2020/02/03/04/" + id.Hex():        true,
+		"payments/" + id.Hex():             true, // not a configured source
+		"orders/2020/02/03/01/" + id.Hex(): true,
+	}}
+
+	m := &migration{client: client, bucket: "webhooks", deleteOld: true}
+	for _, source := range []string{app.DefaultWebHookSource, "orders"} {
+		assert.NoError(t, m.migrateSource(context.Background(), source))
+	}
+
+	assert.Equal(t, 2, m.copied)
+	assert.Equal(t, 1, m.skipped)
+	assert.Equal(t, map[string]bool{
+		"2020/02/03/04/" + id.Hex():        true,
+		"orders/2020/02/03/04/" + id.Hex(): true,
+		"orders/not-an-id":                 true,
+		"payments/" + id.Hex():             true,
+		"orders/2020/02/03/01/" + id.Hex(): true,
+	}, client.keys)
+}